@@ -0,0 +1,255 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	componentconfig "k8s.io/component-base/config/v1alpha1"
+	cfg "sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	DefaultMetricsBindAddress      = ":8080"
+	DefaultHealthProbeBindAddress  = ":8081"
+	DefaultWebhookPort             = 9443
+	DefaultLeaderElectionID        = "0c756fb7.secrets.meln5674.github.com"
+	DefaultMaxConcurrentReconciles = 1
+	DefaultRateLimiterBaseDelay    = 5 * time.Millisecond
+	DefaultRateLimiterMaxDelay     = 1000 * time.Second
+	DefaultRateLimiterQPS          = 10
+	DefaultRateLimiterBurst        = 100
+	DefaultImpersonationCacheSize  = 256
+	DefaultImpersonationCacheTTL   = 10 * time.Minute
+	DefaultTracingSamplingRatio    = 1.0
+	DefaultTemplateMaxOutputBytes  = 1024 * 1024
+	DefaultTemplateTimeout         = time.Second
+	DefaultTemplateMaxIterations   = 10000
+
+	// The defaults of the manager's leader election timings, which are used to validate the timings that are set
+	defaultLeaseDuration = 15 * time.Second
+	defaultRenewDeadline = 10 * time.Second
+	defaultRetryPeriod   = 2 * time.Second
+	// leaderElectionJitter is the factor by which the renew deadline must exceed the retry period
+	leaderElectionJitter = 1.2
+)
+
+// NewOperatorConfig returns the configuration used when no file is provided
+func NewOperatorConfig() *OperatorConfig {
+	config := &OperatorConfig{TypeMeta: metav1.TypeMeta{APIVersion: GroupVersion.String(), Kind: "OperatorConfig"}}
+	config.Default()
+	return config
+}
+
+// LoadOperatorConfig reads a configuration file, rejecting unknown fields, and fills in defaults for any fields which are not set
+func LoadOperatorConfig(path string) (*OperatorConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &OperatorConfig{}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %w", path, err)
+	}
+	if config.APIVersion != GroupVersion.String() || config.Kind != "OperatorConfig" {
+		return nil, fmt.Errorf("%s must have apiVersion %s and kind OperatorConfig, got apiVersion %q and kind %q", path, GroupVersion, config.APIVersion, config.Kind)
+	}
+	config.Default()
+	return config, nil
+}
+
+// Default fills in defaults for any fields which are not set
+func (c *OperatorConfig) Default() {
+	if c.Metrics.BindAddress == "" {
+		c.Metrics.BindAddress = DefaultMetricsBindAddress
+	}
+	if c.Health.HealthProbeBindAddress == "" {
+		c.Health.HealthProbeBindAddress = DefaultHealthProbeBindAddress
+	}
+	if c.Webhook.Port == nil {
+		port := DefaultWebhookPort
+		c.Webhook.Port = &port
+	}
+	if c.LeaderElection == nil {
+		c.LeaderElection = &componentconfig.LeaderElectionConfiguration{}
+	}
+	if c.LeaderElection.LeaderElect == nil {
+		leaderElect := false
+		c.LeaderElection.LeaderElect = &leaderElect
+	}
+	if c.LeaderElection.ResourceName == "" {
+		c.LeaderElection.ResourceName = DefaultLeaderElectionID
+	}
+	if c.Reconcile.MaxConcurrentReconciles == 0 {
+		c.Reconcile.MaxConcurrentReconciles = DefaultMaxConcurrentReconciles
+	}
+	if c.Reconcile.RateLimiter.BaseDelay == nil {
+		c.Reconcile.RateLimiter.BaseDelay = &metav1.Duration{Duration: DefaultRateLimiterBaseDelay}
+	}
+	if c.Reconcile.RateLimiter.MaxDelay == nil {
+		c.Reconcile.RateLimiter.MaxDelay = &metav1.Duration{Duration: DefaultRateLimiterMaxDelay}
+	}
+	if c.Reconcile.RateLimiter.QPS == 0 {
+		c.Reconcile.RateLimiter.QPS = DefaultRateLimiterQPS
+	}
+	if c.Reconcile.RateLimiter.Burst == 0 {
+		c.Reconcile.RateLimiter.Burst = DefaultRateLimiterBurst
+	}
+	if c.Templates.MaxOutputBytes == nil {
+		maxOutputBytes := DefaultTemplateMaxOutputBytes
+		c.Templates.MaxOutputBytes = &maxOutputBytes
+	}
+	if c.Templates.Timeout == nil {
+		c.Templates.Timeout = &metav1.Duration{Duration: DefaultTemplateTimeout}
+	}
+	if c.Templates.MaxIterations == nil {
+		maxIterations := DefaultTemplateMaxIterations
+		c.Templates.MaxIterations = &maxIterations
+	}
+	if c.Impersonation.CacheSize == nil {
+		size := DefaultImpersonationCacheSize
+		c.Impersonation.CacheSize = &size
+	}
+	if c.Impersonation.CacheTTL == nil {
+		c.Impersonation.CacheTTL = &metav1.Duration{Duration: DefaultImpersonationCacheTTL}
+	}
+	if c.Tracing.SamplingRatio == nil {
+		ratio := DefaultTracingSamplingRatio
+		c.Tracing.SamplingRatio = &ratio
+	}
+}
+
+// Validate checks that a configuration, after defaults have been filled in, can be used to start the operator
+func (c *OperatorConfig) Validate() error {
+	errs := field.ErrorList{}
+
+	if c.CacheNamespace != "" {
+		errs = append(errs, field.Forbidden(field.NewPath("cacheNamespace"), "use namespaces.watch instead"))
+	}
+	if c.Webhook.Port != nil && (*c.Webhook.Port < 1 || *c.Webhook.Port > 65535) {
+		errs = append(errs, field.Invalid(field.NewPath("webhook", "port"), *c.Webhook.Port, "must be between 1 and 65535"))
+	}
+	if c.LeaderElection != nil {
+		errs = append(errs, validateLeaderElection(field.NewPath("leaderElection"), c.LeaderElection)...)
+	}
+	if c.Controller != nil {
+		for groupKind, concurrency := range c.Controller.GroupKindConcurrency {
+			if concurrency < 1 {
+				errs = append(errs, field.Invalid(field.NewPath("controller", "groupKindConcurrency").Key(groupKind), concurrency, "must be at least 1"))
+			}
+		}
+	}
+
+	reconcilePath := field.NewPath("reconcile")
+	if c.Reconcile.MaxConcurrentReconciles < 1 {
+		errs = append(errs, field.Invalid(reconcilePath.Child("maxConcurrentReconciles"), c.Reconcile.MaxConcurrentReconciles, "must be at least 1"))
+	}
+	if c.Reconcile.DefaultResyncInterval != nil && c.Reconcile.DefaultResyncInterval.Duration <= 0 {
+		errs = append(errs, field.Invalid(reconcilePath.Child("defaultResyncInterval"), c.Reconcile.DefaultResyncInterval.Duration.String(), "must be positive"))
+	}
+	rateLimiter := &c.Reconcile.RateLimiter
+	rateLimiterPath := reconcilePath.Child("rateLimiter")
+	if rateLimiter.BaseDelay != nil && rateLimiter.BaseDelay.Duration <= 0 {
+		errs = append(errs, field.Invalid(rateLimiterPath.Child("baseDelay"), rateLimiter.BaseDelay.Duration.String(), "must be positive"))
+	}
+	if rateLimiter.BaseDelay != nil && rateLimiter.MaxDelay != nil && rateLimiter.MaxDelay.Duration < rateLimiter.BaseDelay.Duration {
+		errs = append(errs, field.Invalid(rateLimiterPath.Child("maxDelay"), rateLimiter.MaxDelay.Duration.String(), "must not be less than baseDelay"))
+	}
+	if rateLimiter.QPS <= 0 {
+		errs = append(errs, field.Invalid(rateLimiterPath.Child("qps"), rateLimiter.QPS, "must be positive"))
+	}
+	if rateLimiter.Burst < 1 {
+		errs = append(errs, field.Invalid(rateLimiterPath.Child("burst"), rateLimiter.Burst, "must be at least 1"))
+	}
+
+	templatesPath := field.NewPath("templates")
+	if c.Templates.MaxOutputBytes != nil && *c.Templates.MaxOutputBytes < 0 {
+		errs = append(errs, field.Invalid(templatesPath.Child("maxOutputBytes"), *c.Templates.MaxOutputBytes, "must not be negative"))
+	}
+	if c.Templates.Timeout != nil && c.Templates.Timeout.Duration < 0 {
+		errs = append(errs, field.Invalid(templatesPath.Child("timeout"), c.Templates.Timeout.Duration.String(), "must not be negative"))
+	}
+	if c.Templates.MaxIterations != nil && *c.Templates.MaxIterations < 0 {
+		errs = append(errs, field.Invalid(templatesPath.Child("maxIterations"), *c.Templates.MaxIterations, "must not be negative"))
+	}
+
+	namespacesPath := field.NewPath("namespaces")
+	errs = append(errs, validateNamespaces(namespacesPath.Child("watch"), c.Namespaces.Watch)...)
+	errs = append(errs, validateNamespaces(namespacesPath.Child("target"), c.Namespaces.Target)...)
+
+	impersonationPath := field.NewPath("impersonation")
+	if c.Impersonation.CacheSize != nil && *c.Impersonation.CacheSize < 0 {
+		errs = append(errs, field.Invalid(impersonationPath.Child("cacheSize"), *c.Impersonation.CacheSize, "must not be negative"))
+	}
+	if c.Impersonation.CacheTTL != nil && c.Impersonation.CacheTTL.Duration < 0 {
+		errs = append(errs, field.Invalid(impersonationPath.Child("cacheTTL"), c.Impersonation.CacheTTL.Duration.String(), "must not be negative"))
+	}
+
+	tracingPath := field.NewPath("tracing")
+	if c.Tracing.SamplingRatio != nil && (*c.Tracing.SamplingRatio < 0 || *c.Tracing.SamplingRatio > 1) {
+		errs = append(errs, field.Invalid(tracingPath.Child("samplingRatio"), *c.Tracing.SamplingRatio, "must be between 0 and 1"))
+	}
+
+	return errs.ToAggregate()
+}
+
+// validateLeaderElection checks the leader election timings against each other, using the manager's defaults for any which are not set
+func validateLeaderElection(path *field.Path, leaderElection *componentconfig.LeaderElectionConfiguration) field.ErrorList {
+	errs := field.ErrorList{}
+	leaseDuration := orDefault(leaderElection.LeaseDuration, defaultLeaseDuration)
+	renewDeadline := orDefault(leaderElection.RenewDeadline, defaultRenewDeadline)
+	retryPeriod := orDefault(leaderElection.RetryPeriod, defaultRetryPeriod)
+	if retryPeriod <= 0 {
+		errs = append(errs, field.Invalid(path.Child("retryPeriod"), retryPeriod.String(), "must be positive"))
+	}
+	if renewDeadline <= time.Duration(leaderElectionJitter*float64(retryPeriod)) {
+		errs = append(errs, field.Invalid(path.Child("renewDeadline"), renewDeadline.String(), fmt.Sprintf("must be greater than %v times retryPeriod (%s)", leaderElectionJitter, retryPeriod)))
+	}
+	if leaseDuration <= renewDeadline {
+		errs = append(errs, field.Invalid(path.Child("leaseDuration"), leaseDuration.String(), fmt.Sprintf("must be greater than renewDeadline (%s)", renewDeadline)))
+	}
+	return errs
+}
+
+func orDefault(duration metav1.Duration, defaultDuration time.Duration) time.Duration {
+	if duration.Duration == 0 {
+		return defaultDuration
+	}
+	return duration.Duration
+}
+
+func validateNamespaces(path *field.Path, namespaces []string) field.ErrorList {
+	errs := field.ErrorList{}
+	for ix, namespace := range namespaces {
+		for _, msg := range validation.IsDNS1123Label(namespace) {
+			errs = append(errs, field.Invalid(path.Index(ix), namespace, msg))
+		}
+	}
+	return errs
+}
+
+// Complete implements config.ControllerManagerConfiguration, so that the configuration can be passed to ctrl.Options.AndFrom
+func (c *OperatorConfig) Complete() (cfg.ControllerManagerConfigurationSpec, error) {
+	return c.ControllerManagerConfigurationSpec, c.Validate()
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v1alpha1
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	componentconfig "k8s.io/component-base/config/v1alpha1"
+)
+
+func TestDefault(t *testing.T) {
+	cases := []struct {
+		name   string
+		config OperatorConfig
+		check  func(t *testing.T, config *OperatorConfig)
+	}{
+		{
+			name: "empty",
+			check: func(t *testing.T, config *OperatorConfig) {
+				if config.Metrics.BindAddress != DefaultMetricsBindAddress {
+					t.Errorf("Expected metrics bind address %q, got %q", DefaultMetricsBindAddress, config.Metrics.BindAddress)
+				}
+				if config.Health.HealthProbeBindAddress != DefaultHealthProbeBindAddress {
+					t.Errorf("Expected health probe bind address %q, got %q", DefaultHealthProbeBindAddress, config.Health.HealthProbeBindAddress)
+				}
+				if *config.Webhook.Port != DefaultWebhookPort {
+					t.Errorf("Expected webhook port %d, got %d", DefaultWebhookPort, *config.Webhook.Port)
+				}
+				if *config.LeaderElection.LeaderElect || config.LeaderElection.ResourceName != DefaultLeaderElectionID {
+					t.Errorf("Expected leader election to be disabled with ID %q, got %v with ID %q", DefaultLeaderElectionID, *config.LeaderElection.LeaderElect, config.LeaderElection.ResourceName)
+				}
+				if config.Reconcile.MaxConcurrentReconciles != DefaultMaxConcurrentReconciles {
+					t.Errorf("Expected %d concurrent reconciles, got %d", DefaultMaxConcurrentReconciles, config.Reconcile.MaxConcurrentReconciles)
+				}
+				rateLimiter := config.Reconcile.RateLimiter
+				if rateLimiter.BaseDelay.Duration != DefaultRateLimiterBaseDelay || rateLimiter.MaxDelay.Duration != DefaultRateLimiterMaxDelay || rateLimiter.QPS != DefaultRateLimiterQPS || rateLimiter.Burst != DefaultRateLimiterBurst {
+					t.Errorf("Expected the default rate limiter, got %+v", rateLimiter)
+				}
+				if *config.Templates.MaxOutputBytes != DefaultTemplateMaxOutputBytes || config.Templates.Timeout.Duration != DefaultTemplateTimeout || *config.Templates.MaxIterations != DefaultTemplateMaxIterations {
+					t.Errorf("Expected the default template limits, got %+v", config.Templates)
+				}
+				if *config.Impersonation.CacheSize != DefaultImpersonationCacheSize || config.Impersonation.CacheTTL.Duration != DefaultImpersonationCacheTTL {
+					t.Errorf("Expected the default impersonation cache, got %+v", config.Impersonation)
+				}
+				if *config.Tracing.SamplingRatio != DefaultTracingSamplingRatio {
+					t.Errorf("Expected sampling ratio %v, got %v", DefaultTracingSamplingRatio, *config.Tracing.SamplingRatio)
+				}
+			},
+		},
+		{
+			name: "set fields are kept",
+			config: func() OperatorConfig {
+				config := OperatorConfig{}
+				config.Metrics.BindAddress = ":9090"
+				config.LeaderElection = &componentconfig.LeaderElectionConfiguration{ResourceName: "other"}
+				config.Reconcile.MaxConcurrentReconciles = 4
+				config.Reconcile.RateLimiter.MaxDelay = &metav1.Duration{Duration: time.Minute}
+				config.Templates.Timeout = &metav1.Duration{Duration: 0}
+				return config
+			}(),
+			check: func(t *testing.T, config *OperatorConfig) {
+				if config.Metrics.BindAddress != ":9090" {
+					t.Errorf("Expected metrics bind address to be kept, got %q", config.Metrics.BindAddress)
+				}
+				if config.LeaderElection.ResourceName != "other" || config.LeaderElection.LeaderElect == nil {
+					t.Errorf("Expected leader election ID to be kept and leaderElect to be defaulted, got %+v", config.LeaderElection)
+				}
+				if config.Reconcile.MaxConcurrentReconciles != 4 {
+					t.Errorf("Expected concurrent reconciles to be kept, got %d", config.Reconcile.MaxConcurrentReconciles)
+				}
+				if config.Reconcile.RateLimiter.MaxDelay.Duration != time.Minute || config.Reconcile.RateLimiter.BaseDelay.Duration != DefaultRateLimiterBaseDelay {
+					t.Errorf("Expected max delay to be kept and base delay to be defaulted, got %+v", config.Reconcile.RateLimiter)
+				}
+				if config.Templates.Timeout.Duration != 0 {
+					t.Errorf("Expected an explicitly disabled timeout to be kept, got %s", config.Templates.Timeout.Duration)
+				}
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := tc.config
+			config.Default()
+			tc.check(t, &config)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		mutate func(config *OperatorConfig)
+		field  string
+	}{
+		{
+			name:   "defaults",
+			mutate: func(config *OperatorConfig) {},
+		},
+		{
+			name:   "cache namespace",
+			mutate: func(config *OperatorConfig) { config.CacheNamespace = "app-ns" },
+			field:  "cacheNamespace",
+		},
+		{
+			name: "webhook port",
+			mutate: func(config *OperatorConfig) {
+				port := 70000
+				config.Webhook.Port = &port
+			},
+			field: "webhook.port",
+		},
+		{
+			name: "lease duration shorter than renew deadline",
+			mutate: func(config *OperatorConfig) {
+				config.LeaderElection.LeaseDuration = metav1.Duration{Duration: 5 * time.Second}
+			},
+			field: "leaderElection.leaseDuration",
+		},
+		{
+			name:   "no concurrent reconciles",
+			mutate: func(config *OperatorConfig) { config.Reconcile.MaxConcurrentReconciles = -1 },
+			field:  "reconcile.maxConcurrentReconciles",
+		},
+		{
+			name: "max delay below base delay",
+			mutate: func(config *OperatorConfig) {
+				config.Reconcile.RateLimiter.MaxDelay = &metav1.Duration{Duration: time.Millisecond}
+			},
+			field: "reconcile.rateLimiter.maxDelay",
+		},
+		{
+			name:   "negative QPS",
+			mutate: func(config *OperatorConfig) { config.Reconcile.RateLimiter.QPS = -1 },
+			field:  "reconcile.rateLimiter.qps",
+		},
+		{
+			name: "negative template iterations",
+			mutate: func(config *OperatorConfig) {
+				maxIterations := -1
+				config.Templates.MaxIterations = &maxIterations
+			},
+			field: "templates.maxIterations",
+		},
+		{
+			name:   "invalid namespace",
+			mutate: func(config *OperatorConfig) { config.Namespaces.Watch = []string{"app-ns", "Not_A_Namespace"} },
+			field:  "namespaces.watch[1]",
+		},
+		{
+			name: "negative impersonation cache TTL",
+			mutate: func(config *OperatorConfig) {
+				config.Impersonation.CacheTTL = &metav1.Duration{Duration: -time.Second}
+			},
+			field: "impersonation.cacheTTL",
+		},
+		{
+			name: "sampling ratio above 1",
+			mutate: func(config *OperatorConfig) {
+				ratio := 1.5
+				config.Tracing.SamplingRatio = &ratio
+			},
+			field: "tracing.samplingRatio",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := NewOperatorConfig()
+			tc.mutate(config)
+			err := config.Validate()
+			if tc.field == "" {
+				if err != nil {
+					t.Fatalf("Expected configuration to be valid, got %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.field) {
+				t.Fatalf("Expected an error for %s, got %v", tc.field, err)
+			}
+		})
+	}
+}
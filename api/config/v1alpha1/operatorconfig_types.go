@@ -0,0 +1,146 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cfg "sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
+)
+
+// ReconcileConfig configures how resources are reconciled and retried
+type ReconcileConfig struct {
+	// MaxConcurrentReconciles is how many resources of each kind may be reconciled at once. Defaults to 1.
+	// controller.groupKindConcurrency overrides this for individual kinds, e.g. DerivedSecret.secrets.meln5674.github.com
+	// +optional
+	MaxConcurrentReconciles int `json:"maxConcurrentReconciles,omitempty"`
+	// DefaultResyncInterval is how often to regenerate derived objects of resources which do not set their own resyncInterval.
+	// If not set, derived objects are only regenerated when their resource or its references change
+	// +optional
+	DefaultResyncInterval *metav1.Duration `json:"defaultResyncInterval,omitempty"`
+	// RateLimiter determines how quickly failed reconciles are retried
+	// +optional
+	RateLimiter RateLimiterConfig `json:"rateLimiter,omitempty"`
+	// RequireServiceAccountReferences reads the references of every DerivedSecret and DerivedConfigMap by impersonating its ServiceAccount,
+	// regardless of spec.referenceAccess. ClusterDerivedSecrets have no ServiceAccount, so they are not reconciled if this is set
+	// +optional
+	RequireServiceAccountReferences bool `json:"requireServiceAccountReferences,omitempty"`
+}
+
+// RateLimiterConfig configures the workqueue rate limiter of each controller, which is the larger of a per-resource exponential backoff,
+// and an overall token bucket
+type RateLimiterConfig struct {
+	// BaseDelay is how long to wait before retrying a resource after its first failure. The delay doubles with each consecutive failure. Defaults to 5ms
+	// +optional
+	BaseDelay *metav1.Duration `json:"baseDelay,omitempty"`
+	// MaxDelay is the longest delay between retries of a resource. Defaults to 1000s
+	// +optional
+	MaxDelay *metav1.Duration `json:"maxDelay,omitempty"`
+	// QPS is how many retries per second may be queued across all resources. Defaults to 10
+	// +optional
+	QPS float64 `json:"qps,omitempty"`
+	// Burst is how many retries may be queued at once before QPS applies. Defaults to 100
+	// +optional
+	Burst int `json:"burst,omitempty"`
+}
+
+// TemplateConfig configures the templates of derived objects
+type TemplateConfig struct {
+	// AllowedFunctions are the only functions which templates may use. If empty, every function is allowed
+	// +optional
+	AllowedFunctions []string `json:"allowedFunctions,omitempty"`
+	// DeniedFunctions are functions which templates may not use, even if they are in allowedFunctions.
+	// env, expandenv, and getHostByName are never available, and may not be named here or in allowedFunctions
+	// +optional
+	DeniedFunctions []string `json:"deniedFunctions,omitempty"`
+	// MaxOutputBytes is the most output a single template may produce, and the longest string any function may return. 0 disables the limit. Defaults to 1048576 (1MiB)
+	// +optional
+	MaxOutputBytes *int `json:"maxOutputBytes,omitempty"`
+	// Timeout is how long a single template may execute. 0 disables the limit. Defaults to 1s
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// MaxIterations is the most steps a single template may take, where every function call, call of another template,
+	// element ranged over, and element produced by functions such as until, untilStep, and seq is a step.
+	// It is also the most elements a list or dict returned by a function may have. 0 disables the limit. Defaults to 10000
+	// +optional
+	MaxIterations *int `json:"maxIterations,omitempty"`
+}
+
+// NamespaceConfig restricts the namespaces the operator reconciles resources in, and writes derived objects to
+type NamespaceConfig struct {
+	// Watch are the namespaces whose resources are reconciled. If empty, all namespaces are watched
+	// +optional
+	Watch []string `json:"watch,omitempty"`
+	// Target are the namespaces, in addition to the watched namespaces, that derived objects may be written to.
+	// If both this and watch are empty, derived objects may be written to any namespace
+	// +optional
+	Target []string `json:"target,omitempty"`
+}
+
+// ImpersonationConfig configures the cache of clients which impersonate ServiceAccounts
+type ImpersonationConfig struct {
+	// CacheSize is the maximum number of clients to keep. 0 disables the limit. Defaults to 256
+	// +optional
+	CacheSize *int `json:"cacheSize,omitempty"`
+	// CacheTTL is how long to keep a client before building a new one. 0 keeps clients until they are evicted. Defaults to 10m
+	// +optional
+	CacheTTL *metav1.Duration `json:"cacheTTL,omitempty"`
+}
+
+// TracingConfig configures the export of traces of reconciles
+type TracingConfig struct {
+	// OTLPEndpoint is the host and port of an OTLP/HTTP collector to export traces to. Traces are not exported if not set
+	// +optional
+	OTLPEndpoint string `json:"otlpEndpoint,omitempty"`
+	// Insecure exports traces over plain HTTP instead of HTTPS
+	// +optional
+	Insecure bool `json:"insecure,omitempty"`
+	// SamplingRatio is the fraction of reconciles to trace, from 0 to 1. Defaults to 1
+	// +optional
+	SamplingRatio *float64 `json:"samplingRatio,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// OperatorConfig is the configuration file of the operator, passed with --config.
+// Flags which are set on the command line override the corresponding fields
+type OperatorConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ControllerManagerConfigurationSpec configures the manager, including leader election timings, metrics, health probes, and the webhook server
+	cfg.ControllerManagerConfigurationSpec `json:",inline"`
+
+	// Reconcile configures how resources are reconciled and retried
+	// +optional
+	Reconcile ReconcileConfig `json:"reconcile,omitempty"`
+	// Templates configures the templates of derived objects
+	// +optional
+	Templates TemplateConfig `json:"templates,omitempty"`
+	// Namespaces restricts the namespaces the operator reconciles resources in, and writes derived objects to
+	// +optional
+	Namespaces NamespaceConfig `json:"namespaces,omitempty"`
+	// Impersonation configures the cache of clients which impersonate ServiceAccounts
+	// +optional
+	Impersonation ImpersonationConfig `json:"impersonation,omitempty"`
+	// Tracing configures the export of traces of reconciles
+	// +optional
+	Tracing TracingConfig `json:"tracing,omitempty"`
+}
+
+func init() {
+	SchemeBuilder.Register(&OperatorConfig{})
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2022 Andrew Melnick
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClusterDerivedSecretSpec defines the desired state of ClusterDerivedSecret
+type ClusterDerivedSecretSpec struct {
+	// NamespaceSelector selects the Namespaces in which to create the derived Secret. An empty selector matches every Namespace
+	NamespaceSelector metav1.LabelSelector `json:"namespaceSelector"`
+	// ReferenceNamespace is the Namespace to fetch References from. If not set, References are fetched from each selected Namespace
+	// +optional
+	ReferenceNamespace string `json:"referenceNamespace,omitempty"`
+	// References is a list of ConfigMaps or Secrets that can be referenced in the data or stringData templates
+	References []SensitiveReference `json:"references"`
+	// TargetType is the "type" field of the derived Secrets. Same default as a Secret
+	// +optional
+	TargetType corev1.SecretType `json:"targetType,omitempty"`
+	// TargetName is the name of the Secret to create in each Namespace. Defaults to the same as the ClusterDerivedSecret
+	// +optional
+	TargetName string `json:"targetName,omitempty"`
+
+	// Data is a map of keys to values that should produce base64-encoded binary data (e.g. with b64enc) to include in the Secret's data
+	// +optional
+	Data map[string]BinaryTarget `json:"data,omitempty"`
+	// StringData is a set of map of keys to templates that should produce string data to include in the Secret's stringData
+	// +optional
+	StringData map[string]StringTarget `json:"stringData,omitempty"`
+	// Prefab is a set of common options to use instead of data/stringData
+	// +optional
+	Prefab *Prefabs `json:"prefab,omitempty"`
+	// Strict is the default of the strict field of each template. Strict templates fail if they use a reference or key which does not exist,
+	// instead of rendering "<no value>", or if they produce empty output. Defaults to false
+	// +optional
+	Strict *bool `json:"strict,omitempty"`
+}
+
+// ClusterDerivedSecretTarget is a Secret produced by a ClusterDerivedSecret in a single Namespace
+type ClusterDerivedSecretTarget struct {
+	// Namespace is the namespace of the generated Secret
+	Namespace string `json:"namespace"`
+	// Name is the name of the generated Secret
+	Name string `json:"name"`
+	// Error is the error message from the last sync attempt for this Namespace, if any
+	// +optional
+	Error string `json:"error,omitempty"`
+	// LastSync is the time when the Secret in this Namespace was last generated
+	// +optional
+	LastSync *metav1.Time `json:"lastSync,omitempty"`
+	// MissingReferences are the names of optional references which did not exist when references were last fetched for this Namespace
+	// +optional
+	MissingReferences []string `json:"missingReferences,omitempty"`
+}
+
+// ClusterDerivedSecretStatus defines the observed state of ClusterDerivedSecret
+type ClusterDerivedSecretStatus struct {
+	// Targets are the Secrets that were generated, one per selected Namespace
+	// +optional
+	Targets []ClusterDerivedSecretTarget `json:"targets,omitempty"`
+	// Error is the error message from the last sync attempt, if any
+	// +optional
+	Error string `json:"error,omitempty"`
+	// LastSync is the time when every Secret was last generated without error
+	// +optional
+	LastSync *metav1.Time `json:"lastSync,omitempty"`
+	// LastSyncAttempt is the time when the Secrets were last attmpted to be generated
+	// +optional
+	LastSyncAttempt *metav1.Time `json:"lastSyncAttempt,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+
+// ClusterDerivedSecret is the Schema for the clusterderivedsecrets API
+type ClusterDerivedSecret struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterDerivedSecretSpec   `json:"spec,omitempty"`
+	Status ClusterDerivedSecretStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterDerivedSecretList contains a list of ClusterDerivedSecret
+type ClusterDerivedSecretList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterDerivedSecret `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterDerivedSecret{}, &ClusterDerivedSecretList{})
+}
@@ -2,6 +2,7 @@ package v1alpha1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	client "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -12,8 +13,52 @@ const (
 	DerivedFromKindLabel      = "secrets-operator.meln5674.github.com/derived-from.kind"
 	DerivedFromVersionLabel   = "secrets-operator.meln5674.github.com/derived-from.version"
 	DefaultIsMap              = false
+	// ManagedKeysAnnotation is set on derived objects to the comma-separated list of keys the operator wrote,
+	// so that keys which are no longer rendered can be removed
+	ManagedKeysAnnotation = "secrets-operator.meln5674.github.com/managed-keys"
+	// CleanupFinalizer is added to resources which produce derived objects, so that their deletion policy can be applied
+	CleanupFinalizer = "secrets-operator.meln5674.github.com/cleanup"
 )
 
+// DeletionPolicy is what happens to derived objects when the resource they were derived from is deleted
+// +kubebuilder:validation:Enum=Delete;Orphan;Retain
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete deletes derived objects
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyOrphan leaves derived objects in place, and removes any labels or owner references that associate them with the deleted resource
+	DeletionPolicyOrphan DeletionPolicy = "Orphan"
+	// DeletionPolicyRetain leaves derived objects in place, and keeps their derived-from labels,
+	// so that they are adopted if a resource with the same name is created again
+	DeletionPolicyRetain  DeletionPolicy = "Retain"
+	DefaultDeletionPolicy                = DeletionPolicyDelete
+)
+
+// ReferenceAccess is whose privileges are used to read references in the same namespace as the referencing resource
+// +kubebuilder:validation:Enum=Operator;ServiceAccount
+type ReferenceAccess string
+
+const (
+	// ReferenceAccessOperator reads references in the same namespace with the operator's own privileges
+	ReferenceAccessOperator ReferenceAccess = "Operator"
+	// ReferenceAccessServiceAccount reads all references by impersonating the referencing resource's ServiceAccount,
+	// so that a reference can only be used if that ServiceAccount could read it directly
+	ReferenceAccessServiceAccount ReferenceAccess = "ServiceAccount"
+	DefaultReferenceAccess                        = ReferenceAccessOperator
+)
+
+// DerivedObjectReference identifies an object that was written by the operator
+type DerivedObjectReference struct {
+	// Namespace is the namespace of the object
+	Namespace string `json:"namespace"`
+	// Name is the name of the object
+	Name string `json:"name"`
+	// UID is the UID of the object when it was written. An object with the same name but a different UID was not written by the operator
+	// +optional
+	UID types.UID `json:"uid,omitempty"`
+}
+
 func DerivedFromLabelValues(obj client.Object) map[string]string {
 	gvk := obj.GetObjectKind().GroupVersionKind()
 	return map[string]string{
@@ -37,13 +82,34 @@ func DerivedFromLabelValues(obj client.Object) map[string]string {
 // FieldSet is a list map of keys to golang text/template template strings
 // type FieldSet = map[ReferenceKey]Template
 
+// ConfigMapReference selects a ConfigMap, possibly in another Namespace
+type ConfigMapReference struct {
+	corev1.ConfigMapEnvSource `json:",inline"`
+	// Namespace is the Namespace of the ConfigMap. Defaults to the same Namespace as the referencing resource.
+	// If set to a different Namespace, the ConfigMap is read by impersonating the referencing resource's ServiceAccount
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// SecretReference selects a Secret, possibly in another Namespace
+type SecretReference struct {
+	corev1.SecretEnvSource `json:",inline"`
+	// Namespace is the Namespace of the Secret. Defaults to the same Namespace as the referencing resource.
+	// If set to a different Namespace, the Secret is read by impersonating the referencing resource's ServiceAccount
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
 // Reference binds a ConfigMap to a name that can be referenced in a template
 type Reference struct {
 	// Name is the name to reference this ConfigMap in a template
 	// Name ReferenceName `json:"name"` // controller-tools doesn't work
 	Name string `json:"name"`
 	// ConfigMapRef specifies the ConfigMap to use
-	ConfigMapRef corev1.ConfigMapEnvSource `json:"configMapRef"`
+	ConfigMapRef ConfigMapReference `json:"configMapRef"`
+	// Defaults are the values templates and prefabs see for keys which are not in the ConfigMap, or for every key if it is optional and does not exist
+	// +optional
+	Defaults map[string]string `json:"defaults,omitempty"`
 }
 
 // AsSensitiveReference converts a non-sensitive (ConfigMap) Reference to one that could possibly contain a Secret instead
@@ -51,6 +117,7 @@ func (r *Reference) AsSensitiveReference() SensitiveReference {
 	return SensitiveReference{
 		Name:         r.Name,
 		ConfigMapRef: &r.ConfigMapRef,
+		Defaults:     r.Defaults,
 	}
 }
 
@@ -61,10 +128,39 @@ type SensitiveReference struct {
 	Name string `json:"name"`
 	// ConfigMapRef specifies a ConfigMap to use
 	// +optional
-	ConfigMapRef *corev1.ConfigMapEnvSource `json:"configMapRef,omitEmpty"`
+	ConfigMapRef *ConfigMapReference `json:"configMapRef,omitEmpty"`
 	// SecretRef specifies a Secret to use
 	// +optional
-	SecretRef *corev1.SecretEnvSource `json:"secretRef,omityEmpty"`
+	SecretRef *SecretReference `json:"secretRef,omityEmpty"`
+	// Defaults are the values templates and prefabs see for keys which are not in the ConfigMap or Secret, or for every key if it is optional and does not exist.
+	// Defaults of a Secret are bytes, like the rest of its data
+	// +optional
+	Defaults map[string]string `json:"defaults,omitempty"`
+}
+
+// IsOptional returns true if the referenced ConfigMap or Secret may not exist
+func (r *SensitiveReference) IsOptional() bool {
+	var optional *bool
+	if r.ConfigMapRef != nil {
+		optional = r.ConfigMapRef.Optional
+	} else if r.SecretRef != nil {
+		optional = r.SecretRef.Optional
+	}
+	return optional != nil && *optional
+}
+
+// NamespaceOrDefault returns the Namespace of the referenced ConfigMap or Secret, given the Namespace of the referencing resource
+func (r *SensitiveReference) NamespaceOrDefault(defaultNamespace string) string {
+	var namespace string
+	if r.ConfigMapRef != nil {
+		namespace = r.ConfigMapRef.Namespace
+	} else if r.SecretRef != nil {
+		namespace = r.SecretRef.Namespace
+	}
+	if namespace == "" {
+		return defaultNamespace
+	}
+	return namespace
 }
 
 // ReferenceSubset refers to a subset of keys in a Reference
@@ -83,6 +179,7 @@ type ReferenceSubset struct {
 
 const (
 	DefaultTargetOverwrite = true
+	DefaultStrict          = false
 )
 
 type TargetBase struct {
@@ -94,6 +191,10 @@ type TargetBase struct {
 	Overwrite *bool `json:"overwrite"`
 	// IsMap indicates that a target's template output is not a single field, but instead, should be parsed as a YAML map and the merged into the final map.
 	IsMap *bool `json:"isMap,omitempty"`
+	// Strict fails the template if it uses a reference or key which does not exist, instead of rendering "<no value>",
+	// or if it produces empty output. Overrides the strict field of the resource
+	// +optional
+	Strict *bool `json:"strict,omitempty"`
 }
 
 // Target specifies a target field in a Secret.stringData or ConfigMap.data
@@ -0,0 +1,90 @@
+/*
+Copyright 2022 Andrew Melnick
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v1alpha1
+
+const (
+	// ConditionReady is true when every other condition is true, meaning the derived object is up to date with the current generation
+	ConditionReady = "Ready"
+	// ConditionReferencesResolved is true when every reference was fetched
+	ConditionReferencesResolved = "ReferencesResolved"
+	// ConditionRendered is true when every template or prefab was rendered
+	ConditionRendered = "Rendered"
+	// ConditionTargetSynced is true when the derived object was written
+	ConditionTargetSynced = "TargetSynced"
+)
+
+const (
+	// ReasonSynced means a stage, or the entire reconciliation, succeeded
+	ReasonSynced = "Synced"
+	// ReasonNotAttempted means a stage was not attempted because an earlier stage failed
+	ReasonNotAttempted = "NotAttempted"
+	// ReasonFailed means reconciliation failed for a reason not covered by any other reason
+	ReasonFailed = "Failed"
+	// ReasonInvalidSpec means the spec is invalid, and will not succeed until it is changed
+	ReasonInvalidSpec = "InvalidSpec"
+	// ReasonServiceAccountRequired means serviceAccountName is required, but not set
+	ReasonServiceAccountRequired = "ServiceAccountRequired"
+	// ReasonReferenceNotFound means a reference does not exist
+	ReasonReferenceNotFound = "ReferenceNotFound"
+	// ReasonImpersonationFailed means the operator could not impersonate the ServiceAccount named in serviceAccountName
+	ReasonImpersonationFailed = "ImpersonationFailed"
+	// ReasonForbidden means the operator, or the ServiceAccount it impersonated, was not permitted to perform an action
+	ReasonForbidden = "Forbidden"
+	// ReasonReferenceFailed means a reference could not be fetched for any other reason
+	ReasonReferenceFailed = "ReferenceFailed"
+	// ReasonKeyCollision means the same key would be produced more than once
+	ReasonKeyCollision = "KeyCollision"
+	// ReasonInvalidTemplate means a template could not be parsed
+	ReasonInvalidTemplate = "InvalidTemplate"
+	// ReasonTemplateFailed means a template could not be executed
+	ReasonTemplateFailed = "TemplateFailed"
+	// ReasonTemplateLimitExceeded means a template produced too much output, ran for too long, or iterated too many times
+	ReasonTemplateLimitExceeded = "TemplateLimitExceeded"
+	// ReasonInvalidTemplateOutput means the output of a template could not be decoded as base64 or a yaml map
+	ReasonInvalidTemplateOutput = "InvalidTemplateOutput"
+	// ReasonMissingKey means a strict template used a reference or key which does not exist
+	ReasonMissingKey = "MissingKey"
+	// ReasonEmptyTemplateOutput means a strict template produced empty output
+	ReasonEmptyTemplateOutput = "EmptyTemplateOutput"
+	// ReasonTargetConflict means the derived object was modified while it was being written
+	ReasonTargetConflict = "TargetConflict"
+	// ReasonNamespaceNotWatched means the derived object would be written to a namespace the operator is not configured to write to,
+	// or a reference is in a namespace the operator does not watch
+	ReasonNamespaceNotWatched = "NamespaceNotWatched"
+	// ReasonTargetFailed means the derived object could not be written for any other reason
+	ReasonTargetFailed = "TargetFailed"
+)
+
+// Reasons of Normal Events. Warning Events use the reason of the condition that failed
+const (
+	// EventReasonReferencesFetched means every reference was fetched
+	EventReasonReferencesFetched = "ReferencesFetched"
+	// EventReasonCreated means the derived object was created
+	EventReasonCreated = "Created"
+	// EventReasonUpdated means the derived object was changed
+	EventReasonUpdated = "Updated"
+	// EventReasonUnchanged means the derived object was already up to date
+	EventReasonUnchanged = "Unchanged"
+	// EventReasonCleanedUp means a previously derived object which is no longer produced was deleted
+	EventReasonCleanedUp = "CleanedUp"
+	// EventReasonCleanupFailed means a previously derived object which is no longer produced could not be deleted
+	EventReasonCleanupFailed = "CleanupFailed"
+	// EventReasonReleaseAbandoned means the deletion policy could not be applied to a derived object while deleting the resource,
+	// because it or its namespace no longer exists, or the operator is no longer allowed to access it, so it was left as is
+	EventReasonReleaseAbandoned = "ReleaseAbandoned"
+)
@@ -0,0 +1,113 @@
+/*
+Copyright 2022 Andrew Melnick
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DerivedConfigMapSpec defines the desired state of DerivedConfigMap
+type DerivedConfigMapSpec struct {
+	// References is a list of ConfigMaps that can be referenced in the data or binaryData templates
+	References []Reference `json:"references"`
+	// ServiceAccountName is the name of a ServiceAccount in the same Namespace as the DerivedConfigMap that will be used to create the derived ConfigMap
+	// Required if targetNamespace is set, and not the same as the current namespace
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+	// TargetName is the name of the ConfigMap to create. Defaults to the same as the DerivedConfigMap
+	// +optional
+	TargetName string `json:"targetName,omitempty"`
+	// TargetNamespace is the namespace of the ConfigMap to create. Defaults to the same as the DerivedConfigMap
+	// +optional
+	TargetNamespace string `json:"targetNamespace,omitempty"`
+
+	// Data is a set of map of keys to templates that should produce string data to include in the ConfigMap's data
+	// +optional
+	Data map[string]StringTarget `json:"data,omitempty"`
+	// BinaryData is a map of keys to values that should produce base64-encoded binary data (e.g. with b64enc) to include in the ConfigMap's binaryData
+	// +optional
+	BinaryData map[string]BinaryTarget `json:"binaryData,omitempty"`
+	// Prefab is a set of common options to use instead of data/binaryData
+	// +optional
+	Prefab *Prefabs `json:"prefab,omitempty"`
+	// Strict is the default of the strict field of each template. Strict templates fail if they use a reference or key which does not exist,
+	// instead of rendering "<no value>", or if they produce empty output. Defaults to false
+	// +optional
+	Strict *bool `json:"strict,omitempty"`
+	// DeletionPolicy is what happens to the derived ConfigMap when the DerivedConfigMap is deleted. One of Delete, Orphan, or Retain. Defaults to Delete
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+}
+
+// DerivedConfigMapStatus defines the observed state of DerivedConfigMap
+type DerivedConfigMapStatus struct {
+	// ConfigMapName is the name of the ConfigMap that was generated, if any
+	// +optional
+	ConfigMapName string `json:"configMapName,omitempty"`
+	// ConfigMapNamespace is the namespace of the ConfigMap that was generated, if any
+	// +optional
+	ConfigMapNamespace string `json:"configMapNamespace,omitempty"`
+	// Inventory is every ConfigMap written for this DerivedConfigMap which has not yet been cleaned up.
+	// The first entry is the ConfigMap written by the last successful sync
+	// +optional
+	Inventory []DerivedObjectReference `json:"inventory,omitempty"`
+	// Error is the error message from the last sync attempt, if any
+	// +optional
+	Error string `json:"error,omitempty"`
+	// LastSync is the time when the ConfigMap was last generated
+	// +optional
+	LastSync *metav1.Time `json:"lastSync,omitempty"`
+	// LastSyncAttempt is the time when the ConfigMap was last attmpted to be generated
+	// +optional
+	LastSyncAttempt *metav1.Time `json:"lastSyncAttempt,omitempty"`
+	// AccessedKeys are the keys of each reference which were used when the ConfigMap was last generated.
+	// Updates to references which change none of these keys do not regenerate the ConfigMap
+	// +optional
+	AccessedKeys []ReferenceSubset `json:"accessedKeys,omitempty"`
+	// MissingReferences are the names of optional references which did not exist when references were last fetched
+	// +optional
+	MissingReferences []string `json:"missingReferences,omitempty"`
+	// ObservedGeneration is the generation of the DerivedConfigMap that was last reconciled
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+
+// DerivedConfigMap is the Schema for the derivedconfigmaps API
+type DerivedConfigMap struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DerivedConfigMapSpec   `json:"spec,omitempty"`
+	Status DerivedConfigMapStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// DerivedConfigMapList contains a list of DerivedConfigMap
+type DerivedConfigMapList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DerivedConfigMap `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DerivedConfigMap{}, &DerivedConfigMapList{})
+}
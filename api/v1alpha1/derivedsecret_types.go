@@ -30,6 +30,11 @@ type DerivedSecretSpec struct {
 	// Required if targetNamespace is set, and not the same as the current namespace
 	// +optional
 	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+	// ReferenceAccess is whose privileges are used to read references in the same namespace as the DerivedSecret. One of Operator or ServiceAccount. Defaults to Operator.
+	// If ServiceAccount, serviceAccountName is required, and is impersonated to read every reference, so a reference fails if that ServiceAccount cannot get it.
+	// The operator may be configured to always use ServiceAccount
+	// +optional
+	ReferenceAccess ReferenceAccess `json:"referenceAccess,omitempty"`
 	// TargetType is the "type" field of the derived Secret. Same default as a Secret
 	// +optional
 	TargetType corev1.SecretType `json:"targetType"`
@@ -51,7 +56,17 @@ type DerivedSecretSpec struct {
 	// Prefab is a set of common options to use instead of data/stringData
 	// +optional
 	Prefab *Prefabs `json:"prefab,omityempty"`
-	// TODO: optional cleanup field
+	// Strict is the default of the strict field of each template. Strict templates fail if they use a reference or key which does not exist,
+	// instead of rendering "<no value>", or if they produce empty output. Defaults to false
+	// +optional
+	Strict *bool `json:"strict,omitempty"`
+	// DeletionPolicy is what happens to the derived Secret when the DerivedSecret is deleted. One of Delete, Orphan, or Retain. Defaults to Delete
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// ResyncInterval is how often to regenerate the Secret even if nothing has changed, e.g. for templates which depend on the current time.
+	// If not set, the Secret is only regenerated when the DerivedSecret or its references change
+	// +optional
+	ResyncInterval *metav1.Duration `json:"resyncInterval,omitempty"`
 }
 
 // DerivedSecretStatus defines the observed state of DerivedSecret
@@ -71,10 +86,34 @@ type DerivedSecretStatus struct {
 	// LastSyncAttempt is the time when the secret was last attmpted to be generated
 	// +optional
 	LastSyncAttempt *metav1.Time `json:"lastSyncAttempt,omitempty"`
+	// Inventory is every Secret written for this DerivedSecret which has not yet been cleaned up.
+	// The first entry is the Secret written by the last successful sync
+	// +optional
+	Inventory []DerivedObjectReference `json:"inventory,omitempty"`
+	// AccessedKeys are the keys of each reference which were used when the secret was last generated.
+	// Updates to references which change none of these keys do not regenerate the secret
+	// +optional
+	AccessedKeys []ReferenceSubset `json:"accessedKeys,omitempty"`
+	// MissingReferences are the names of optional references which did not exist when references were last fetched
+	// +optional
+	MissingReferences []string `json:"missingReferences,omitempty"`
+	// ObservedGeneration is the generation of the DerivedSecret that was last reconciled
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions are the Ready, ReferencesResolved, Rendered, and TargetSynced conditions from the last sync attempt
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].reason`
+//+kubebuilder:printcolumn:name="Target Namespace",type=string,JSONPath=`.status.secretNamespace`,priority=1
+//+kubebuilder:printcolumn:name="Target",type=string,JSONPath=`.status.secretName`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // DerivedSecret is the Schema for the derivedsecrets API
 type DerivedSecret struct {
@@ -23,7 +23,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package v1alpha1
 
 import (
-	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -48,6 +48,342 @@ func (in *BinaryTarget) DeepCopy() *BinaryTarget {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterDerivedSecret) DeepCopyInto(out *ClusterDerivedSecret) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterDerivedSecret.
+func (in *ClusterDerivedSecret) DeepCopy() *ClusterDerivedSecret {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterDerivedSecret)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterDerivedSecret) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterDerivedSecretList) DeepCopyInto(out *ClusterDerivedSecretList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ClusterDerivedSecret, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterDerivedSecretList.
+func (in *ClusterDerivedSecretList) DeepCopy() *ClusterDerivedSecretList {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterDerivedSecretList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterDerivedSecretList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterDerivedSecretSpec) DeepCopyInto(out *ClusterDerivedSecretSpec) {
+	*out = *in
+	in.NamespaceSelector.DeepCopyInto(&out.NamespaceSelector)
+	if in.References != nil {
+		in, out := &in.References, &out.References
+		*out = make([]SensitiveReference, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Data != nil {
+		in, out := &in.Data, &out.Data
+		*out = make(map[string]BinaryTarget, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.StringData != nil {
+		in, out := &in.StringData, &out.StringData
+		*out = make(map[string]StringTarget, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.Prefab != nil {
+		in, out := &in.Prefab, &out.Prefab
+		*out = new(Prefabs)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Strict != nil {
+		in, out := &in.Strict, &out.Strict
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterDerivedSecretSpec.
+func (in *ClusterDerivedSecretSpec) DeepCopy() *ClusterDerivedSecretSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterDerivedSecretSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterDerivedSecretStatus) DeepCopyInto(out *ClusterDerivedSecretStatus) {
+	*out = *in
+	if in.Targets != nil {
+		in, out := &in.Targets, &out.Targets
+		*out = make([]ClusterDerivedSecretTarget, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.LastSync != nil {
+		in, out := &in.LastSync, &out.LastSync
+		*out = (*in).DeepCopy()
+	}
+	if in.LastSyncAttempt != nil {
+		in, out := &in.LastSyncAttempt, &out.LastSyncAttempt
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterDerivedSecretStatus.
+func (in *ClusterDerivedSecretStatus) DeepCopy() *ClusterDerivedSecretStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterDerivedSecretStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterDerivedSecretTarget) DeepCopyInto(out *ClusterDerivedSecretTarget) {
+	*out = *in
+	if in.LastSync != nil {
+		in, out := &in.LastSync, &out.LastSync
+		*out = (*in).DeepCopy()
+	}
+	if in.MissingReferences != nil {
+		in, out := &in.MissingReferences, &out.MissingReferences
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterDerivedSecretTarget.
+func (in *ClusterDerivedSecretTarget) DeepCopy() *ClusterDerivedSecretTarget {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterDerivedSecretTarget)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigMapReference) DeepCopyInto(out *ConfigMapReference) {
+	*out = *in
+	in.ConfigMapEnvSource.DeepCopyInto(&out.ConfigMapEnvSource)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigMapReference.
+func (in *ConfigMapReference) DeepCopy() *ConfigMapReference {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigMapReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DerivedConfigMap) DeepCopyInto(out *DerivedConfigMap) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DerivedConfigMap.
+func (in *DerivedConfigMap) DeepCopy() *DerivedConfigMap {
+	if in == nil {
+		return nil
+	}
+	out := new(DerivedConfigMap)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *DerivedConfigMap) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DerivedConfigMapList) DeepCopyInto(out *DerivedConfigMapList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]DerivedConfigMap, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DerivedConfigMapList.
+func (in *DerivedConfigMapList) DeepCopy() *DerivedConfigMapList {
+	if in == nil {
+		return nil
+	}
+	out := new(DerivedConfigMapList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *DerivedConfigMapList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DerivedConfigMapSpec) DeepCopyInto(out *DerivedConfigMapSpec) {
+	*out = *in
+	if in.References != nil {
+		in, out := &in.References, &out.References
+		*out = make([]Reference, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Data != nil {
+		in, out := &in.Data, &out.Data
+		*out = make(map[string]StringTarget, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.BinaryData != nil {
+		in, out := &in.BinaryData, &out.BinaryData
+		*out = make(map[string]BinaryTarget, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.Prefab != nil {
+		in, out := &in.Prefab, &out.Prefab
+		*out = new(Prefabs)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Strict != nil {
+		in, out := &in.Strict, &out.Strict
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DerivedConfigMapSpec.
+func (in *DerivedConfigMapSpec) DeepCopy() *DerivedConfigMapSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(DerivedConfigMapSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DerivedConfigMapStatus) DeepCopyInto(out *DerivedConfigMapStatus) {
+	*out = *in
+	if in.Inventory != nil {
+		in, out := &in.Inventory, &out.Inventory
+		*out = make([]DerivedObjectReference, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastSync != nil {
+		in, out := &in.LastSync, &out.LastSync
+		*out = (*in).DeepCopy()
+	}
+	if in.LastSyncAttempt != nil {
+		in, out := &in.LastSyncAttempt, &out.LastSyncAttempt
+		*out = (*in).DeepCopy()
+	}
+	if in.AccessedKeys != nil {
+		in, out := &in.AccessedKeys, &out.AccessedKeys
+		*out = make([]ReferenceSubset, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.MissingReferences != nil {
+		in, out := &in.MissingReferences, &out.MissingReferences
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DerivedConfigMapStatus.
+func (in *DerivedConfigMapStatus) DeepCopy() *DerivedConfigMapStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(DerivedConfigMapStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DerivedObjectReference) DeepCopyInto(out *DerivedObjectReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DerivedObjectReference.
+func (in *DerivedObjectReference) DeepCopy() *DerivedObjectReference {
+	if in == nil {
+		return nil
+	}
+	out := new(DerivedObjectReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DerivedSecret) DeepCopyInto(out *DerivedSecret) {
 	*out = *in
@@ -136,6 +472,16 @@ func (in *DerivedSecretSpec) DeepCopyInto(out *DerivedSecretSpec) {
 		*out = new(Prefabs)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Strict != nil {
+		in, out := &in.Strict, &out.Strict
+		*out = new(bool)
+		**out = **in
+	}
+	if in.ResyncInterval != nil {
+		in, out := &in.ResyncInterval, &out.ResyncInterval
+		*out = new(v1.Duration)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DerivedSecretSpec.
@@ -159,6 +505,30 @@ func (in *DerivedSecretStatus) DeepCopyInto(out *DerivedSecretStatus) {
 		in, out := &in.LastSyncAttempt, &out.LastSyncAttempt
 		*out = (*in).DeepCopy()
 	}
+	if in.Inventory != nil {
+		in, out := &in.Inventory, &out.Inventory
+		*out = make([]DerivedObjectReference, len(*in))
+		copy(*out, *in)
+	}
+	if in.AccessedKeys != nil {
+		in, out := &in.AccessedKeys, &out.AccessedKeys
+		*out = make([]ReferenceSubset, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.MissingReferences != nil {
+		in, out := &in.MissingReferences, &out.MissingReferences
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DerivedSecretStatus.
@@ -209,6 +579,13 @@ func (in *Prefabs) DeepCopy() *Prefabs {
 func (in *Reference) DeepCopyInto(out *Reference) {
 	*out = *in
 	in.ConfigMapRef.DeepCopyInto(&out.ConfigMapRef)
+	if in.Defaults != nil {
+		in, out := &in.Defaults, &out.Defaults
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Reference.
@@ -246,19 +623,42 @@ func (in *ReferenceSubset) DeepCopy() *ReferenceSubset {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretReference) DeepCopyInto(out *SecretReference) {
+	*out = *in
+	in.SecretEnvSource.DeepCopyInto(&out.SecretEnvSource)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretReference.
+func (in *SecretReference) DeepCopy() *SecretReference {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SensitiveReference) DeepCopyInto(out *SensitiveReference) {
 	*out = *in
 	if in.ConfigMapRef != nil {
 		in, out := &in.ConfigMapRef, &out.ConfigMapRef
-		*out = new(v1.ConfigMapEnvSource)
+		*out = new(ConfigMapReference)
 		(*in).DeepCopyInto(*out)
 	}
 	if in.SecretRef != nil {
 		in, out := &in.SecretRef, &out.SecretRef
-		*out = new(v1.SecretEnvSource)
+		*out = new(SecretReference)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Defaults != nil {
+		in, out := &in.Defaults, &out.Defaults
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SensitiveReference.
@@ -310,6 +710,11 @@ func (in *TargetBase) DeepCopyInto(out *TargetBase) {
 		*out = new(bool)
 		**out = **in
 	}
+	if in.Strict != nil {
+		in, out := &in.Strict, &out.Strict
+		*out = new(bool)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TargetBase.
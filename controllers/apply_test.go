@@ -0,0 +1,103 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+func managedBy(entries ...metav1.ManagedFieldsEntry) []metav1.ManagedFieldsEntry {
+	fields := &metav1.FieldsV1{Raw: []byte(`{"f:data":{"f:password":{}}}`)}
+	for ix := range entries {
+		entries[ix].FieldsType = "FieldsV1"
+		entries[ix].FieldsV1 = fields
+	}
+	return entries
+}
+
+func TestMigrateLegacyFields(t *testing.T) {
+	owner := &secretsv1alpha1.DerivedSecret{ObjectMeta: metav1.ObjectMeta{Namespace: "app-ns", Name: "app"}}
+	other := &secretsv1alpha1.DerivedSecret{ObjectMeta: metav1.ObjectMeta{Namespace: "app-ns", Name: "other"}}
+	legacy := metav1.ManagedFieldsEntry{Manager: legacyFieldManager, Operation: metav1.ManagedFieldsOperationUpdate}
+	applied := metav1.ManagedFieldsEntry{Manager: fieldManager, Operation: metav1.ManagedFieldsOperationApply}
+
+	cases := []struct {
+		name      string
+		owner     client.Object
+		fields    []metav1.ManagedFieldsEntry
+		expectOps []string
+	}{
+		{
+			name:      "legacy update is migrated to apply",
+			owner:     owner,
+			fields:    managedBy(legacy),
+			expectOps: []string{fieldManager + "/Apply"},
+		},
+		{
+			name:      "already applied secrets are not migrated again",
+			owner:     owner,
+			fields:    managedBy(applied, legacy),
+			expectOps: []string{fieldManager + "/Apply", legacyFieldManager + "/Update"},
+		},
+		{
+			name:      "secrets derived from another resource are not migrated",
+			owner:     other,
+			fields:    managedBy(legacy),
+			expectOps: []string{legacyFieldManager + "/Update"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			current := secretIn("app-ns", "app")
+			current.Labels = secretsv1alpha1.DerivedFromLabelValues(owner)
+			current.ManagedFields = tc.fields
+			c := newIndexedClient(t, current)
+
+			ctx := context.Background()
+			if err := c.Get(ctx, client.ObjectKeyFromObject(current), current); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := migrateLegacyFields(ctx, c, tc.owner, current); err != nil {
+				t.Fatal(err)
+			}
+			migrated := &corev1.Secret{}
+			if err := c.Get(ctx, client.ObjectKeyFromObject(current), migrated); err != nil {
+				t.Fatal(err)
+			}
+			ops := make([]string, 0, len(migrated.ManagedFields))
+			for _, entry := range migrated.ManagedFields {
+				ops = append(ops, entry.Manager+"/"+string(entry.Operation))
+			}
+			if len(ops) != len(tc.expectOps) {
+				t.Fatalf("Expected managed fields %v, got %v", tc.expectOps, ops)
+			}
+			for ix := range ops {
+				if ops[ix] != tc.expectOps[ix] {
+					t.Fatalf("Expected managed fields %v, got %v", tc.expectOps, ops)
+				}
+			}
+		})
+	}
+}
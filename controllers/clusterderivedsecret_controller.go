@@ -0,0 +1,494 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+	"github.com/meln5674/secrets-operator/model"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClusterDerivedSecretReconciler reconciles a ClusterDerivedSecret object
+type ClusterDerivedSecretReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Namespaces restricts which namespaces Secrets are written to. Selected namespaces which cannot be targeted are skipped,
+	// and listed in status.targets with an error
+	Namespaces NamespaceScope
+	// DefaultResyncInterval is how often to regenerate derived objects if the resource does not set its own interval. Never if nil
+	DefaultResyncInterval *metav1.Duration
+	// ControllerOptions configures the concurrency and rate limiting of the controller
+	ControllerOptions controller.Options
+	// Recorder emits Events about selected namespaces which are skipped
+	Recorder record.EventRecorder
+
+	events *eventRecorder
+}
+
+type ClusterDerivedSecretReconcilerRunStage1 struct {
+	*ClusterDerivedSecretReconciler
+	logger logr.Logger
+	ctx    context.Context
+	src    *secretsv1alpha1.ClusterDerivedSecret
+}
+
+type ClusterDerivedSecretReconcilerRunStage2 struct {
+	*ClusterDerivedSecretReconcilerRunStage1
+	namespaces []corev1.Namespace
+	// skipped are the selected namespaces which are not target namespaces, and why
+	skipped map[string]error
+}
+
+type ClusterDerivedSecretReconcilerRunStage3 struct {
+	*ClusterDerivedSecretReconcilerRunStage2
+	targets []secretsv1alpha1.ClusterDerivedSecretTarget
+}
+
+func (r *ClusterDerivedSecretReconcilerRunStage1) FetchNamespaces() (nextR *ClusterDerivedSecretReconcilerRunStage2, err error) {
+	selector, err := metav1.LabelSelectorAsSelector(&r.src.Spec.NamespaceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid spec.namespaceSelector: %s", err)
+	}
+	namespaceList := corev1.NamespaceList{}
+	err = r.List(r.ctx, &namespaceList, client.MatchingLabelsSelector{Selector: selector})
+	if err != nil {
+		return nil, err
+	}
+	namespaces := make([]corev1.Namespace, 0, len(namespaceList.Items))
+	skipped := make(map[string]error)
+	skippedNames := make([]string, 0)
+	for _, namespace := range namespaceList.Items {
+		if namespace.Status.Phase == corev1.NamespaceTerminating {
+			continue
+		}
+		if err := r.Namespaces.checkTarget("", namespace.Name); err != nil {
+			r.logger.Info("Skipping selected namespace which is not a target namespace", "namespace", namespace.Name)
+			skipped[namespace.Name] = err
+			skippedNames = append(skippedNames, namespace.Name)
+			continue
+		}
+		namespaces = append(namespaces, namespace)
+	}
+	if len(skippedNames) != 0 {
+		// A single Event for every skipped namespace, so that it is not repeated on each reconcile, see eventRecorder
+		r.events.Eventf(r.src, corev1.EventTypeWarning, secretsv1alpha1.ReasonNamespaceNotWatched, "Selected namespaces %s are not target namespaces of the operator, so Secrets cannot be written to them", strings.Join(skippedNames, ", "))
+	}
+	return &ClusterDerivedSecretReconcilerRunStage2{ClusterDerivedSecretReconcilerRunStage1: r, namespaces: namespaces, skipped: skipped}, nil
+}
+
+func (r *ClusterDerivedSecretReconcilerRunStage2) CreateSecrets() (nextR *ClusterDerivedSecretReconcilerRunStage3, err error) {
+	var sharedCMRefs map[string]corev1.ConfigMap
+	var sharedSRefs map[string]corev1.Secret
+	if r.src.Spec.ReferenceNamespace != "" {
+		sharedCMRefs, sharedSRefs, err = fetchReferences(r.ctx, r.Client, r.Client, r.src.Spec.ReferenceNamespace, r.src.Spec.References)
+		if err != nil {
+			return nil, err
+		}
+		r.logger.Info("All references fetched", "referenceNamespace", r.src.Spec.ReferenceNamespace)
+	}
+
+	failures := 0
+	targets := make([]secretsv1alpha1.ClusterDerivedSecretTarget, 0, len(r.namespaces)+len(r.skipped))
+	for _, namespace := range r.namespaces {
+		target := r.target(namespace.Name)
+		missing, err := r.CreateSecret(namespace.Name, sharedCMRefs, sharedSRefs)
+		target.MissingReferences = missing
+		if err != nil {
+			r.logger.Info("Failed to create secret", "namespace", namespace.Name, "error", err)
+			target.Error = redactedErrorMessage(err)
+			failures++
+		} else {
+			now := metav1.Now()
+			target.LastSync = &now
+		}
+		targets = append(targets, target)
+	}
+	// Skipped namespaces are not failures, as retrying will not help until the operator is reconfigured, but are still
+	// listed so that it is clear why they have no Secret. Any Secret previously written there is left alone
+	for namespace, err := range r.skipped {
+		target := r.target(namespace)
+		target.Error = redactedErrorMessage(err)
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Namespace < targets[j].Namespace })
+
+	nextR = &ClusterDerivedSecretReconcilerRunStage3{ClusterDerivedSecretReconcilerRunStage2: r, targets: targets}
+	if failures != 0 {
+		return nextR, fmt.Errorf("Failed to create %d of %d secrets, see status.targets for details", failures, len(targets))
+	}
+	return nextR, nil
+}
+
+// target returns the status of the Secret in a namespace, keeping the time it was last generated, if any
+func (r *ClusterDerivedSecretReconcilerRunStage2) target(namespace string) secretsv1alpha1.ClusterDerivedSecretTarget {
+	target := secretsv1alpha1.ClusterDerivedSecretTarget{
+		Namespace: namespace,
+		Name:      r.src.Spec.TargetName,
+	}
+	if target.Name == "" {
+		target.Name = r.src.Name
+	}
+	for _, previous := range r.src.Status.Targets {
+		if previous.Namespace == target.Namespace && previous.Name == target.Name {
+			target.LastSync = previous.LastSync
+		}
+	}
+	return target
+}
+
+// CreateSecret generates and writes the Secret for a namespace, returning the names of any optional references which do not exist
+func (r *ClusterDerivedSecretReconcilerRunStage2) CreateSecret(namespace string, cmRefs map[string]corev1.ConfigMap, sRefs map[string]corev1.Secret) (missing []string, err error) {
+	if r.src.Spec.ReferenceNamespace == "" {
+		cmRefs, sRefs, err = fetchReferences(r.ctx, r.Client, r.Client, namespace, r.src.Spec.References)
+		if err != nil {
+			return nil, err
+		}
+	}
+	missing = model.MissingReferences(r.src.Spec.References, cmRefs, sRefs)
+
+	current, err := currentSecret(r.ctx, r.Client, model.ClusterSecretTarget(r.src, namespace))
+	if err != nil {
+		return missing, err
+	}
+
+	secretCopy, noOverwrite, err := model.GenerateClusterSecret(cmRefs, sRefs, current, r.src, namespace)
+	if err != nil {
+		return missing, err
+	}
+
+	err = ctrl.SetControllerReference(r.src, &secretCopy, r.Scheme)
+	if err != nil {
+		return missing, err
+	}
+
+	_, _, err = applySecret(r.ctx, r.Client, r.src, current, &secretCopy, noOverwrite)
+	return missing, err
+}
+
+func (r *ClusterDerivedSecretReconcilerRunStage3) CleanUnselectedSecrets() {
+	current := make(map[types.NamespacedName]struct{}, len(r.targets))
+	for _, target := range r.targets {
+		current[types.NamespacedName{Namespace: target.Namespace, Name: target.Name}] = struct{}{}
+	}
+
+	for _, previous := range r.src.Status.Targets {
+		if _, ok := current[types.NamespacedName{Namespace: previous.Namespace, Name: previous.Name}]; ok {
+			continue
+		}
+		secret := corev1.Secret{}
+		err := r.Get(r.ctx, client.ObjectKey{Namespace: previous.Namespace, Name: previous.Name}, &secret)
+		if client.IgnoreNotFound(err) != nil {
+			// Keep track of it so that we try again next time
+			r.logger.Info("Failed to fetch previously derived secret", "namespace", previous.Namespace, "name", previous.Name, "error", err)
+			r.targets = append(r.targets, previous)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !metav1.IsControlledBy(&secret, r.src) {
+			// Someone else has taken over this secret, it isn't ours to delete
+			continue
+		}
+		err = r.Delete(r.ctx, &secret)
+		if client.IgnoreNotFound(err) != nil {
+			r.logger.Info("Failed to delete previously derived secret", "namespace", previous.Namespace, "name", previous.Name, "error", err)
+			r.targets = append(r.targets, previous)
+		}
+	}
+
+	r.src.Status.Targets = r.targets
+}
+
+func (r *ClusterDerivedSecretReconcilerRunStage1) SyncStatus(err error) error {
+	if err == nil {
+		now := metav1.Now()
+		r.src.Status.Error = ""
+		r.src.Status.LastSync = &now
+	} else {
+		r.src.Status.Error = redactedErrorMessage(err)
+	}
+	uperr := r.Status().Update(r.ctx, r.src)
+	if uperr != nil {
+		return uperr
+	}
+	return err
+}
+
+//+kubebuilder:rbac:groups=secrets.meln5674.github.com,resources=clusterderivedsecrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=secrets.meln5674.github.com,resources=clusterderivedsecrets/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=secrets.meln5674.github.com,resources=clusterderivedsecrets/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+func (r *ClusterDerivedSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	logger := log.FromContext(ctx).WithValues("request", req)
+
+	logger.Info("Got request")
+
+	src := secretsv1alpha1.ClusterDerivedSecret{}
+
+	err = r.Get(ctx, req.NamespacedName, &src)
+
+	if client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err != nil {
+		// Generated secrets are owned by the ClusterDerivedSecret, and will be garbage collected
+		logger.Info("Got not found, assuming deleted", "error", err)
+		return ctrl.Result{}, nil
+	}
+	now := metav1.Now()
+	src.Status.LastSyncAttempt = &now
+
+	r1 := ClusterDerivedSecretReconcilerRunStage1{ClusterDerivedSecretReconciler: r, ctx: ctx, src: &src, logger: logger}
+
+	// See DerivedSecretReconciler.Reconcile
+	defer func() {
+		result, err = reconcileResult(logger, r1.SyncStatus(err), r.DefaultResyncInterval)
+	}()
+
+	r2, err := r1.FetchNamespaces()
+	if err != nil {
+		return
+	}
+	logger.Info("Selected namespaces fetched", "count", len(r2.namespaces))
+
+	// A failure in one namespace should not prevent cleaning up namespaces that are no longer selected,
+	// so we only stop here if we have nothing to clean up with
+	r3, err := r2.CreateSecrets()
+	if r3 == nil {
+		return
+	}
+	logger.Info("Secrets created/updated")
+
+	r3.CleanUnselectedSecrets()
+
+	logger.Info("Status updated, reconciliation complete")
+	return
+}
+
+type ClusterDerivedSecretWatcher struct {
+	Reconciler *ClusterDerivedSecretReconciler
+}
+
+// ReferencingClusterDerivedSecrets returns a request for each ClusterDerivedSecret which references a Secret or ConfigMap,
+// either in a single namespace, or in every namespace it selects
+func (w *ClusterDerivedSecretWatcher) ReferencingClusterDerivedSecrets(kind string, obj client.Object) ([]reconcile.Request, error) {
+	key, ok := referenceKeyForKind(kind)
+	if !ok {
+		return nil, nil
+	}
+	referees, err := listReferencing(context.TODO(), w.Reconciler, &secretsv1alpha1.ClusterDerivedSecretList{}, key, referenceIndexValue(obj.GetNamespace(), obj.GetName()))
+	if err != nil {
+		return nil, err
+	}
+
+	perNamespaceReferees, err := listReferencing(context.TODO(), w.Reconciler, &secretsv1alpha1.ClusterDerivedSecretList{}, key, referenceIndexValue(anyNamespace, obj.GetName()))
+	if err != nil {
+		return nil, err
+	}
+	if len(perNamespaceReferees) != 0 {
+		namespace := corev1.Namespace{}
+		err = w.Reconciler.Get(context.TODO(), client.ObjectKey{Name: obj.GetNamespace()}, &namespace)
+		if client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+		for _, referee := range perNamespaceReferees {
+			if selectsNamespace(referee.(*secretsv1alpha1.ClusterDerivedSecret), obj.GetNamespace(), namespace.Labels) {
+				referees = append(referees, referee)
+			}
+		}
+	}
+
+	return requestsFor(referees), nil
+}
+
+func (w *ClusterDerivedSecretWatcher) QueueReferencingClusterDerivedSecrets(kind string, obj client.Object, q workqueue.RateLimitingInterface) {
+	logger := log.FromContext(context.TODO()).WithValues("namespace", obj.GetNamespace(), kind, obj.GetName())
+	requests, err := w.ReferencingClusterDerivedSecrets(kind, obj)
+	if err != nil {
+		logger.Info("Failed to find ClusterDerivedSecrets which have reference", "error", err)
+		return
+	}
+
+	if len(requests) == 0 {
+		return
+	}
+	logger.Info("Queuing referees", "referees", requests)
+	for _, request := range requests {
+		q.AddRateLimited(request)
+	}
+}
+
+type ClusterDerivedSecretSecretWatcher struct {
+	ClusterDerivedSecretWatcher
+}
+
+var (
+	_ = handler.EventHandler(&ClusterDerivedSecretSecretWatcher{})
+)
+
+func (w *ClusterDerivedSecretSecretWatcher) QueueSecretReferencingClusterDerivedSecrets(secret client.Object, q workqueue.RateLimitingInterface) {
+	w.QueueReferencingClusterDerivedSecrets("Secret", secret, q)
+}
+
+func (w *ClusterDerivedSecretSecretWatcher) Create(e event.CreateEvent, q workqueue.RateLimitingInterface) {
+	w.QueueSecretReferencingClusterDerivedSecrets(e.Object, q)
+}
+
+// Update queues every ClusterDerivedSecret which references the Secret. Unlike DerivedSecrets, the keys each one used are not tracked,
+// as they may differ for each namespace it renders in, so every update regenerates them
+func (w *ClusterDerivedSecretSecretWatcher) Update(e event.UpdateEvent, q workqueue.RateLimitingInterface) {
+	w.QueueSecretReferencingClusterDerivedSecrets(e.ObjectNew, q)
+}
+
+func (w *ClusterDerivedSecretSecretWatcher) Delete(e event.DeleteEvent, q workqueue.RateLimitingInterface) {
+	w.QueueSecretReferencingClusterDerivedSecrets(e.Object, q)
+}
+
+func (w *ClusterDerivedSecretSecretWatcher) Generic(e event.GenericEvent, q workqueue.RateLimitingInterface) {
+	w.QueueSecretReferencingClusterDerivedSecrets(e.Object, q)
+}
+
+type ClusterDerivedSecretConfigMapWatcher struct {
+	ClusterDerivedSecretWatcher
+}
+
+var (
+	_ = handler.EventHandler(&ClusterDerivedSecretConfigMapWatcher{})
+)
+
+func (w *ClusterDerivedSecretConfigMapWatcher) QueueConfigMapReferencingClusterDerivedSecrets(configMap client.Object, q workqueue.RateLimitingInterface) {
+	w.ClusterDerivedSecretWatcher.QueueReferencingClusterDerivedSecrets("ConfigMap", configMap, q)
+}
+
+func (w *ClusterDerivedSecretConfigMapWatcher) Create(e event.CreateEvent, q workqueue.RateLimitingInterface) {
+	w.QueueConfigMapReferencingClusterDerivedSecrets(e.Object, q)
+}
+
+// Update queues every ClusterDerivedSecret which references the ConfigMap, see ClusterDerivedSecretSecretWatcher.Update
+func (w *ClusterDerivedSecretConfigMapWatcher) Update(e event.UpdateEvent, q workqueue.RateLimitingInterface) {
+	w.QueueConfigMapReferencingClusterDerivedSecrets(e.ObjectNew, q)
+}
+
+func (w *ClusterDerivedSecretConfigMapWatcher) Delete(e event.DeleteEvent, q workqueue.RateLimitingInterface) {
+	w.QueueConfigMapReferencingClusterDerivedSecrets(e.Object, q)
+}
+
+func (w *ClusterDerivedSecretConfigMapWatcher) Generic(e event.GenericEvent, q workqueue.RateLimitingInterface) {
+	w.QueueConfigMapReferencingClusterDerivedSecrets(e.Object, q)
+}
+
+// QueueSelectingClusterDerivedSecrets queues every ClusterDerivedSecret whenever a namespace is created, relabeled, or deleted.
+// Namespace events are rare enough that checking each selector here is not worth the trouble,
+// as the selected namespaces are recomputed from scratch on each reconcile anyway
+func (w *ClusterDerivedSecretWatcher) QueueSelectingClusterDerivedSecrets(namespace client.Object) []reconcile.Request {
+	logger := log.FromContext(context.TODO()).WithValues("namespace", namespace.GetName())
+
+	clusterDerivedSecrets := secretsv1alpha1.ClusterDerivedSecretList{}
+	err := w.Reconciler.List(context.TODO(), &clusterDerivedSecrets)
+	if err != nil {
+		logger.Info("Failed to list ClusterDerivedSecrets", "error", err)
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(clusterDerivedSecrets.Items))
+	for ix := range clusterDerivedSecrets.Items {
+		item := &clusterDerivedSecrets.Items[ix]
+		if !selectsNamespace(item, namespace.GetName(), namespace.GetLabels()) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: item.Name}})
+	}
+	return requests
+}
+
+// selectsNamespace returns true if a ClusterDerivedSecret's selector matches a namespace, or it has previously produced a Secret in it
+func selectsNamespace(clusterDerivedSecret *secretsv1alpha1.ClusterDerivedSecret, namespace string, namespaceLabels map[string]string) bool {
+	selector, err := metav1.LabelSelectorAsSelector(&clusterDerivedSecret.Spec.NamespaceSelector)
+	if err != nil {
+		// Let the reconciler report the bad selector
+		selector = labels.Everything()
+	}
+	if selector.Matches(labels.Set(namespaceLabels)) {
+		return true
+	}
+	for _, target := range clusterDerivedSecret.Status.Targets {
+		if target.Namespace == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// clusterDerivedSecretReferences extracts the references of a ClusterDerivedSecret for the reference indexes.
+// Without a referenceNamespace, references are resolved in every selected namespace
+func clusterDerivedSecretReferences(obj client.Object) (string, []secretsv1alpha1.SensitiveReference) {
+	clusterDerivedSecret := obj.(*secretsv1alpha1.ClusterDerivedSecret)
+	namespace := clusterDerivedSecret.Spec.ReferenceNamespace
+	if namespace == "" {
+		namespace = anyNamespace
+	}
+	return namespace, clusterDerivedSecret.Spec.References
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ClusterDerivedSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	if err := indexReferences(context.Background(), mgr.GetFieldIndexer(), &secretsv1alpha1.ClusterDerivedSecret{}, clusterDerivedSecretReferences); err != nil {
+		return err
+	}
+
+	r.events = newEventRecorder(r.Recorder, repeatedEventInterval)
+
+	watcher := ClusterDerivedSecretWatcher{Reconciler: r}
+	return ctrl.NewControllerManagedBy(mgr).
+		WithOptions(r.ControllerOptions).
+		For(&secretsv1alpha1.ClusterDerivedSecret{}, builder.WithPredicates(specChangedPredicate)).
+		// Only the metadata of Secrets is cached, their contents are read live, see UncachedObjects
+		Owns(&corev1.Secret{}, builder.OnlyMetadata).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, &ClusterDerivedSecretSecretWatcher{ClusterDerivedSecretWatcher: watcher}, builder.OnlyMetadata).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, &ClusterDerivedSecretConfigMapWatcher{ClusterDerivedSecretWatcher: watcher}).
+		Watches(&source.Kind{Type: &corev1.Namespace{}}, handler.EnqueueRequestsFromMapFunc(watcher.QueueSelectingClusterDerivedSecrets)).
+		Complete(r)
+}
@@ -0,0 +1,336 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+	"github.com/meln5674/secrets-operator/model"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const (
+	// fieldManager is the field manager used for server-side apply
+	fieldManager = "secrets-operator"
+	// legacyFieldManager is the field manager of fields written by previous versions of the operator, which used client-side updates,
+	// and so were identified by the name of the binary
+	legacyFieldManager = "manager"
+)
+
+// specChangedPredicate ignores updates to a resource which do not change its spec, such as status updates,
+// other than the start of its deletion
+var specChangedPredicate = predicate.Or(
+	predicate.GenerationChangedPredicate{},
+	predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return !e.ObjectNew.GetDeletionTimestamp().IsZero()
+		},
+	},
+)
+
+// reconcileResult determines when to reconcile again, given the final error of a reconcile, and the resync interval, if any.
+// Transient errors are returned, so they are retried with exponential backoff.
+// Permanent errors are not retried, as the resource or its references must change to resolve them, which will trigger a reconcile on its own
+func reconcileResult(logger logr.Logger, err error, resyncInterval *metav1.Duration) (ctrl.Result, error) {
+	if err != nil && !isPermanent(err) {
+		return ctrl.Result{}, err
+	}
+	if err != nil {
+		logger.Info("Reconcile failed with a permanent error, not retrying until the resource or its references change", "error", err)
+	}
+	if resyncInterval != nil && resyncInterval.Duration > 0 {
+		return ctrl.Result{RequeueAfter: resyncInterval.Duration}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// hasCrossNamespaceReferences returns true if any reference is to a ConfigMap or Secret outside of a namespace
+func hasCrossNamespaceReferences(namespace string, references []secretsv1alpha1.SensitiveReference) bool {
+	for ix := range references {
+		if references[ix].NamespaceOrDefault(namespace) != namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchReferences fetches every ConfigMap and Secret in a list of references, keyed by reference name.
+// References without a namespace are fetched from the provided namespace using c,
+// while references to other namespaces are fetched using crossNamespaceClient, which should impersonate the ServiceAccount
+// of the referencing resource. If crossNamespaceClient is nil, references to other namespaces are an error.
+// Optional references which do not exist are left out of the results, and any other error fetching them is still an error.
+func fetchReferences(ctx context.Context, c client.Client, crossNamespaceClient client.Client, namespace string, references []secretsv1alpha1.SensitiveReference) (cmRefs map[string]corev1.ConfigMap, sRefs map[string]corev1.Secret, err error) {
+	if errs := model.ValidateReferences(field.NewPath("spec", "references"), references); len(errs) != 0 {
+		return nil, nil, errs.ToAggregate()
+	}
+
+	cmRefs = make(map[string]corev1.ConfigMap)
+	sRefs = make(map[string]corev1.Secret)
+
+	for ix := range references {
+		refInfo := &references[ix]
+		refName := refInfo.Name
+		refNamespace := refInfo.NamespaceOrDefault(namespace)
+		refClient := c
+		if refNamespace != namespace {
+			if crossNamespaceClient == nil {
+				return nil, nil, &stageError{
+					Condition: secretsv1alpha1.ConditionReferencesResolved,
+					Reason:    secretsv1alpha1.ReasonServiceAccountRequired,
+					Err:       fmt.Errorf("Reference %s is in namespace %s, which requires spec.serviceAccountName to be set", refName, refNamespace),
+				}
+			}
+			refClient = crossNamespaceClient
+		}
+		if refInfo.ConfigMapRef != nil {
+			cm := corev1.ConfigMap{}
+			err := refClient.Get(ctx, client.ObjectKey{Namespace: refNamespace, Name: refInfo.ConfigMapRef.Name}, &cm)
+			if apierrors.IsNotFound(err) && refInfo.IsOptional() {
+				continue
+			}
+			if apierrors.IsForbidden(err) {
+				return nil, nil, referenceForbidden(refName, "ConfigMap", refNamespace, refInfo.ConfigMapRef.Name, err)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("While fetching reference %s: %w", refName, err)
+			}
+			cmRefs[refName] = cm
+			continue
+		}
+		if refInfo.SecretRef != nil {
+			s := corev1.Secret{}
+			err := refClient.Get(ctx, client.ObjectKey{Namespace: refNamespace, Name: refInfo.SecretRef.Name}, &s)
+			if apierrors.IsNotFound(err) && refInfo.IsOptional() {
+				continue
+			}
+			if apierrors.IsForbidden(err) {
+				return nil, nil, referenceForbidden(refName, "Secret", refNamespace, refInfo.SecretRef.Name, err)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("While fetching reference %s: %w", refName, err)
+			}
+			sRefs[refName] = s
+			continue
+		}
+	}
+	return cmRefs, sRefs, nil
+}
+
+// referenceForbidden describes a reference which could not be read because of RBAC, including which object needs to be readable
+func referenceForbidden(refName, kind, namespace, name string, err error) error {
+	reason := secretsv1alpha1.ReasonForbidden
+	if isImpersonationForbidden(err) {
+		reason = secretsv1alpha1.ReasonImpersonationFailed
+	}
+	return &stageError{
+		Condition: secretsv1alpha1.ConditionReferencesResolved,
+		Reason:    reason,
+		Err:       fmt.Errorf("Not permitted to get %s %s/%s for reference %s: %w", kind, namespace, name, refName, err),
+	}
+}
+
+// currentSecret reads a generated Secret before it is rendered, returning nil if it does not exist.
+// It must be read with the same client that writes it, so that a ServiceAccount which cannot read it cannot use templates to do so
+func currentSecret(ctx context.Context, c client.Client, key types.NamespacedName) (*corev1.Secret, error) {
+	existing := &corev1.Secret{}
+	err := c.Get(ctx, key, existing)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// applySecret creates or updates a generated Secret using server-side apply, leaving the existing value of any keys in noOverwrite alone,
+// and returns whether the Secret was created, changed, or already up to date.
+// current is the Secret read by currentSecret, or nil if it did not exist.
+// Keys which were applied previously but are no longer present are removed by the API server, unless another field manager also owns them.
+// If another field manager owns a key with a different value, a conflict error is returned.
+// Fields written by previous versions of the operator are first migrated to be owned by it, see migrateLegacyFields
+func applySecret(ctx context.Context, c client.Client, owner client.Object, current *corev1.Secret, secretCopy *corev1.Secret, noOverwrite map[string]struct{}) (*corev1.Secret, controllerutil.OperationResult, error) {
+	created := current == nil
+	existing := corev1.Secret{}
+	if current != nil {
+		migrated, err := migrateLegacyFields(ctx, c, owner, current)
+		if err != nil {
+			return nil, controllerutil.OperationResultNone, err
+		}
+		existing = *migrated
+	}
+
+	secret := &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            secretCopy.Name,
+			Namespace:       secretCopy.Namespace,
+			Labels:          secretCopy.Labels,
+			OwnerReferences: secretCopy.OwnerReferences,
+		},
+		Type: secretCopy.Type,
+		Data: make(map[string][]byte, len(secretCopy.Data)+len(secretCopy.StringData)),
+	}
+	// stringData is write-only, so it cannot be owned by a field manager
+	for key, val := range secretCopy.Data {
+		secret.Data[key] = val
+	}
+	for key, val := range secretCopy.StringData {
+		secret.Data[key] = []byte(val)
+	}
+	for key := range noOverwrite {
+		if val, ok := existing.Data[key]; ok {
+			secret.Data[key] = val
+		}
+	}
+
+	err := c.Patch(ctx, secret, client.Apply, client.FieldOwner(fieldManager))
+	if err != nil {
+		return nil, controllerutil.OperationResultNone, err
+	}
+	switch {
+	case created:
+		return secret, controllerutil.OperationResultCreated, nil
+	case secret.ResourceVersion != existing.ResourceVersion:
+		return secret, controllerutil.OperationResultUpdated, nil
+	default:
+		return secret, controllerutil.OperationResultNone, nil
+	}
+}
+
+// migrateLegacyFields transfers the fields of a Secret written by the client-side updates of previous versions of the operator
+// to its server-side applies, so that applying does not conflict with them, and returns the migrated Secret.
+// The migration happens at most once: only Secrets derived from owner which have never been applied to are migrated,
+// so fields of a field manager which happens to have the same name as the legacy one are never taken over afterwards
+func migrateLegacyFields(ctx context.Context, c client.Client, owner client.Object, current *corev1.Secret) (*corev1.Secret, error) {
+	labels := current.GetLabels()
+	if labels[secretsv1alpha1.DerivedFromNameLabel] != owner.GetName() || labels[secretsv1alpha1.DerivedFromNamespaceLabel] != owner.GetNamespace() {
+		return current, nil
+	}
+	legacy := -1
+	for ix, entry := range current.ManagedFields {
+		if entry.Manager == fieldManager && entry.Operation == metav1.ManagedFieldsOperationApply {
+			return current, nil
+		}
+		if entry.Manager == legacyFieldManager && entry.Operation == metav1.ManagedFieldsOperationUpdate && entry.Subresource == "" {
+			legacy = ix
+		}
+	}
+	if legacy == -1 {
+		return current, nil
+	}
+
+	migrated := current.DeepCopy()
+	migrated.ManagedFields[legacy].Manager = fieldManager
+	migrated.ManagedFields[legacy].Operation = metav1.ManagedFieldsOperationApply
+	err := c.Patch(ctx, migrated, client.MergeFromWithOptions(current, client.MergeFromWithOptimisticLock{}))
+	if err != nil {
+		return nil, err
+	}
+	return migrated, nil
+}
+
+// updateManagedKeys calls remove for each key which was previously written by the operator, but is no longer rendered,
+// then records the rendered keys in the managed keys annotation.
+// Keys which are not overwritten are not recorded, so they are never removed, nor are keys written by anything else
+func updateManagedKeys(obj client.Object, rendered map[string]struct{}, noOverwrite map[string]struct{}, remove func(key string)) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	if previous := annotations[secretsv1alpha1.ManagedKeysAnnotation]; previous != "" {
+		for _, key := range strings.Split(previous, ",") {
+			if _, ok := rendered[key]; !ok {
+				remove(key)
+			}
+		}
+	}
+
+	managed := make([]string, 0, len(rendered))
+	for key := range rendered {
+		if _, skip := noOverwrite[key]; skip {
+			continue
+		}
+		managed = append(managed, key)
+	}
+	sort.Strings(managed)
+	annotations[secretsv1alpha1.ManagedKeysAnnotation] = strings.Join(managed, ",")
+	obj.SetAnnotations(annotations)
+}
+
+// releaseDerived applies a deletion policy to an object derived from owner. obj only needs its name and namespace set.
+// Objects which no longer exist, are no longer labeled as derived from owner, or do not have the expected UID (if set), are left alone
+func releaseDerived(ctx context.Context, c client.Client, owner client.Object, obj client.Object, uid types.UID, policy secretsv1alpha1.DeletionPolicy) error {
+	err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if uid != "" && obj.GetUID() != uid {
+		return nil
+	}
+	labels := obj.GetLabels()
+	if labels[secretsv1alpha1.DerivedFromNameLabel] != owner.GetName() || labels[secretsv1alpha1.DerivedFromNamespaceLabel] != owner.GetNamespace() {
+		return nil
+	}
+
+	switch policy {
+	case secretsv1alpha1.DeletionPolicyDelete:
+		uid := obj.GetUID()
+		return client.IgnoreNotFound(c.Delete(ctx, obj, client.Preconditions{UID: &uid}))
+	case secretsv1alpha1.DeletionPolicyOrphan:
+		for key := range secretsv1alpha1.DerivedFromLabelValues(owner) {
+			delete(labels, key)
+		}
+		obj.SetLabels(labels)
+	}
+
+	ownerRefs := make([]metav1.OwnerReference, 0, len(obj.GetOwnerReferences()))
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID != owner.GetUID() {
+			ownerRefs = append(ownerRefs, ref)
+		}
+	}
+	obj.SetOwnerReferences(ownerRefs)
+	return client.IgnoreNotFound(c.Update(ctx, obj, client.FieldOwner(fieldManager)))
+}
+
+// UncachedObjects are the types which the manager's client should always read live instead of from its cache.
+// Secrets are only watched with metadata-only informers, so that the contents of every Secret in the cluster are not held in memory.
+// Only the Secrets which are referenced or produced by a reconcile are read in full, and only for the duration of that reconcile
+func UncachedObjects() []client.Object {
+	return []client.Object{&corev1.Secret{}}
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+	"github.com/meln5674/secrets-operator/model"
+)
+
+// stageError is an error from a stage of reconciliation, along with the condition it sets to false, and a machine-readable reason
+type stageError struct {
+	Condition string
+	Reason    string
+	Err       error
+}
+
+func (e *stageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.Err
+}
+
+// referenceError wraps an error from fetching references
+func referenceError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*stageError); ok {
+		return err
+	}
+	reason := secretsv1alpha1.ReasonReferenceFailed
+	var agg utilerrors.Aggregate
+	switch {
+	case errors.As(err, &agg):
+		reason = secretsv1alpha1.ReasonInvalidSpec
+	case apierrors.IsNotFound(err):
+		reason = secretsv1alpha1.ReasonReferenceNotFound
+	case isImpersonationForbidden(err):
+		reason = secretsv1alpha1.ReasonImpersonationFailed
+	case apierrors.IsForbidden(err):
+		reason = secretsv1alpha1.ReasonForbidden
+	}
+	return &stageError{Condition: secretsv1alpha1.ConditionReferencesResolved, Reason: reason, Err: err}
+}
+
+// isImpersonationForbidden returns true if a request was rejected because the operator may not impersonate the ServiceAccount,
+// rather than because the ServiceAccount may not perform the request
+func isImpersonationForbidden(err error) bool {
+	return apierrors.IsForbidden(err) && strings.Contains(err.Error(), "cannot impersonate")
+}
+
+// impersonationError wraps an error from building a client which impersonates a ServiceAccount
+func impersonationError(condition string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &stageError{Condition: condition, Reason: secretsv1alpha1.ReasonImpersonationFailed, Err: fmt.Errorf("Failed to impersonate ServiceAccount: %w", err)}
+}
+
+// renderError wraps an error from rendering a derived object
+func renderError(err error) error {
+	if err == nil {
+		return nil
+	}
+	reason := secretsv1alpha1.ReasonTemplateFailed
+	var renderErr *model.RenderError
+	if errors.As(err, &renderErr) {
+		reason = renderErr.Reason
+	}
+	return &stageError{Condition: secretsv1alpha1.ConditionRendered, Reason: reason, Err: err}
+}
+
+// targetError wraps an error from writing a derived object
+func targetError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*stageError); ok {
+		return err
+	}
+	reason := secretsv1alpha1.ReasonTargetFailed
+	switch {
+	case apierrors.IsConflict(err), apierrors.IsAlreadyExists(err):
+		reason = secretsv1alpha1.ReasonTargetConflict
+	case isImpersonationForbidden(err):
+		reason = secretsv1alpha1.ReasonImpersonationFailed
+	case apierrors.IsForbidden(err):
+		reason = secretsv1alpha1.ReasonForbidden
+	}
+	return &stageError{Condition: secretsv1alpha1.ConditionTargetSynced, Reason: reason, Err: err}
+}
+
+// permanentReasons are reasons for errors which will not be resolved by retrying,
+// only by a change to the resource or its references, which will trigger a reconcile on their own
+var permanentReasons = map[string]struct{}{
+	secretsv1alpha1.ReasonInvalidSpec:            {},
+	secretsv1alpha1.ReasonServiceAccountRequired: {},
+	secretsv1alpha1.ReasonKeyCollision:           {},
+	secretsv1alpha1.ReasonInvalidTemplate:        {},
+	secretsv1alpha1.ReasonTemplateFailed:         {},
+	secretsv1alpha1.ReasonTemplateLimitExceeded:  {},
+	secretsv1alpha1.ReasonMissingKey:             {},
+	secretsv1alpha1.ReasonEmptyTemplateOutput:    {},
+	secretsv1alpha1.ReasonInvalidTemplateOutput:  {},
+	secretsv1alpha1.ReasonNamespaceNotWatched:    {},
+}
+
+// isPermanent returns true if an error will not be resolved by retrying
+func isPermanent(err error) bool {
+	reason := ""
+	var stageErr *stageError
+	var renderErr *model.RenderError
+	switch {
+	case errors.As(err, &stageErr):
+		reason = stageErr.Reason
+	case errors.As(err, &renderErr):
+		reason = renderErr.Reason
+	default:
+		return false
+	}
+	_, permanent := permanentReasons[reason]
+	return permanent
+}
+
+// stageConditions records the outcome of each stage of a reconciliation
+type stageConditions struct {
+	generation int64
+	stages     []string
+	succeeded  map[string]struct{}
+}
+
+func newStageConditions(generation int64, stages ...string) *stageConditions {
+	return &stageConditions{generation: generation, stages: stages, succeeded: make(map[string]struct{})}
+}
+
+// Succeeded records that the stage for a condition completed
+func (s *stageConditions) Succeeded(conditionType string) {
+	s.succeeded[conditionType] = struct{}{}
+}
+
+// Apply sets the condition for each stage, along with the Ready condition, given the final error of the reconciliation.
+// Stages which neither succeeded nor failed are set to Unknown
+func (s *stageConditions) Apply(conditions *[]metav1.Condition, err error) {
+	failedCondition := ""
+	reason := secretsv1alpha1.ReasonFailed
+	message := ""
+	if err != nil {
+		message = redactedErrorMessage(err)
+		var stageErr *stageError
+		if errors.As(err, &stageErr) {
+			failedCondition = stageErr.Condition
+			reason = stageErr.Reason
+		}
+	}
+
+	for _, conditionType := range s.stages {
+		condition := metav1.Condition{
+			Type:               conditionType,
+			ObservedGeneration: s.generation,
+		}
+		if _, ok := s.succeeded[conditionType]; ok {
+			condition.Status = metav1.ConditionTrue
+			condition.Reason = secretsv1alpha1.ReasonSynced
+		} else if conditionType == failedCondition {
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = reason
+			condition.Message = message
+		} else {
+			condition.Status = metav1.ConditionUnknown
+			condition.Reason = secretsv1alpha1.ReasonNotAttempted
+		}
+		meta.SetStatusCondition(conditions, condition)
+	}
+
+	ready := metav1.Condition{
+		Type:               secretsv1alpha1.ConditionReady,
+		ObservedGeneration: s.generation,
+	}
+	if err == nil {
+		ready.Status = metav1.ConditionTrue
+		ready.Reason = secretsv1alpha1.ReasonSynced
+	} else {
+		ready.Status = metav1.ConditionFalse
+		ready.Reason = reason
+		ready.Message = message
+	}
+	meta.SetStatusCondition(conditions, ready)
+}
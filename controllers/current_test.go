@@ -0,0 +1,78 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+// reconcileWithCurrent reconciles a DerivedSecret which appends to the current value of its password, returning the password written
+func reconcileWithCurrent(t *testing.T, objs ...client.Object) string {
+	template := `{{ with .Current.password }}{{ . | utf8 }},{{ end }}new`
+	derivedSecret := &secretsv1alpha1.DerivedSecret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app-ns", Name: "app"},
+		Spec: secretsv1alpha1.DerivedSecretSpec{
+			StringData: map[string]secretsv1alpha1.StringTarget{
+				"password": {TargetBase: secretsv1alpha1.TargetBase{Template: &template}},
+			},
+		},
+	}
+	c := &applyAsMergeClient{indexedClient: newIndexedClient(t, append(objs, derivedSecret)...)}
+	r := &DerivedSecretReconciler{Client: c, Scheme: c.Scheme()}
+	r.instrument()
+
+	ctx := context.Background()
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "app-ns", Name: "app"}}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, req.NamespacedName, derivedSecret); err != nil {
+		t.Fatal(err)
+	}
+	if derivedSecret.Status.Error != "" {
+		t.Fatalf("Expected the reconcile to succeed, got %s", derivedSecret.Status.Error)
+	}
+	secret := corev1.Secret{}
+	if err := r.Get(ctx, req.NamespacedName, &secret); err != nil {
+		t.Fatal(err)
+	}
+	return string(secret.Data["password"])
+}
+
+func TestTemplateReadsCurrentSecret(t *testing.T) {
+	current := secretIn("app-ns", "app")
+	current.Data = map[string][]byte{"password": []byte("old")}
+	if password := reconcileWithCurrent(t, current); password != "old,new" {
+		t.Fatalf("Expected the template to see the current password, got %q", password)
+	}
+}
+
+func TestTemplateCurrentSecretMissing(t *testing.T) {
+	if password := reconcileWithCurrent(t); password != "new" {
+		t.Fatalf("Expected .Current to be empty when the Secret does not exist, got %q", password)
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+// usedKeys are the keys of a Secret or ConfigMap which were used to render a derived object
+type usedKeys struct {
+	all  bool
+	keys map[string]struct{}
+}
+
+// referencedKeys returns the keys of a Secret or ConfigMap which a resource used, given its references,
+// the namespace that references without a namespace are resolved in, and the keys it accessed of each reference.
+// More than one reference may be to the same object
+func referencedKeys(namespace string, references []secretsv1alpha1.SensitiveReference, accessed []secretsv1alpha1.ReferenceSubset, kind string, obj client.Object) usedKeys {
+	used := usedKeys{keys: make(map[string]struct{})}
+	for ix := range references {
+		ref := &references[ix]
+		var name string
+		switch {
+		case kind == "Secret" && ref.SecretRef != nil:
+			name = ref.SecretRef.Name
+		case kind == "ConfigMap" && ref.ConfigMapRef != nil:
+			name = ref.ConfigMapRef.Name
+		default:
+			continue
+		}
+		if name != obj.GetName() || ref.NamespaceOrDefault(namespace) != obj.GetNamespace() {
+			continue
+		}
+		for _, subset := range accessed {
+			if subset.Name != ref.Name {
+				continue
+			}
+			if subset.AllKeys != nil && *subset.AllKeys {
+				used.all = true
+			}
+			for _, key := range subset.Keys {
+				used.keys[key] = struct{}{}
+			}
+		}
+	}
+	return used
+}
+
+// referenceData returns the contents of a Secret or ConfigMap, keyed the same way as in templates
+func referenceData(obj client.Object) map[string][]byte {
+	data := make(map[string][]byte)
+	switch o := obj.(type) {
+	case *corev1.Secret:
+		for key, value := range o.Data {
+			data[key] = value
+		}
+		for key, value := range o.StringData {
+			data[key] = []byte(value)
+		}
+	case *corev1.ConfigMap:
+		for key, value := range o.Data {
+			data[key] = []byte(value)
+		}
+		for key, value := range o.BinaryData {
+			data[key] = value
+		}
+	}
+	return data
+}
+
+// keysOf returns the keys which were used, in order. If every key was used, that includes every key in the contents of a Secret or ConfigMap
+func (u usedKeys) keysOf(datas ...map[string][]byte) []string {
+	keys := make([]string, 0, len(u.keys))
+	for key := range u.keys {
+		keys = append(keys, key)
+	}
+	if u.all {
+		seen := make(map[string]struct{}, len(u.keys))
+		for key := range u.keys {
+			seen[key] = struct{}{}
+		}
+		for _, data := range datas {
+			for key := range data {
+				if _, ok := seen[key]; !ok {
+					seen[key] = struct{}{}
+					keys = append(keys, key)
+				}
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// changed returns true if an update to a Secret or ConfigMap added, removed, or changed any of the keys which were used
+func (u usedKeys) changed(oldData, newData map[string][]byte) bool {
+	for _, key := range u.keysOf(oldData, newData) {
+		oldValue, inOld := oldData[key]
+		newValue, inNew := newData[key]
+		if inOld != inNew || !bytes.Equal(oldValue, newValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprint summarizes the values of the keys which were used, so that they can be compared without keeping the values
+func (u usedKeys) fingerprint(data map[string][]byte) [sha256.Size]byte {
+	hash := sha256.New()
+	writeField := func(field []byte) {
+		length := make([]byte, binary.MaxVarintLen64)
+		hash.Write(length[:binary.PutUvarint(length, uint64(len(field)))])
+		hash.Write(field)
+	}
+	for _, key := range u.keysOf(data) {
+		writeField([]byte(key))
+		if value, ok := data[key]; ok {
+			hash.Write([]byte{1})
+			writeField(value)
+		} else {
+			hash.Write([]byte{0})
+		}
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	return sum
+}
+
+// renderedCurrentSpec returns true if the status of a DerivedSecret, including its accessed keys,
+// is from a successful reconcile of its current spec
+func renderedCurrentSpec(derivedSecret *secretsv1alpha1.DerivedSecret) bool {
+	return derivedSecret.Status.ObservedGeneration == derivedSecret.Generation &&
+		meta.IsStatusConditionTrue(derivedSecret.Status.Conditions, secretsv1alpha1.ConditionReady)
+}
+
+// renderedCurrentConfigMapSpec is renderedCurrentSpec for a DerivedConfigMap, which has no conditions
+func renderedCurrentConfigMapSpec(derivedConfigMap *secretsv1alpha1.DerivedConfigMap) bool {
+	return derivedConfigMap.Status.ObservedGeneration == derivedConfigMap.Generation &&
+		derivedConfigMap.Status.Error == "" && derivedConfigMap.Status.LastSync != nil
+}
+
+// secretFingerprint is a fingerprint of the keys of a Secret which a DerivedSecret used when it was last rendered
+type secretFingerprint struct {
+	used usedKeys
+	sum  [sha256.Size]byte
+}
+
+// referenceFingerprints remembers a fingerprint of the keys each DerivedSecret used of each Secret it references.
+// Only the metadata of Secrets is cached, so updates to them do not include their previous contents to compare against.
+// Instead, the current contents are compared against the fingerprint from the last time each DerivedSecret was rendered
+type referenceFingerprints struct {
+	lock         sync.Mutex
+	fingerprints map[types.NamespacedName]map[types.NamespacedName]secretFingerprint
+}
+
+func newReferenceFingerprints() *referenceFingerprints {
+	return &referenceFingerprints{fingerprints: make(map[types.NamespacedName]map[types.NamespacedName]secretFingerprint)}
+}
+
+// Record replaces the fingerprints of the Secrets a DerivedSecret used, given the keys it accessed of each reference
+func (f *referenceFingerprints) Record(derivedSecret *secretsv1alpha1.DerivedSecret, sRefs map[string]corev1.Secret, accessed []secretsv1alpha1.ReferenceSubset) {
+	if f == nil {
+		return
+	}
+	fingerprints := make(map[types.NamespacedName]secretFingerprint, len(sRefs))
+	for name := range sRefs {
+		secret := sRefs[name]
+		key := client.ObjectKeyFromObject(&secret)
+		if _, ok := fingerprints[key]; ok {
+			continue
+		}
+		used := referencedKeys(derivedSecret.Namespace, derivedSecret.Spec.References, accessed, "Secret", &secret)
+		fingerprints[key] = secretFingerprint{used: used, sum: used.fingerprint(referenceData(&secret))}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.fingerprints[client.ObjectKeyFromObject(derivedSecret)] = fingerprints
+}
+
+// Forget removes the fingerprints of a DerivedSecret, so that any update to the Secrets it references queues it
+func (f *referenceFingerprints) Forget(derivedSecret types.NamespacedName) {
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.fingerprints, derivedSecret)
+}
+
+// Unchanged returns true if none of the keys that a DerivedSecret used of a Secret have changed since it was last rendered.
+// It returns false if there is no fingerprint for that DerivedSecret and Secret
+func (f *referenceFingerprints) Unchanged(derivedSecret types.NamespacedName, secret *corev1.Secret) bool {
+	if f == nil {
+		return false
+	}
+	f.lock.Lock()
+	fingerprint, ok := f.fingerprints[derivedSecret][client.ObjectKeyFromObject(secret)]
+	f.lock.Unlock()
+	if !ok {
+		return false
+	}
+	return fingerprint.used.fingerprint(referenceData(secret)) == fingerprint.sum
+}
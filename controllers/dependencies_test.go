@@ -0,0 +1,235 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+// recordingQueue records the requests which are queued, as AddRateLimited does not add them immediately
+type recordingQueue struct {
+	workqueue.RateLimitingInterface
+	queued []reconcile.Request
+}
+
+func (q *recordingQueue) AddRateLimited(item interface{}) {
+	q.queued = append(q.queued, item.(reconcile.Request))
+}
+
+// newRenderedDerivedSecret reconciles a DerivedSecret which uses one key of a Secret and one key of a ConfigMap,
+// which each also have a key it does not use
+func newRenderedDerivedSecret(t *testing.T) (*DerivedSecretReconciler, *corev1.Secret, *corev1.ConfigMap) {
+	source := secretIn("app-ns", "source")
+	source.Data = map[string][]byte{"password": []byte("hunter2"), "username": []byte("admin")}
+	settings := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app-ns", Name: "settings"},
+		Data:       map[string]string{"host": "db.example.com", "comment": "unused"},
+	}
+	secretReference := secretRef("source", "")
+	secretReference.Name = "creds"
+	configMapReference := configMapRef("settings", "")
+	configMapReference.Name = "settings"
+	template := `{{ .References.creds.password | utf8 }}@{{ index .References.settings "host" }}`
+	derivedSecret := &secretsv1alpha1.DerivedSecret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app-ns", Name: "app"},
+		Spec: secretsv1alpha1.DerivedSecretSpec{
+			References: []secretsv1alpha1.SensitiveReference{secretReference, configMapReference},
+			StringData: map[string]secretsv1alpha1.StringTarget{
+				"url": {TargetBase: secretsv1alpha1.TargetBase{Template: &template}},
+			},
+		},
+	}
+	c := &applyAsMergeClient{indexedClient: newIndexedClient(t, source, settings, derivedSecret)}
+	r := &DerivedSecretReconciler{Client: c, Scheme: c.Scheme(), fingerprints: newReferenceFingerprints()}
+	r.instrument()
+
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "app-ns", Name: "app"}}
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	return r, source, settings
+}
+
+func TestReconcileRecordsAccessedKeys(t *testing.T) {
+	r, _, _ := newRenderedDerivedSecret(t)
+	derivedSecret := &secretsv1alpha1.DerivedSecret{}
+	if err := r.Get(context.Background(), types.NamespacedName{Namespace: "app-ns", Name: "app"}, derivedSecret); err != nil {
+		t.Fatal(err)
+	}
+	if derivedSecret.Status.Error != "" {
+		t.Fatalf("Expected the reconcile to succeed, got %s", derivedSecret.Status.Error)
+	}
+	accessed := make([]string, 0, len(derivedSecret.Status.AccessedKeys))
+	for _, subset := range derivedSecret.Status.AccessedKeys {
+		accessed = append(accessed, fmt.Sprintf("%s=%v", subset.Name, subset.Keys))
+	}
+	if fmt.Sprint(accessed) != "[creds=[password] settings=[host]]" {
+		t.Fatalf("Expected only the keys used by the template to be accessed, got %v", accessed)
+	}
+}
+
+func TestConfigMapWatcherSkipsUnaccessedKeys(t *testing.T) {
+	r, _, settings := newRenderedDerivedSecret(t)
+	watcher := &DerivedSecretConfigMapWatcher{DerivedSecretWatcher: DerivedSecretWatcher{Reconciler: r}}
+	q := &recordingQueue{}
+
+	unrelated := settings.DeepCopy()
+	unrelated.Data["comment"] = "changed"
+	watcher.Update(event.UpdateEvent{ObjectOld: settings, ObjectNew: unrelated}, q)
+	if len(q.queued) != 0 {
+		t.Fatalf("Expected a change to an unused key not to queue the DerivedSecret")
+	}
+
+	related := settings.DeepCopy()
+	related.Data["host"] = "other.example.com"
+	watcher.Update(event.UpdateEvent{ObjectOld: settings, ObjectNew: related}, q)
+	if len(q.queued) != 1 {
+		t.Fatalf("Expected a change to a used key to queue the DerivedSecret")
+	}
+}
+
+func TestSecretWatcherSkipsUnaccessedKeys(t *testing.T) {
+	r, source, _ := newRenderedDerivedSecret(t)
+	watcher := &DerivedSecretSecretWatcher{DerivedSecretWatcher: DerivedSecretWatcher{Reconciler: r}}
+	q := &recordingQueue{}
+	ctx := context.Background()
+
+	// Secret watches are metadata only, so the watcher reads the new contents itself
+	old := secretIn(source.Namespace, source.Name)
+	if err := r.Get(ctx, types.NamespacedName{Namespace: source.Namespace, Name: source.Name}, source); err != nil {
+		t.Fatal(err)
+	}
+	source.Data["username"] = []byte("root")
+	if err := r.Update(ctx, source); err != nil {
+		t.Fatal(err)
+	}
+	watcher.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: secretIn(source.Namespace, source.Name)}, q)
+	if len(q.queued) != 0 {
+		t.Fatalf("Expected a change to an unused key not to queue the DerivedSecret")
+	}
+
+	source.Data["password"] = []byte("hunter3")
+	if err := r.Update(ctx, source); err != nil {
+		t.Fatal(err)
+	}
+	watcher.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: secretIn(source.Namespace, source.Name)}, q)
+	if len(q.queued) != 1 {
+		t.Fatalf("Expected a change to a used key to queue the DerivedSecret")
+	}
+}
+
+func TestWatcherQueuesUnrenderedDerivedSecrets(t *testing.T) {
+	r, source, _ := newRenderedDerivedSecret(t)
+	r.fingerprints.Forget(types.NamespacedName{Namespace: "app-ns", Name: "app"})
+	watcher := &DerivedSecretSecretWatcher{DerivedSecretWatcher: DerivedSecretWatcher{Reconciler: r}}
+	q := &recordingQueue{}
+
+	// Without a fingerprint from the last render, such as after a restart, any update may have changed a used key
+	watcher.Update(event.UpdateEvent{ObjectOld: source, ObjectNew: source}, q)
+	if len(q.queued) != 1 {
+		t.Fatalf("Expected an update to queue a DerivedSecret with no fingerprint")
+	}
+}
+
+// newRenderedDerivedConfigMap reconciles a DerivedConfigMap which uses one key of a ConfigMap which also has a key it does not use
+func newRenderedDerivedConfigMap(t *testing.T) (*DerivedConfigMapReconciler, *corev1.ConfigMap) {
+	settings := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app-ns", Name: "settings"},
+		Data:       map[string]string{"host": "db.example.com", "comment": "unused"},
+	}
+	template := `{{ index .References.settings "host" }}`
+	derivedConfigMap := &secretsv1alpha1.DerivedConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app-ns", Name: "app"},
+		Spec: secretsv1alpha1.DerivedConfigMapSpec{
+			References: []secretsv1alpha1.Reference{{Name: "settings", ConfigMapRef: *configMapRef("settings", "").ConfigMapRef}},
+			Data: map[string]secretsv1alpha1.StringTarget{
+				"host": {TargetBase: secretsv1alpha1.TargetBase{Template: &template}},
+			},
+		},
+	}
+	c := newIndexedClient(t, settings, derivedConfigMap)
+	if err := indexReferences(context.Background(), c, &secretsv1alpha1.DerivedConfigMap{}, derivedConfigMapReferences); err != nil {
+		t.Fatal(err)
+	}
+	r := &DerivedConfigMapReconciler{Client: c, Scheme: c.Scheme()}
+
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "app-ns", Name: "app"}}
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	return r, settings
+}
+
+func TestDerivedConfigMapWatcherSkipsUnaccessedKeys(t *testing.T) {
+	r, settings := newRenderedDerivedConfigMap(t)
+	watcher := &DerivedConfigMapConfigMapWatcher{DerivedConfigMapWatcher: DerivedConfigMapWatcher{Reconciler: r}}
+	q := &recordingQueue{}
+
+	unrelated := settings.DeepCopy()
+	unrelated.Data["comment"] = "changed"
+	watcher.Update(event.UpdateEvent{ObjectOld: settings, ObjectNew: unrelated}, q)
+	if len(q.queued) != 0 {
+		t.Fatalf("Expected a change to an unused key not to queue the DerivedConfigMap")
+	}
+
+	related := settings.DeepCopy()
+	related.Data["host"] = "other.example.com"
+	watcher.Update(event.UpdateEvent{ObjectOld: settings, ObjectNew: related}, q)
+	if len(q.queued) != 1 {
+		t.Fatalf("Expected a change to a used key to queue the DerivedConfigMap")
+	}
+}
+
+func TestDerivedConfigMapWatcherQueuesChangedSpec(t *testing.T) {
+	r, settings := newRenderedDerivedConfigMap(t)
+	ctx := context.Background()
+	derivedConfigMap := &secretsv1alpha1.DerivedConfigMap{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "app-ns", Name: "app"}, derivedConfigMap); err != nil {
+		t.Fatal(err)
+	}
+	if derivedConfigMap.Status.ObservedGeneration != derivedConfigMap.Generation {
+		t.Fatalf("Expected generation %d to be observed, got %d", derivedConfigMap.Generation, derivedConfigMap.Status.ObservedGeneration)
+	}
+	// The accessed keys are from the previous spec until it is reconciled again
+	template := `{{ index .References.settings "comment" }}`
+	derivedConfigMap.Spec.Data["comment"] = secretsv1alpha1.StringTarget{TargetBase: secretsv1alpha1.TargetBase{Template: &template}}
+	derivedConfigMap.Generation++
+	if err := r.Update(ctx, derivedConfigMap); err != nil {
+		t.Fatal(err)
+	}
+	watcher := &DerivedConfigMapConfigMapWatcher{DerivedConfigMapWatcher: DerivedConfigMapWatcher{Reconciler: r}}
+	q := &recordingQueue{}
+
+	changed := settings.DeepCopy()
+	changed.Data["comment"] = "changed"
+	watcher.Update(event.UpdateEvent{ObjectOld: settings, ObjectNew: changed}, q)
+	if len(q.queued) != 1 {
+		t.Fatalf("Expected an update to queue a DerivedConfigMap whose spec has not been rendered")
+	}
+}
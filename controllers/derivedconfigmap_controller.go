@@ -0,0 +1,515 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+	"github.com/meln5674/secrets-operator/model"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DerivedConfigMapReconciler reconciles a DerivedConfigMap object
+type DerivedConfigMapReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// ImpersonatingClients provides clients for ServiceAccounts when accessing other namespaces
+	ImpersonatingClients *ImpersonatingClientCache
+	// Namespaces restricts which namespaces are reconciled and written to
+	Namespaces NamespaceScope
+	// DefaultResyncInterval is how often to regenerate derived objects if the resource does not set its own interval. Never if nil
+	DefaultResyncInterval *metav1.Duration
+	// ControllerOptions configures the concurrency and rate limiting of the controller
+	ControllerOptions controller.Options
+	// RequireServiceAccountReferences reads references by impersonating the ServiceAccount of every DerivedConfigMap,
+	// see DerivedSecretReconciler.RequireServiceAccountReferences
+	RequireServiceAccountReferences bool
+}
+
+type DerivedConfigMapReconcilerRunStage1 struct {
+	*DerivedConfigMapReconciler
+	logger logr.Logger
+	ctx    context.Context
+	src    *secretsv1alpha1.DerivedConfigMap
+}
+
+type DerivedConfigMapReconcilerRunStage2 struct {
+	*DerivedConfigMapReconcilerRunStage1
+	cmRefs map[string]corev1.ConfigMap
+}
+
+type DerivedConfigMapReconcilerRunStage3 struct {
+	*DerivedConfigMapReconcilerRunStage2
+	configMap *corev1.ConfigMap
+	operation controllerutil.OperationResult
+}
+
+func (r *DerivedConfigMapReconcilerRunStage1) SensitiveReferences() []secretsv1alpha1.SensitiveReference {
+	references := make([]secretsv1alpha1.SensitiveReference, 0, len(r.src.Spec.References))
+	for ix := range r.src.Spec.References {
+		references = append(references, r.src.Spec.References[ix].AsSensitiveReference())
+	}
+	return references
+}
+
+// FetchReferences reads the references of the DerivedConfigMap.
+// referenceClient is used for references in other namespaces, or for every reference if RequireServiceAccountReferences is set
+func (r *DerivedConfigMapReconcilerRunStage1) FetchReferences(referenceClient client.Client) (nextR *DerivedConfigMapReconcilerRunStage2, err error) {
+	references := r.SensitiveReferences()
+	localClient := r.Client
+	if r.RequireServiceAccountReferences {
+		localClient = referenceClient
+	}
+	cmRefs, _, err := fetchReferences(r.ctx, localClient, referenceClient, r.src.Namespace, references)
+	if err != nil {
+		return nil, err
+	}
+	r.src.Status.MissingReferences = model.MissingReferences(references, cmRefs, nil)
+	return &DerivedConfigMapReconcilerRunStage2{DerivedConfigMapReconcilerRunStage1: r, cmRefs: cmRefs}, nil
+}
+
+func (r *DerivedConfigMapReconcilerRunStage1) GetClientForReferences() (client.Client, error) {
+	if err := r.Namespaces.checkReferences(r.src.Namespace, r.SensitiveReferences()); err != nil {
+		return nil, err
+	}
+	if r.RequireServiceAccountReferences {
+		r.logger.Info("Reading references with ServiceAccount privileges, using impersonation")
+		if r.src.Spec.ServiceAccountName == "" {
+			return nil, fmt.Errorf("spec.serviceAccountName is required to read references with ServiceAccount privileges")
+		}
+	} else if !hasCrossNamespaceReferences(r.src.Namespace, r.SensitiveReferences()) {
+		return nil, nil
+	} else {
+		r.logger.Info("References include other namespaces, using impersonation")
+		if r.src.Spec.ServiceAccountName == "" {
+			return nil, fmt.Errorf("spec.serviceAccountName is required when referencing a secret or configmap in another namespace")
+		}
+	}
+
+	return r.ImpersonatingClients.Get(r.src.Namespace, r.src.Spec.ServiceAccountName)
+}
+
+func (r *DerivedConfigMapReconcilerRunStage1) GetClientForConfigMap() (client.Client, error) {
+	targetNamespace := r.src.Spec.TargetNamespace
+	if targetNamespace == "" {
+		targetNamespace = r.src.Namespace
+	}
+	if err := r.Namespaces.checkTarget(r.src.Namespace, targetNamespace); err != nil {
+		return nil, err
+	}
+	return r.clientForConfigMapNamespace(targetNamespace)
+}
+
+// clientForConfigMapNamespace returns the client to use for ConfigMaps in a namespace, impersonating the ServiceAccount if it is not the DerivedConfigMap's namespace
+func (r *DerivedConfigMapReconcilerRunStage1) clientForConfigMapNamespace(targetNamespace string) (client.Client, error) {
+	if targetNamespace == r.src.Namespace {
+		return r.Client, nil
+	}
+
+	r.logger.Info("Target namespace is different than source, using impersonation", "targetNamespace", targetNamespace)
+	if r.src.Spec.ServiceAccountName == "" {
+		return nil, fmt.Errorf("spec.serviceAccountName is required when creating a configmap in another namespace")
+	}
+
+	return r.ImpersonatingClients.Get(r.src.Namespace, r.src.Spec.ServiceAccountName)
+}
+
+func (r *DerivedConfigMapReconcilerRunStage2) CreateConfigMap(configMapClient client.Client) (nextR *DerivedConfigMapReconcilerRunStage3, err error) {
+	configMapCopy, noOverwrite, accessed, err := model.GenerateConfigMap(r.cmRefs, r.src)
+	if err != nil {
+		r.src.Status.AccessedKeys = nil
+		return nil, err
+	}
+	r.src.Status.AccessedKeys = accessed
+	r.logger.Info("ConfigMap generated")
+
+	if configMapCopy.Namespace == r.src.Namespace {
+		err = ctrl.SetControllerReference(r.src, &configMapCopy, r.Scheme)
+		if err != nil {
+			return nil, err
+		}
+		r.logger.Info("ConfigMap controller set")
+	}
+
+	configMap := configMapCopy.DeepCopy()
+
+	operation, err := ctrl.CreateOrUpdate(r.ctx, configMapClient, configMap, func() error {
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		for key, val := range configMapCopy.Data {
+			if _, skip := noOverwrite[key]; skip {
+				continue
+			}
+			configMap.Data[key] = val
+		}
+		if configMap.BinaryData == nil {
+			configMap.BinaryData = make(map[string][]byte)
+		}
+		for key, val := range configMapCopy.BinaryData {
+			if _, skip := noOverwrite[key]; skip {
+				continue
+			}
+			configMap.BinaryData[key] = val
+		}
+		if configMap.Labels == nil {
+			configMap.Labels = make(map[string]string)
+		}
+		for key, value := range configMapCopy.Labels {
+			configMap.Labels[key] = value
+		}
+		rendered := make(map[string]struct{}, len(configMapCopy.Data)+len(configMapCopy.BinaryData))
+		for key := range configMapCopy.Data {
+			rendered[key] = struct{}{}
+		}
+		for key := range configMapCopy.BinaryData {
+			rendered[key] = struct{}{}
+		}
+		updateManagedKeys(configMap, rendered, noOverwrite, func(key string) {
+			delete(configMap.Data, key)
+			delete(configMap.BinaryData, key)
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.src.Status.ConfigMapName = configMap.Name
+	r.src.Status.ConfigMapNamespace = configMap.Namespace
+	return &DerivedConfigMapReconcilerRunStage3{DerivedConfigMapReconcilerRunStage2: r, configMap: configMap, operation: operation}, nil
+}
+
+// CleanInventory deletes every ConfigMap in the inventory other than the one just written, and replaces the inventory.
+// ConfigMaps which could not be deleted are kept in the inventory, so that they are retried on the next reconcile
+func (r *DerivedConfigMapReconcilerRunStage3) CleanInventory() error {
+	inventory := []secretsv1alpha1.DerivedObjectReference{{
+		Namespace: r.configMap.Namespace,
+		Name:      r.configMap.Name,
+		UID:       r.configMap.UID,
+	}}
+	var errs []error
+	for _, ref := range r.previousInventory() {
+		if ref.Namespace == r.configMap.Namespace && ref.Name == r.configMap.Name {
+			continue
+		}
+		err := r.releaseConfigMap(ref, secretsv1alpha1.DeletionPolicyDelete)
+		if err != nil {
+			r.logger.Info("Failed to delete previously derived configmap, will retry", "configMapNamespace", ref.Namespace, "configMapName", ref.Name, "error", err)
+			errs = append(errs, fmt.Errorf("Failed to delete previously derived ConfigMap %s/%s: %w", ref.Namespace, ref.Name, err))
+			inventory = append(inventory, ref)
+			continue
+		}
+		r.logger.Info("Deleted previously derived configmap", "configMapNamespace", ref.Namespace, "configMapName", ref.Name)
+	}
+	r.src.Status.Inventory = inventory
+	return utilerrors.NewAggregate(errs)
+}
+
+// previousInventory returns the ConfigMaps written by previous reconciles.
+// DerivedConfigMaps which were last reconciled before the inventory existed only have their last ConfigMap recorded
+func (r *DerivedConfigMapReconcilerRunStage1) previousInventory() []secretsv1alpha1.DerivedObjectReference {
+	if len(r.src.Status.Inventory) != 0 || r.src.Status.ConfigMapName == "" {
+		return r.src.Status.Inventory
+	}
+	return []secretsv1alpha1.DerivedObjectReference{{
+		Namespace: r.src.Status.ConfigMapNamespace,
+		Name:      r.src.Status.ConfigMapName,
+	}}
+}
+
+// releaseConfigMap applies a deletion policy to a ConfigMap in the inventory
+func (r *DerivedConfigMapReconcilerRunStage1) releaseConfigMap(ref secretsv1alpha1.DerivedObjectReference, policy secretsv1alpha1.DeletionPolicy) error {
+	configMapClient, err := r.clientForConfigMapNamespace(ref.Namespace)
+	if err != nil {
+		return err
+	}
+	configMap := corev1.ConfigMap{}
+	configMap.Name = ref.Name
+	configMap.Namespace = ref.Namespace
+	return releaseDerived(r.ctx, configMapClient, r.src, &configMap, ref.UID, policy)
+}
+
+// EnsureFinalizer adds the cleanup finalizer, if it is not already present
+func (r *DerivedConfigMapReconcilerRunStage1) EnsureFinalizer() error {
+	if controllerutil.ContainsFinalizer(r.src, secretsv1alpha1.CleanupFinalizer) {
+		return nil
+	}
+	controllerutil.AddFinalizer(r.src, secretsv1alpha1.CleanupFinalizer)
+	return r.Update(r.ctx, r.src)
+}
+
+// Finalize applies the deletion policy to every ConfigMap in the inventory, then removes the cleanup finalizer,
+// see DerivedSecretReconcilerRunStage1.Finalize
+func (r *DerivedConfigMapReconcilerRunStage1) Finalize() error {
+	if !controllerutil.ContainsFinalizer(r.src, secretsv1alpha1.CleanupFinalizer) {
+		return nil
+	}
+
+	policy := r.src.Spec.DeletionPolicy
+	if policy == "" {
+		policy = secretsv1alpha1.DefaultDeletionPolicy
+	}
+
+	for _, ref := range r.previousInventory() {
+		err := r.releaseConfigMap(ref, policy)
+		if releaseAbandoned(err) {
+			r.logger.Info("Deletion policy cannot be applied, abandoning configmap", "policy", policy, "configMapNamespace", ref.Namespace, "configMapName", ref.Name, "error", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		r.logger.Info("Deletion policy applied", "policy", policy, "configMapNamespace", ref.Namespace, "configMapName", ref.Name)
+	}
+
+	controllerutil.RemoveFinalizer(r.src, secretsv1alpha1.CleanupFinalizer)
+	return r.Update(r.ctx, r.src)
+}
+
+func (r *DerivedConfigMapReconcilerRunStage1) SyncStatus(err error) error {
+	if err == nil {
+		now := metav1.Now()
+		r.src.Status.Error = ""
+		r.src.Status.LastSync = &now
+	} else {
+		r.src.Status.Error = redactedErrorMessage(err)
+	}
+	r.src.Status.ObservedGeneration = r.src.Generation
+	uperr := r.Status().Update(r.ctx, r.src)
+	if uperr != nil {
+		return uperr
+	}
+	return err
+}
+
+//+kubebuilder:rbac:groups=secrets.meln5674.github.com,resources=derivedconfigmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=secrets.meln5674.github.com,resources=derivedconfigmaps/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=secrets.meln5674.github.com,resources=derivedconfigmaps/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+func (r *DerivedConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	logger := log.FromContext(ctx).WithValues("request", req)
+
+	logger.Info("Got request")
+
+	if !r.Namespaces.Watches(req.Namespace) {
+		logger.Info("Namespace is not watched, ignoring")
+		return ctrl.Result{}, nil
+	}
+
+	src := secretsv1alpha1.DerivedConfigMap{}
+
+	err = r.Get(ctx, req.NamespacedName, &src)
+
+	if client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err != nil {
+		logger.Info("Got not found, assuming deleted", "error", err)
+		return ctrl.Result{}, nil
+	}
+
+	r1 := DerivedConfigMapReconcilerRunStage1{DerivedConfigMapReconciler: r, ctx: ctx, src: &src, logger: logger}
+
+	if !src.DeletionTimestamp.IsZero() {
+		logger.Info("Being deleted, applying deletion policy")
+		return ctrl.Result{}, r1.Finalize()
+	}
+
+	err = r1.EnsureFinalizer()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	now := metav1.Now()
+	src.Status.LastSyncAttempt = &now
+
+	// See DerivedSecretReconciler.Reconcile
+	defer func() {
+		result, err = reconcileResult(logger, r1.SyncStatus(err), r.DefaultResyncInterval)
+	}()
+
+	configMapClient, err := r1.GetClientForConfigMap()
+	if err != nil {
+		return
+	}
+
+	referenceClient, err := r1.GetClientForReferences()
+	if err != nil {
+		return
+	}
+
+	r2, err := r1.FetchReferences(referenceClient)
+	if err != nil {
+		return
+	}
+	logger.Info("All references fetched")
+
+	r3, err := r2.CreateConfigMap(configMapClient)
+	if err != nil {
+		return
+	}
+	logger.Info("ConfigMap created/updated", "result", r3.operation)
+
+	err = r3.CleanInventory()
+	if err != nil {
+		return
+	}
+
+	logger.Info("Status updated, reconciliation complete")
+	return
+}
+
+// derivedConfigMapReferences extracts the references of a DerivedConfigMap for the reference indexes
+func derivedConfigMapReferences(obj client.Object) (string, []secretsv1alpha1.SensitiveReference) {
+	derivedConfigMap := obj.(*secretsv1alpha1.DerivedConfigMap)
+	references := make([]secretsv1alpha1.SensitiveReference, 0, len(derivedConfigMap.Spec.References))
+	for ix := range derivedConfigMap.Spec.References {
+		references = append(references, derivedConfigMap.Spec.References[ix].AsSensitiveReference())
+	}
+	return derivedConfigMap.Namespace, references
+}
+
+type DerivedConfigMapWatcher struct {
+	Reconciler *DerivedConfigMapReconciler
+}
+
+// ReferencingDerivedConfigMaps returns a request for each DerivedConfigMap which references a ConfigMap
+func (w *DerivedConfigMapWatcher) ReferencingDerivedConfigMaps(kind string, obj client.Object) ([]reconcile.Request, error) {
+	referees, err := w.referencingDerivedConfigMaps(kind, obj)
+	if err != nil {
+		return nil, err
+	}
+	return requestsFor(referees), nil
+}
+
+func (w *DerivedConfigMapWatcher) referencingDerivedConfigMaps(kind string, obj client.Object) ([]client.Object, error) {
+	key, ok := referenceKeyForKind(kind)
+	if !ok || key != referencedConfigMapsKey {
+		return nil, nil
+	}
+	return listReferencing(context.TODO(), w.Reconciler, &secretsv1alpha1.DerivedConfigMapList{}, key, referenceIndexValue(obj.GetNamespace(), obj.GetName()))
+}
+
+// QueueReferencingDerivedConfigMaps queues the DerivedConfigMaps which reference a ConfigMap.
+// If changed is not nil, only those for which it returns true are queued
+func (w *DerivedConfigMapWatcher) QueueReferencingDerivedConfigMaps(kind string, obj client.Object, changed func(*secretsv1alpha1.DerivedConfigMap) bool, q workqueue.RateLimitingInterface) {
+	logger := log.FromContext(context.TODO()).WithValues("namespace", obj.GetNamespace(), kind, obj.GetName())
+	referees, err := w.referencingDerivedConfigMaps(kind, obj)
+	if err != nil {
+		logger.Info("Failed to find DerivedConfigMaps which have reference", "error", err)
+		return
+	}
+
+	if changed != nil {
+		filtered := make([]client.Object, 0, len(referees))
+		for _, referee := range referees {
+			if !changed(referee.(*secretsv1alpha1.DerivedConfigMap)) {
+				logger.V(1).Info("No accessed keys changed, not queuing referee", "referee", referee)
+				continue
+			}
+			filtered = append(filtered, referee)
+		}
+		referees = filtered
+	}
+
+	requests := requestsFor(referees)
+	if len(requests) == 0 {
+		return
+	}
+	logger.Info("Queuing referees", "referees", requests)
+	for _, request := range requests {
+		q.AddRateLimited(request)
+	}
+}
+
+type DerivedConfigMapConfigMapWatcher struct {
+	DerivedConfigMapWatcher
+}
+
+var (
+	_ = handler.EventHandler(&DerivedConfigMapConfigMapWatcher{})
+)
+
+func (w *DerivedConfigMapConfigMapWatcher) QueueConfigMapReferencingDerivedConfigMaps(configMap client.Object, changed func(*secretsv1alpha1.DerivedConfigMap) bool, q workqueue.RateLimitingInterface) {
+	w.DerivedConfigMapWatcher.QueueReferencingDerivedConfigMaps("ConfigMap", configMap, changed, q)
+}
+
+func (w *DerivedConfigMapConfigMapWatcher) Create(e event.CreateEvent, q workqueue.RateLimitingInterface) {
+	w.QueueConfigMapReferencingDerivedConfigMaps(e.Object, nil, q)
+}
+
+// Update queues the DerivedConfigMaps which used any keys of the ConfigMap that the update changed
+func (w *DerivedConfigMapConfigMapWatcher) Update(e event.UpdateEvent, q workqueue.RateLimitingInterface) {
+	oldData := referenceData(e.ObjectOld)
+	newData := referenceData(e.ObjectNew)
+	changed := func(derivedConfigMap *secretsv1alpha1.DerivedConfigMap) bool {
+		if !renderedCurrentConfigMapSpec(derivedConfigMap) {
+			return true
+		}
+		namespace, references := derivedConfigMapReferences(derivedConfigMap)
+		used := referencedKeys(namespace, references, derivedConfigMap.Status.AccessedKeys, "ConfigMap", e.ObjectNew)
+		return used.changed(oldData, newData)
+	}
+	w.QueueConfigMapReferencingDerivedConfigMaps(e.ObjectNew, changed, q)
+}
+
+func (w *DerivedConfigMapConfigMapWatcher) Delete(e event.DeleteEvent, q workqueue.RateLimitingInterface) {
+	w.QueueConfigMapReferencingDerivedConfigMaps(e.Object, nil, q)
+}
+
+func (w *DerivedConfigMapConfigMapWatcher) Generic(e event.GenericEvent, q workqueue.RateLimitingInterface) {
+	w.QueueConfigMapReferencingDerivedConfigMaps(e.Object, nil, q)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *DerivedConfigMapReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	if err := indexReferences(context.Background(), mgr.GetFieldIndexer(), &secretsv1alpha1.DerivedConfigMap{}, derivedConfigMapReferences); err != nil {
+		return err
+	}
+
+	watcher := DerivedConfigMapWatcher{Reconciler: r}
+	return ctrl.NewControllerManagedBy(mgr).
+		WithOptions(r.ControllerOptions).
+		For(&secretsv1alpha1.DerivedConfigMap{}, builder.WithPredicates(specChangedPredicate, r.Namespaces.Predicate())).
+		Owns(&corev1.ConfigMap{}).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, &DerivedConfigMapConfigMapWatcher{DerivedConfigMapWatcher: watcher}).
+		Complete(r)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+func TestDerivedConfigMapRenameDeletesPrevious(t *testing.T) {
+	template := "bar"
+	derivedConfigMap := &secretsv1alpha1.DerivedConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app-ns", Name: "app"},
+		Spec: secretsv1alpha1.DerivedConfigMapSpec{
+			TargetName: "first-name",
+			Data: map[string]secretsv1alpha1.StringTarget{
+				"foo": {TargetBase: secretsv1alpha1.TargetBase{Template: &template}},
+			},
+		},
+	}
+	c := newIndexedClient(t, derivedConfigMap)
+	r := &DerivedConfigMapReconciler{Client: c, Scheme: c.Scheme()}
+
+	ctx := context.Background()
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "app-ns", Name: "app"}}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, req.NamespacedName, derivedConfigMap); err != nil {
+		t.Fatal(err)
+	}
+	derivedConfigMap.Spec.TargetName = "second-name"
+	if err := r.Update(ctx, derivedConfigMap); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "app-ns", Name: "second-name"}, &corev1.ConfigMap{}); err != nil {
+		t.Fatalf("Expected the renamed ConfigMap to exist, got %s", err)
+	}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "app-ns", Name: "first-name"}, &corev1.ConfigMap{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("Expected the previous ConfigMap to be deleted, got %v", err)
+	}
+	if err := r.Get(ctx, req.NamespacedName, derivedConfigMap); err != nil {
+		t.Fatal(err)
+	}
+	inventory := derivedConfigMap.Status.Inventory
+	if len(inventory) != 1 || inventory[0].Name != "second-name" {
+		t.Fatalf("Expected only the renamed ConfigMap in the inventory, got %v", inventory)
+	}
+}
+
+// forbiddenConfigMapsClient stands in for a ServiceAccount which may not read ConfigMaps
+type forbiddenConfigMapsClient struct {
+	*indexedClient
+}
+
+func (c *forbiddenConfigMapsClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if _, ok := obj.(*corev1.ConfigMap); ok {
+		return apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, key.Name, nil)
+	}
+	return c.indexedClient.Get(ctx, key, obj)
+}
+
+func TestDerivedConfigMapRequireServiceAccountReferences(t *testing.T) {
+	settings := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "app-ns", Name: "settings"}}
+	derivedConfigMap := &secretsv1alpha1.DerivedConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app-ns", Name: "app"},
+		Spec: secretsv1alpha1.DerivedConfigMapSpec{
+			References: []secretsv1alpha1.Reference{{Name: "settings", ConfigMapRef: *configMapRef("settings", "").ConfigMapRef}},
+		},
+	}
+	c := newIndexedClient(t, settings)
+	serviceAccountClient := &forbiddenConfigMapsClient{indexedClient: c}
+
+	for _, require := range []bool{false, true} {
+		r := &DerivedConfigMapReconcilerRunStage1{
+			DerivedConfigMapReconciler: &DerivedConfigMapReconciler{Client: c, Scheme: c.Scheme(), RequireServiceAccountReferences: require},
+			logger:                     ctrl.Log,
+			ctx:                        context.Background(),
+			src:                        derivedConfigMap.DeepCopy(),
+		}
+
+		_, err := r.GetClientForReferences()
+		if require && (err == nil || !strings.Contains(err.Error(), "spec.serviceAccountName is required")) {
+			t.Fatalf("Expected a ServiceAccount to be required, got %v", err)
+		}
+		if !require && err != nil {
+			t.Fatalf("Expected no ServiceAccount to be required for references in the same namespace, got %s", err)
+		}
+
+		_, err = r.FetchReferences(serviceAccountClient)
+		if require && !apierrors.IsForbidden(err) {
+			t.Fatalf("Expected references in the same namespace to be read as the ServiceAccount, got %v", err)
+		}
+		if !require && err != nil {
+			t.Fatalf("Expected references in the same namespace to be read as the operator, got %s", err)
+		}
+	}
+}
@@ -20,47 +20,66 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/cluster"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
-	"k8s.io/client-go/rest"
-
 	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
 	"github.com/meln5674/secrets-operator/model"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-const (
-	referencedSecretsKey    = ".metadata.references.secrets"
-	referencedConfigMapsKey = ".metadata.references.configMaps"
-	secretDerivedFromKey    = ".metadata.derivedFrom.derivedSecret"
-)
-
 // DerivedSecretReconciler reconciles a DerivedSecret object
 type DerivedSecretReconciler struct {
 	client.Client
-	Scheme     *runtime.Scheme
-	RestConfig *rest.Config
-	Manager    ctrl.Manager
+	Scheme *runtime.Scheme
+	// ImpersonatingClients provides clients for ServiceAccounts when accessing other namespaces
+	ImpersonatingClients *ImpersonatingClientCache
+	// Namespaces restricts which namespaces are reconciled and written to
+	Namespaces NamespaceScope
+	// DefaultResyncInterval is how often to regenerate derived objects if the resource does not set its own interval. Never if nil
+	DefaultResyncInterval *metav1.Duration
+	// ControllerOptions configures the concurrency and rate limiting of the controller
+	ControllerOptions controller.Options
+	// RequireServiceAccountReferences reads references by impersonating the ServiceAccount of every DerivedSecret,
+	// as if they all had a referenceAccess of ServiceAccount
+	RequireServiceAccountReferences bool
+	// Recorder emits Events about the outcome of each reconcile
+	Recorder record.EventRecorder
+	// TracerProvider creates the spans of each reconcile. Defaults to the global provider
+	TracerProvider trace.TracerProvider
+
+	events       *eventRecorder
+	tracer       trace.Tracer
+	traces       *pendingTraces
+	fingerprints *referenceFingerprints
 }
 
 type DerivedSecretReconcilerRunStage1 struct {
 	*DerivedSecretReconciler
-	logger logr.Logger
-	ctx    context.Context
-	src    *secretsv1alpha1.DerivedSecret
+	logger     logr.Logger
+	ctx        context.Context
+	src        *secretsv1alpha1.DerivedSecret
+	conditions *stageConditions
 }
 
 type DerivedSecretReconcilerRunStage2 struct {
@@ -74,167 +93,271 @@ type DerivedSecretReconcilerRunStage3 struct {
 	secret *corev1.Secret
 }
 
-func (r *DerivedSecretReconcilerRunStage1) FetchReferences() (nextR *DerivedSecretReconcilerRunStage2, err error) {
-	cmRefs := make(map[string]corev1.ConfigMap)
-	sRefs := make(map[string]corev1.Secret)
+// FetchReferences reads the references of the DerivedSecret.
+// referenceClient is used for references in other namespaces, or for every reference if they are read with the ServiceAccount's privileges
+func (r *DerivedSecretReconcilerRunStage1) FetchReferences(referenceClient client.Client) (nextR *DerivedSecretReconcilerRunStage2, err error) {
+	end := r.startStage("FetchReferences", attrReferences.Int(len(r.src.Spec.References)))
+	defer func() { end(err) }()
 
-	refKeys := make(map[string]struct{})
+	localClient := r.Client
+	if r.readsReferencesAsServiceAccount() {
+		localClient = referenceClient
+	}
+	cmRefs, sRefs, err := fetchReferences(r.ctx, localClient, referenceClient, r.src.Namespace, r.src.Spec.References)
+	if err != nil {
+		return nil, referenceError(err)
+	}
+	r.conditions.Succeeded(secretsv1alpha1.ConditionReferencesResolved)
+	r.src.Status.MissingReferences = model.MissingReferences(r.src.Spec.References, cmRefs, sRefs)
+	if len(r.src.Status.MissingReferences) != 0 {
+		r.logger.Info("Optional references do not exist", "references", r.src.Status.MissingReferences)
+		r.events.Eventf(r.src, corev1.EventTypeNormal, secretsv1alpha1.EventReasonReferencesFetched, "Fetched %d references, optional references %s do not exist", len(r.src.Spec.References)-len(r.src.Status.MissingReferences), strings.Join(r.src.Status.MissingReferences, ", "))
+	} else {
+		r.events.Eventf(r.src, corev1.EventTypeNormal, secretsv1alpha1.EventReasonReferencesFetched, "Fetched %d references", len(r.src.Spec.References))
+	}
+	return &DerivedSecretReconcilerRunStage2{DerivedSecretReconcilerRunStage1: r, cmRefs: cmRefs, sRefs: sRefs}, nil
+}
 
-	for _, refInfo := range r.src.Spec.References {
-		refName := refInfo.Name
-		if _, collided := refKeys[refName]; collided {
-			return nil, fmt.Errorf("Reference names must be unique, but %s appeared multiple times", refName)
-		}
-		if refInfo.ConfigMapRef != nil {
-			cm := corev1.ConfigMap{}
-			err := r.Get(r.ctx, client.ObjectKey{Namespace: r.src.Namespace, Name: refInfo.ConfigMapRef.Name}, &cm)
-			if client.IgnoreNotFound(err) != nil && refInfo.ConfigMapRef.Optional != nil && *refInfo.ConfigMapRef.Optional {
-				continue
-			}
-			if err != nil {
-				return nil, fmt.Errorf("While fetching reference %s: %s", refName, err)
+// readsReferencesAsServiceAccount returns true if all references should be read by impersonating the ServiceAccount
+func (r *DerivedSecretReconcilerRunStage1) readsReferencesAsServiceAccount() bool {
+	return r.RequireServiceAccountReferences || r.src.Spec.ReferenceAccess == secretsv1alpha1.ReferenceAccessServiceAccount
+}
+
+func (r *DerivedSecretReconcilerRunStage1) GetClientForReferences() (c client.Client, err error) {
+	end := r.startStage("GetClientForReferences")
+	defer func() { end(err) }()
+
+	if err := r.Namespaces.checkReferences(r.src.Namespace, r.src.Spec.References); err != nil {
+		return nil, err
+	}
+
+	if r.readsReferencesAsServiceAccount() {
+		r.logger.Info("Reading references with ServiceAccount privileges, using impersonation")
+		if r.src.Spec.ServiceAccountName == "" {
+			return nil, &stageError{
+				Condition: secretsv1alpha1.ConditionReferencesResolved,
+				Reason:    secretsv1alpha1.ReasonServiceAccountRequired,
+				Err:       fmt.Errorf("spec.serviceAccountName is required to read references with ServiceAccount privileges"),
 			}
-			cmRefs[refName] = cm
-			continue
 		}
-		if refInfo.SecretRef != nil {
-			s := corev1.Secret{}
-			err := r.Get(r.ctx, client.ObjectKey{Namespace: r.src.Namespace, Name: refInfo.SecretRef.Name}, &s)
-			if client.IgnoreNotFound(err) != nil && refInfo.SecretRef.Optional != nil && *refInfo.SecretRef.Optional {
-				continue
-			}
-			if err != nil {
-				return nil, fmt.Errorf("While fetching reference %s: %s", refName, err)
+	} else if !hasCrossNamespaceReferences(r.src.Namespace, r.src.Spec.References) {
+		return nil, nil
+	} else {
+		r.logger.Info("References include other namespaces, using impersonation")
+		if r.src.Spec.ServiceAccountName == "" {
+			return nil, &stageError{
+				Condition: secretsv1alpha1.ConditionReferencesResolved,
+				Reason:    secretsv1alpha1.ReasonServiceAccountRequired,
+				Err:       fmt.Errorf("spec.serviceAccountName is required when referencing a secret or configmap in another namespace"),
 			}
-			sRefs[refName] = s
-			continue
 		}
-		return nil, fmt.Errorf("Reference %s does not specify a source", refName)
 	}
-	return &DerivedSecretReconcilerRunStage2{DerivedSecretReconcilerRunStage1: r, cmRefs: cmRefs, sRefs: sRefs}, nil
+
+	c, err = r.ImpersonatingClients.Get(r.src.Namespace, r.src.Spec.ServiceAccountName)
+	return newTracingClient(c, r.getTracer()), impersonationError(secretsv1alpha1.ConditionReferencesResolved, err)
 }
 
-func (r *DerivedSecretReconcilerRunStage1) GetClientForSecret() (client.Client, error) {
+func (r *DerivedSecretReconcilerRunStage1) GetClientForSecret() (c client.Client, err error) {
 	targetNamespace := r.src.Spec.TargetNamespace
 	if targetNamespace == "" {
 		targetNamespace = r.src.Namespace
 	}
+	end := r.startStage("GetClientForSecret", attrTargetNamespace.String(targetNamespace))
+	defer func() { end(err) }()
 
+	if err := r.Namespaces.checkTarget(r.src.Namespace, targetNamespace); err != nil {
+		return nil, err
+	}
+	return r.clientForSecretNamespace(targetNamespace)
+}
+
+// clientForSecretNamespace returns the client to use for Secrets in a namespace, impersonating the ServiceAccount if it is not the DerivedSecret's namespace
+func (r *DerivedSecretReconcilerRunStage1) clientForSecretNamespace(targetNamespace string) (client.Client, error) {
 	if targetNamespace == r.src.Namespace {
 		return r.Client, nil
 	}
 
 	r.logger.Info("Target namespace is different than source, using impersonation", "targetNamespace", targetNamespace)
 	if r.src.Spec.ServiceAccountName == "" {
-		return nil, fmt.Errorf("spec.serviceAccountName is required when creating a secret in another namespace")
+		return nil, &stageError{
+			Condition: secretsv1alpha1.ConditionTargetSynced,
+			Reason:    secretsv1alpha1.ReasonServiceAccountRequired,
+			Err:       fmt.Errorf("spec.serviceAccountName is required when creating a secret in another namespace"),
+		}
 	}
 
-	clusterOpts := cluster.Options{
-		NewClient: cluster.DefaultNewClient,
-	}
-	impConfig := *r.RestConfig
-	impConfig.Impersonate = rest.ImpersonationConfig{
-		UserName: fmt.Sprintf("system:serviceaccount:%s:%s", r.src.Namespace, r.src.Spec.ServiceAccountName),
-	}
-	mapper := r.Manager.GetRESTMapper()
-	cache := r.Manager.GetCache()
-	clientOptions := client.Options{Scheme: clusterOpts.Scheme, Mapper: mapper}
+	c, err := r.ImpersonatingClients.Get(r.src.Namespace, r.src.Spec.ServiceAccountName)
+	return newTracingClient(c, r.getTracer()), impersonationError(secretsv1alpha1.ConditionTargetSynced, err)
+}
 
-	impClient, err := clusterOpts.NewClient(cache, &impConfig, clientOptions, clusterOpts.ClientDisableCacheFor...)
+func (r *DerivedSecretReconcilerRunStage2) CreateSecret(secretClient client.Client) (nextR *DerivedSecretReconcilerRunStage3, err error) {
+	end := r.startStage("CreateSecret")
+	defer func() { end(err) }()
+
+	current, err := currentSecret(r.ctx, secretClient, model.SecretTarget(r.src))
 	if err != nil {
-		return nil, err
+		return nil, targetError(err)
 	}
-	return impClient, nil
-}
 
-func (r *DerivedSecretReconcilerRunStage2) CreateSecret(secretClient client.Client) (nextR *DerivedSecretReconcilerRunStage3, err error) {
-	secretCopy, noOverwrite, err := model.GenerateSecret(r.cmRefs, r.sRefs, r.src)
+	renderStart := time.Now()
+	secretCopy, noOverwrite, accessed, err := model.GenerateSecret(r.cmRefs, r.sRefs, current, r.src)
+	derivedSecretRenderDuration.WithLabelValues(r.src.Namespace, r.src.Name).Observe(time.Since(renderStart).Seconds())
 	if err != nil {
-		return nil, err
+		r.src.Status.AccessedKeys = nil
+		r.fingerprints.Forget(client.ObjectKeyFromObject(r.src))
+		return nil, renderError(err)
 	}
+	r.src.Status.AccessedKeys = accessed
+	r.fingerprints.Record(r.src, r.sRefs, accessed)
+	derivedSecretMetrics.ObserveOutputKeys(r.src, len(secretCopy.Data)+len(secretCopy.StringData))
+	r.conditions.Succeeded(secretsv1alpha1.ConditionRendered)
 	r.logger.Info("Secret generated")
 
 	if secretCopy.Namespace == r.src.Namespace {
 		err = ctrl.SetControllerReference(r.src, &secretCopy, r.Scheme)
 		if err != nil {
-			return nil, err
+			return nil, targetError(err)
 		}
 		r.logger.Info("Secret controller set")
 	}
 
-	secret := secretCopy.DeepCopy()
-
-	_, err = ctrl.CreateOrUpdate(r.ctx, secretClient, secret, func() error {
-		secret.Type = secretCopy.Type
-		if secret.Data == nil {
-			secret.Data = make(map[string][]byte)
-		}
-		for key, val := range secretCopy.Data {
-			if _, skip := noOverwrite[key]; skip {
-				continue
-			}
-			secret.Data[key] = val
-		}
-		if secret.StringData == nil {
-			secret.StringData = make(map[string]string)
-		}
-		for key, val := range secretCopy.StringData {
-			if _, skip := noOverwrite[key]; skip {
-				continue
-			}
-			secret.StringData[key] = val
-		}
-		if secret.Labels == nil {
-			secret.Labels = make(map[string]string)
-		}
-		for key, value := range secretCopy.Labels {
-			secret.Labels[key] = value
-		}
-		return nil
-	})
+	secret, result, err := applySecret(r.ctx, secretClient, r.src, current, &secretCopy, noOverwrite)
 	if err != nil {
-		return nil, err
+		return nil, targetError(err)
 	}
+	r.logger.Info("Secret applied", "result", result)
+	switch result {
+	case controllerutil.OperationResultCreated:
+		r.events.Eventf(r.src, corev1.EventTypeNormal, secretsv1alpha1.EventReasonCreated, "Created Secret %s/%s", secret.Namespace, secret.Name)
+	case controllerutil.OperationResultUpdated:
+		r.events.Eventf(r.src, corev1.EventTypeNormal, secretsv1alpha1.EventReasonUpdated, "Updated Secret %s/%s", secret.Namespace, secret.Name)
+	default:
+		r.events.Eventf(r.src, corev1.EventTypeNormal, secretsv1alpha1.EventReasonUnchanged, "Secret %s/%s is up to date", secret.Namespace, secret.Name)
+	}
+	trace.SpanFromContext(r.ctx).SetAttributes(attrTargetNamespace.String(secret.Namespace), attrTargetName.String(secret.Name))
+	r.conditions.Succeeded(secretsv1alpha1.ConditionTargetSynced)
 	r.src.Status.SecretName = secret.Name
 	r.src.Status.SecretNamespace = secret.Namespace
 	return &DerivedSecretReconcilerRunStage3{DerivedSecretReconcilerRunStage2: r, secret: secret}, nil
 }
 
-func (r *DerivedSecretReconcilerRunStage3) CleanOtherOwnedSecrets(secretClient client.Client) error {
-	otherSecrets := corev1.SecretList{}
-	err := secretClient.List(
-		r.ctx,
-		&otherSecrets,
-		client.MatchingFields(map[string]string{
-			secretDerivedFromKey: DerivedFromFieldValueFromObject(r.src),
-		}),
-	)
-	if err != nil {
-		// Technically not stopping us from continuing
-		r.logger.Info("Failed to list other secrets owned by this DerivedSecret, previous secrets may still exist", "error", err)
-	} else {
-		for _, secret := range otherSecrets.Items {
-			if secret.Name == r.secret.Name && secret.Namespace == r.secret.Namespace {
-				continue
-			}
-			err = secretClient.Delete(r.ctx, &secret)
-			if err != nil {
-				// Also technically not stopping us
-				r.logger.Info("Failed to delete previously derived secrets", "error", err)
-			}
+// CleanInventory deletes every Secret in the inventory other than the one just written, and replaces the inventory.
+// Secrets which could not be deleted are kept in the inventory, so that they are retried on the next reconcile
+func (r *DerivedSecretReconcilerRunStage3) CleanInventory() (err error) {
+	end := r.startStage("CleanInventory")
+	defer func() { end(err) }()
+
+	inventory := []secretsv1alpha1.DerivedObjectReference{{
+		Namespace: r.secret.Namespace,
+		Name:      r.secret.Name,
+		UID:       r.secret.UID,
+	}}
+	for _, ref := range r.previousInventory() {
+		if ref.Namespace == r.secret.Namespace && ref.Name == r.secret.Name {
+			continue
+		}
+		err := r.releaseSecret(ref, secretsv1alpha1.DeletionPolicyDelete)
+		if err != nil {
+			// Technically not stopping us from continuing
+			r.logger.Info("Failed to delete previously derived secret, will retry", "secretNamespace", ref.Namespace, "secretName", ref.Name, "error", err)
+			r.events.Eventf(r.src, corev1.EventTypeWarning, secretsv1alpha1.EventReasonCleanupFailed, "Failed to delete previously derived Secret %s/%s, will retry: %s", ref.Namespace, ref.Name, redactedErrorMessage(err))
+			inventory = append(inventory, ref)
+			continue
 		}
+		r.logger.Info("Deleted previously derived secret", "secretNamespace", ref.Namespace, "secretName", ref.Name)
+		r.events.Eventf(r.src, corev1.EventTypeNormal, secretsv1alpha1.EventReasonCleanedUp, "Deleted previously derived Secret %s/%s", ref.Namespace, ref.Name)
 	}
+	r.src.Status.Inventory = inventory
 	return nil
 }
 
+// previousInventory returns the Secrets written by previous reconciles.
+// DerivedSecrets which were last reconciled before the inventory existed only have their last Secret recorded
+func (r *DerivedSecretReconcilerRunStage1) previousInventory() []secretsv1alpha1.DerivedObjectReference {
+	if len(r.src.Status.Inventory) != 0 || r.src.Status.SecretName == "" {
+		return r.src.Status.Inventory
+	}
+	return []secretsv1alpha1.DerivedObjectReference{{
+		Namespace: r.src.Status.SecretNamespace,
+		Name:      r.src.Status.SecretName,
+	}}
+}
+
+// releaseSecret applies a deletion policy to a Secret in the inventory
+func (r *DerivedSecretReconcilerRunStage1) releaseSecret(ref secretsv1alpha1.DerivedObjectReference, policy secretsv1alpha1.DeletionPolicy) error {
+	secretClient, err := r.clientForSecretNamespace(ref.Namespace)
+	if err != nil {
+		return err
+	}
+	secret := corev1.Secret{}
+	secret.Name = ref.Name
+	secret.Namespace = ref.Namespace
+	return releaseDerived(r.ctx, secretClient, r.src, &secret, ref.UID, policy)
+}
+
+// releaseAbandoned returns true if an error applying the deletion policy to a Secret will not be fixed by retrying
+func releaseAbandoned(err error) bool {
+	return apierrors.IsNotFound(err) || apierrors.IsForbidden(err)
+}
+
+// EnsureFinalizer adds the cleanup finalizer, if it is not already present
+func (r *DerivedSecretReconcilerRunStage1) EnsureFinalizer() error {
+	if controllerutil.ContainsFinalizer(r.src, secretsv1alpha1.CleanupFinalizer) {
+		return nil
+	}
+	controllerutil.AddFinalizer(r.src, secretsv1alpha1.CleanupFinalizer)
+	return r.Update(r.ctx, r.src)
+}
+
+// Finalize applies the deletion policy to every Secret in the inventory, then removes the cleanup finalizer
+func (r *DerivedSecretReconcilerRunStage1) Finalize() (err error) {
+	if !controllerutil.ContainsFinalizer(r.src, secretsv1alpha1.CleanupFinalizer) {
+		return nil
+	}
+	end := r.startStage("Finalize")
+	defer func() { end(err) }()
+
+	policy := r.src.Spec.DeletionPolicy
+	if policy == "" {
+		policy = secretsv1alpha1.DefaultDeletionPolicy
+	}
+
+	for _, ref := range r.previousInventory() {
+		err := r.releaseSecret(ref, policy)
+		if releaseAbandoned(err) {
+			// Retrying would block deletion forever, such as when the namespace is being deleted,
+			// and the ServiceAccount or its RoleBindings were deleted first
+			r.logger.Info("Deletion policy cannot be applied, abandoning secret", "policy", policy, "secretNamespace", ref.Namespace, "secretName", ref.Name, "error", err)
+			r.events.Eventf(r.src, corev1.EventTypeWarning, secretsv1alpha1.EventReasonReleaseAbandoned, "Could not apply deletion policy %s to Secret %s/%s, leaving it as is: %s", policy, ref.Namespace, ref.Name, redactedErrorMessage(err))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		r.logger.Info("Deletion policy applied", "policy", policy, "secretNamespace", ref.Namespace, "secretName", ref.Name)
+	}
+
+	controllerutil.RemoveFinalizer(r.src, secretsv1alpha1.CleanupFinalizer)
+	err = r.Update(r.ctx, r.src)
+	if err == nil {
+		r.events.Forget(r.src)
+		derivedSecretMetrics.Forget(types.NamespacedName{Namespace: r.src.Namespace, Name: r.src.Name})
+		r.fingerprints.Forget(types.NamespacedName{Namespace: r.src.Namespace, Name: r.src.Name})
+	}
+	return err
+}
+
 func (r *DerivedSecretReconcilerRunStage1) SyncStatus(err error) error {
 	if err == nil {
 		now := metav1.Now()
 		r.src.Status.Error = ""
 		r.src.Status.LastSync = &now
 	} else {
-		r.src.Status.Error = err.Error()
+		r.src.Status.Error = redactedErrorMessage(err)
+		r.events.Warning(r.src, err)
 	}
+	r.src.Status.ObservedGeneration = r.src.Generation
+	r.conditions.Apply(&r.src.Status.Conditions, err)
 	uperr := r.Status().Update(r.ctx, r.src)
 	if uperr != nil {
 		return uperr
@@ -281,14 +404,36 @@ func DerivedFromFieldValueFromLabels(labels map[string]string) (string, bool) {
 //+kubebuilder:rbac:groups=secrets.meln5674.github.com,resources=derivedsecrets/finalizers,verbs=update
 //+kubebuilder:rbac:groups=core,resources=secrets,verbs=*
 //+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
 func (r *DerivedSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
 	logger := log.FromContext(ctx).WithValues("request", req)
 
+	// Continue the traces of the watch events which queued this request, if any.
+	// The span ends with the error from the reconcile, or, if one is recorded in the status, that error,
+	// as permanent errors are not returned
+	ctx, startOptions := continueTraces(ctx, r.traces.Take(req.NamespacedName))
+	ctx, span := r.getTracer().Start(ctx, "Reconcile DerivedSecret", append(startOptions, trace.WithAttributes(
+		attrDerivedSecretNamespace.String(req.Namespace),
+		attrDerivedSecretName.String(req.Name),
+	))...)
+	var spanErr error
+	defer func() {
+		if spanErr == nil {
+			spanErr = err
+		}
+		endSpan(span, spanErr)
+	}()
+
 	logger.Info("Got request")
 
+	if !r.Namespaces.Watches(req.Namespace) {
+		logger.Info("Namespace is not watched, ignoring")
+		return ctrl.Result{}, nil
+	}
+
 	src := secretsv1alpha1.DerivedSecret{}
 
 	err = r.Get(ctx, req.NamespacedName, &src)
@@ -298,27 +443,48 @@ func (r *DerivedSecretReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 	}
 
 	if err != nil {
-		// TODO: Finalizers?
 		logger.Info("Got not found, assuming deleted", "error", err)
+		derivedSecretMetrics.Forget(req.NamespacedName)
+		r.fingerprints.Forget(req.NamespacedName)
 		return ctrl.Result{}, nil
 	}
+
+	r1 := DerivedSecretReconcilerRunStage1{
+		DerivedSecretReconciler: r,
+		ctx:                     ctx,
+		src:                     &src,
+		logger:                  logger,
+		conditions: newStageConditions(
+			src.Generation,
+			secretsv1alpha1.ConditionReferencesResolved,
+			secretsv1alpha1.ConditionRendered,
+			secretsv1alpha1.ConditionTargetSynced,
+		),
+	}
+
+	if !src.DeletionTimestamp.IsZero() {
+		logger.Info("Being deleted, applying deletion policy")
+		return ctrl.Result{}, r1.Finalize()
+	}
+
+	err = r1.EnsureFinalizer()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	span.SetAttributes(attrReferences.Int(len(src.Spec.References)))
+
 	now := metav1.Now()
 	src.Status.LastSyncAttempt = &now
 
-	r1 := DerivedSecretReconcilerRunStage1{DerivedSecretReconciler: r, ctx: ctx, src: &src, logger: logger}
-
 	// After this, any error will be captured in the .status.error field (assuming the Update() call succeeds)
 	// or it will be cleared if no error is returned
-	// As well, we retry any error after 5 seconds (Configurable?),
-	// and any successful reconcilation does not requeue, as we will be triggered by updates
+	// As well, we retry transient errors with exponential backoff, while permanent errors (e.g. an invalid template)
+	// and successful reconcilations only requeue after spec.resyncInterval, if set, as we will be triggered by updates
 	defer func() {
-		uperr := r1.SyncStatus(err)
-		if err != nil || uperr == nil {
-			result = ctrl.Result{Requeue: true, RequeueAfter: 5 * time.Second}
-		} else {
-			result = ctrl.Result{}
-		}
-		err = uperr
+		err = r1.SyncStatus(err)
+		spanErr = err
+		recordDerivedSecretReconcile(&src, err)
+		result, err = reconcileResult(logger, err, r.resyncInterval(&src))
 	}()
 
 	secretClient, err := r1.GetClientForSecret()
@@ -326,7 +492,12 @@ func (r *DerivedSecretReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		return
 	}
 
-	r2, err := r1.FetchReferences()
+	referenceClient, err := r1.GetClientForReferences()
+	if err != nil {
+		return
+	}
+
+	r2, err := r1.FetchReferences(referenceClient)
 	if err != nil {
 		return
 	}
@@ -336,9 +507,7 @@ func (r *DerivedSecretReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 	if err != nil {
 		return
 	}
-	logger.Info("Secret created/updated", "result", result)
-
-	err = r3.CleanOtherOwnedSecrets(secretClient)
+	err = r3.CleanInventory()
 	if err != nil {
 		return
 	}
@@ -347,42 +516,108 @@ func (r *DerivedSecretReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 	return
 }
 
+// getTracer returns the tracer of the reconciler, which is set up with the manager, or a tracer from the TracerProvider if not
+func (r *DerivedSecretReconciler) getTracer() trace.Tracer {
+	if r.tracer != nil {
+		return r.tracer
+	}
+	return tracerFor(r.TracerProvider)
+}
+
+// instrument traces the reconciler's API calls, and the watch events which queue requests
+func (r *DerivedSecretReconciler) instrument() {
+	r.tracer = tracerFor(r.TracerProvider)
+	r.traces = newPendingTraces()
+	r.Client = newTracingClient(r.Client, r.tracer)
+}
+
+// startStage starts the span of a stage of the reconcile, which is the parent of API calls made during the stage.
+// The returned function ends the span with the outcome of the stage
+func (r *DerivedSecretReconcilerRunStage1) startStage(name string, attrs ...attribute.KeyValue) func(error) {
+	parent := r.ctx
+	ctx, span := r.getTracer().Start(parent, name, trace.WithAttributes(attrs...))
+	r.ctx = ctx
+	return func(err error) {
+		r.ctx = parent
+		endSpan(span, err)
+	}
+}
+
+// resyncInterval returns how often to regenerate the Secret of a DerivedSecret
+func (r *DerivedSecretReconciler) resyncInterval(src *secretsv1alpha1.DerivedSecret) *metav1.Duration {
+	if src.Spec.ResyncInterval != nil {
+		return src.Spec.ResyncInterval
+	}
+	return r.DefaultResyncInterval
+}
+
+// derivedSecretReferences extracts the references of a DerivedSecret for the reference indexes
+func derivedSecretReferences(obj client.Object) (string, []secretsv1alpha1.SensitiveReference) {
+	derivedSecret := obj.(*secretsv1alpha1.DerivedSecret)
+	return derivedSecret.Namespace, derivedSecret.Spec.References
+}
+
 type DerivedSecretWatcher struct {
 	Reconciler *DerivedSecretReconciler
 }
 
-func (w *DerivedSecretWatcher) QueueReferencingDerivedSecrets(kind string, obj client.Object, q workqueue.RateLimitingInterface) {
-	logger := log.FromContext(context.TODO()).WithValues("namespace", obj.GetNamespace(), kind, obj.GetName())
-	var key string
-	switch kind {
-	case "Secret":
-		key = referencedSecretsKey
-	case "ConfigMap":
-		key = referencedConfigMapsKey
-	default:
-		return
+// ReferencingDerivedSecrets returns a request for each DerivedSecret which references a Secret or ConfigMap
+func (w *DerivedSecretWatcher) ReferencingDerivedSecrets(kind string, obj client.Object) ([]reconcile.Request, error) {
+	referees, err := w.referencingDerivedSecrets(kind, obj)
+	if err != nil {
+		return nil, err
 	}
+	return requestsFor(referees), nil
+}
 
-	derivedSecrets := secretsv1alpha1.DerivedSecretList{}
-	err := w.Reconciler.List(
-		context.TODO(),
-		&derivedSecrets,
-		client.MatchingFields(map[string]string{key: obj.GetName()}),
-	)
+func (w *DerivedSecretWatcher) referencingDerivedSecrets(kind string, obj client.Object) ([]client.Object, error) {
+	key, ok := referenceKeyForKind(kind)
+	if !ok {
+		return nil, nil
+	}
+	return listReferencing(context.TODO(), w.Reconciler, &secretsv1alpha1.DerivedSecretList{}, key, referenceIndexValue(obj.GetNamespace(), obj.GetName()))
+}
+
+// QueueReferencingDerivedSecrets queues each DerivedSecret which references an object that an event occurred for.
+// If changed is not nil, only DerivedSecrets for which it returns true are queued.
+// Events which queue requests start a trace, which is continued by the reconciles they queue
+func (w *DerivedSecretWatcher) QueueReferencingDerivedSecrets(eventType, kind string, obj client.Object, changed func(*secretsv1alpha1.DerivedSecret) bool, q workqueue.RateLimitingInterface) {
+	logger := log.FromContext(context.TODO()).WithValues("namespace", obj.GetNamespace(), kind, obj.GetName())
+	referees, err := w.referencingDerivedSecrets(kind, obj)
 	if err != nil {
 		logger.Info("Failed to find DerivedSecretes which have reference", "error", err)
 		return
 	}
 
-	if len(derivedSecrets.Items) == 0 {
+	if changed != nil {
+		filtered := make([]client.Object, 0, len(referees))
+		for _, referee := range referees {
+			if !changed(referee.(*secretsv1alpha1.DerivedSecret)) {
+				logger.V(1).Info("No accessed keys changed, not queuing referee", "referee", referee)
+				continue
+			}
+			filtered = append(filtered, referee)
+		}
+		referees = filtered
+	}
+
+	requests := requestsFor(referees)
+	if len(requests) == 0 {
 		return
 	}
-	logger.Info("Queuing referees", "referees", derivedSecrets.Items)
-	for _, item := range derivedSecrets.Items {
-		q.AddRateLimited(ctrl.Request{NamespacedName: types.NamespacedName{
-			Namespace: item.Namespace,
-			Name:      item.Name,
-		}})
+	_, span := w.Reconciler.getTracer().Start(context.TODO(), "Watch "+kind, trace.WithAttributes(
+		attrEvent.String(eventType),
+		attrKind.String(kind),
+		attrNamespace.String(obj.GetNamespace()),
+		attrName.String(obj.GetName()),
+		attrReferees.Int(len(requests)),
+	))
+	defer span.End()
+
+	logger.Info("Queuing referees", "referees", requests)
+	for _, request := range requests {
+		w.Reconciler.traces.Add(request.NamespacedName, span.SpanContext())
+		q.AddRateLimited(request)
 	}
 }
 
@@ -394,24 +629,41 @@ var (
 	_ = handler.EventHandler(&DerivedSecretSecretWatcher{})
 )
 
-func (w *DerivedSecretSecretWatcher) QueueSecretReferencingDerivedSecrets(secret client.Object, q workqueue.RateLimitingInterface) {
-	w.QueueReferencingDerivedSecrets("Secret", secret, q)
+func (w *DerivedSecretSecretWatcher) QueueSecretReferencingDerivedSecrets(eventType string, secret client.Object, changed func(*secretsv1alpha1.DerivedSecret) bool, q workqueue.RateLimitingInterface) {
+	w.QueueReferencingDerivedSecrets(eventType, "Secret", secret, changed, q)
 }
 
 func (w *DerivedSecretSecretWatcher) Create(e event.CreateEvent, q workqueue.RateLimitingInterface) {
-	w.QueueSecretReferencingDerivedSecrets(e.Object, q)
+	w.QueueSecretReferencingDerivedSecrets("create", e.Object, nil, q)
 }
 
+// Update queues the DerivedSecrets which used any keys of the Secret that have changed since they were last rendered.
+// Only the metadata of Secrets is cached, so the Secret is read at most once, and only if a DerivedSecret needs to compare against it
 func (w *DerivedSecretSecretWatcher) Update(e event.UpdateEvent, q workqueue.RateLimitingInterface) {
-	w.QueueSecretReferencingDerivedSecrets(e.ObjectOld, q)
+	var secret *corev1.Secret
+	var getErr error
+	changed := func(derivedSecret *secretsv1alpha1.DerivedSecret) bool {
+		if !renderedCurrentSpec(derivedSecret) {
+			return true
+		}
+		if secret == nil && getErr == nil {
+			secret = &corev1.Secret{}
+			getErr = w.Reconciler.Get(context.TODO(), client.ObjectKeyFromObject(e.ObjectNew), secret)
+		}
+		if getErr != nil {
+			return true
+		}
+		return !w.Reconciler.fingerprints.Unchanged(client.ObjectKeyFromObject(derivedSecret), secret)
+	}
+	w.QueueSecretReferencingDerivedSecrets("update", e.ObjectNew, changed, q)
 }
 
 func (w *DerivedSecretSecretWatcher) Delete(e event.DeleteEvent, q workqueue.RateLimitingInterface) {
-	w.QueueSecretReferencingDerivedSecrets(e.Object, q)
+	w.QueueSecretReferencingDerivedSecrets("delete", e.Object, nil, q)
 }
 
 func (w *DerivedSecretSecretWatcher) Generic(e event.GenericEvent, q workqueue.RateLimitingInterface) {
-	w.QueueSecretReferencingDerivedSecrets(e.Object, q)
+	w.QueueSecretReferencingDerivedSecrets("generic", e.Object, nil, q)
 }
 
 type DerivedSecretConfigMapWatcher struct {
@@ -422,89 +674,54 @@ var (
 	_ = handler.EventHandler(&DerivedSecretConfigMapWatcher{})
 )
 
-func (w *DerivedSecretConfigMapWatcher) QueueConfigMapReferencingDerivedSecrets(configMap client.Object, q workqueue.RateLimitingInterface) {
-	w.DerivedSecretWatcher.QueueReferencingDerivedSecrets("ConfigMap", configMap, q)
+func (w *DerivedSecretConfigMapWatcher) QueueConfigMapReferencingDerivedSecrets(eventType string, configMap client.Object, changed func(*secretsv1alpha1.DerivedSecret) bool, q workqueue.RateLimitingInterface) {
+	w.DerivedSecretWatcher.QueueReferencingDerivedSecrets(eventType, "ConfigMap", configMap, changed, q)
 }
 
 func (w *DerivedSecretConfigMapWatcher) Create(e event.CreateEvent, q workqueue.RateLimitingInterface) {
-	w.QueueConfigMapReferencingDerivedSecrets(e.Object, q)
+	w.QueueConfigMapReferencingDerivedSecrets("create", e.Object, nil, q)
 }
 
+// Update queues the DerivedSecrets which used any keys of the ConfigMap that the update changed
 func (w *DerivedSecretConfigMapWatcher) Update(e event.UpdateEvent, q workqueue.RateLimitingInterface) {
-	w.QueueConfigMapReferencingDerivedSecrets(e.ObjectOld, q)
+	oldData := referenceData(e.ObjectOld)
+	newData := referenceData(e.ObjectNew)
+	changed := func(derivedSecret *secretsv1alpha1.DerivedSecret) bool {
+		if !renderedCurrentSpec(derivedSecret) {
+			return true
+		}
+		used := referencedKeys(derivedSecret.Namespace, derivedSecret.Spec.References, derivedSecret.Status.AccessedKeys, "ConfigMap", e.ObjectNew)
+		return used.changed(oldData, newData)
+	}
+	w.QueueConfigMapReferencingDerivedSecrets("update", e.ObjectNew, changed, q)
 }
 
 func (w *DerivedSecretConfigMapWatcher) Delete(e event.DeleteEvent, q workqueue.RateLimitingInterface) {
-	w.QueueConfigMapReferencingDerivedSecrets(e.Object, q)
+	w.QueueConfigMapReferencingDerivedSecrets("delete", e.Object, nil, q)
 }
 
 func (w *DerivedSecretConfigMapWatcher) Generic(e event.GenericEvent, q workqueue.RateLimitingInterface) {
-	w.QueueConfigMapReferencingDerivedSecrets(e.Object, q)
+	w.QueueConfigMapReferencingDerivedSecrets("generic", e.Object, nil, q)
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *DerivedSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
 
-	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Secret{}, secretDerivedFromKey, func(rawObj client.Object) []string {
-		// grab the job object, extract the owner...
-		secret := rawObj.(*corev1.Secret)
-		owner := metav1.GetControllerOf(secret)
-		var ownerStr string
-		if owner == nil {
-			var ok bool
-
-			ownerStr, ok = DerivedFromFieldValueFromLabels(secret.Labels)
-			if !ok {
-				return nil
-			}
-		} else {
-			// ...make sure it's a CronJob...
-			if owner.APIVersion != secretsv1alpha1.GroupVersion.String() || owner.Kind != "DerivedSecret" {
-				return nil
-			}
-			ownerStr = fmt.Sprintf("%s/%s/%s", owner.Kind, secret.Namespace, owner.Name)
-		}
-		// ...and if so, return it
-		return []string{ownerStr}
-	}); err != nil {
-		return err
-	}
-
-	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &secretsv1alpha1.DerivedSecret{}, referencedSecretsKey, func(rawObj client.Object) []string {
-		// grab the job object, extract the owner...
-		derivedSecret := rawObj.(*secretsv1alpha1.DerivedSecret)
-		references := make([]string, 0, len(derivedSecret.Spec.References))
-		for _, ref := range derivedSecret.Spec.References {
-			if ref.SecretRef != nil {
-				references = append(references, ref.SecretRef.Name)
-			}
-		}
-
-		return references
-	}); err != nil {
+	if err := indexReferences(context.Background(), mgr.GetFieldIndexer(), &secretsv1alpha1.DerivedSecret{}, derivedSecretReferences); err != nil {
 		return err
 	}
 
-	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &secretsv1alpha1.DerivedSecret{}, referencedConfigMapsKey, func(rawObj client.Object) []string {
-		// grab the job object, extract the owner...
-		derivedSecret := rawObj.(*secretsv1alpha1.DerivedSecret)
-		references := make([]string, 0, len(derivedSecret.Spec.References))
-		for _, ref := range derivedSecret.Spec.References {
-			if ref.ConfigMapRef != nil {
-				references = append(references, ref.ConfigMapRef.Name)
-			}
-		}
-
-		return references
-	}); err != nil {
-		return err
-	}
+	r.events = newEventRecorder(r.Recorder, repeatedEventInterval)
+	r.fingerprints = newReferenceFingerprints()
+	r.instrument()
 
 	watcher := DerivedSecretWatcher{Reconciler: r}
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&secretsv1alpha1.DerivedSecret{}).
-		Owns(&corev1.Secret{}).
-		Watches(&source.Kind{Type: &corev1.Secret{}}, &DerivedSecretSecretWatcher{DerivedSecretWatcher: watcher}).
+		WithOptions(r.ControllerOptions).
+		For(&secretsv1alpha1.DerivedSecret{}, builder.WithPredicates(specChangedPredicate, r.Namespaces.Predicate())).
+		// Only the metadata of Secrets is cached, their contents are read live, see UncachedObjects
+		Owns(&corev1.Secret{}, builder.OnlyMetadata).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, &DerivedSecretSecretWatcher{DerivedSecretWatcher: watcher}, builder.OnlyMetadata).
 		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, &DerivedSecretConfigMapWatcher{DerivedSecretWatcher: watcher}).
 		Complete(r)
 }
@@ -0,0 +1,87 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+	"github.com/meln5674/secrets-operator/model"
+)
+
+// DerivedSecretValidator rejects DerivedSecrets which would always fail to reconcile
+type DerivedSecretValidator struct {
+	// RequireServiceAccountReferences matches the reconciler option of the same name,
+	// and rejects DerivedSecrets without a ServiceAccount to read references with
+	RequireServiceAccountReferences bool
+}
+
+var (
+	_ = admission.CustomValidator(&DerivedSecretValidator{})
+)
+
+//+kubebuilder:webhook:path=/validate-secrets-meln5674-github-com-v1alpha1-derivedsecret,mutating=false,failurePolicy=fail,sideEffects=None,groups=secrets.meln5674.github.com,resources=derivedsecrets,verbs=create;update,versions=v1alpha1,name=vderivedsecret.secrets.meln5674.github.com,admissionReviewVersions=v1
+
+func (v *DerivedSecretValidator) validate(obj runtime.Object) error {
+	src, ok := obj.(*secretsv1alpha1.DerivedSecret)
+	if !ok {
+		return fmt.Errorf("Expected a DerivedSecret, got %T", obj)
+	}
+	errs := model.ValidateDerivedSecret(src)
+	if v.RequireServiceAccountReferences && src.Spec.ServiceAccountName == "" {
+		errs = append(errs, field.Required(field.NewPath("spec", "serviceAccountName"), "required to read references, as the operator reads all references by impersonating a ServiceAccount"))
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(secretsv1alpha1.GroupVersion.WithKind("DerivedSecret").GroupKind(), src.Name, errs)
+}
+
+func (v *DerivedSecretValidator) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	return v.validate(obj)
+}
+
+func (v *DerivedSecretValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
+	oldSrc, oldOk := oldObj.(*secretsv1alpha1.DerivedSecret)
+	newSrc, newOk := newObj.(*secretsv1alpha1.DerivedSecret)
+	// Updates which leave the spec alone, such as adding or removing the finalizer, must not be blocked by a spec which was valid when it was created
+	if oldOk && newOk && (!newSrc.DeletionTimestamp.IsZero() || equality.Semantic.DeepEqual(oldSrc.Spec, newSrc.Spec)) {
+		return nil
+	}
+	return v.validate(newObj)
+}
+
+func (v *DerivedSecretValidator) ValidateDelete(ctx context.Context, obj runtime.Object) error {
+	return nil
+}
+
+// SetupWebhookWithManager registers the validating webhook with the Manager.
+func (v *DerivedSecretValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&secretsv1alpha1.DerivedSecret{}).
+		WithValidator(v).
+		Complete()
+}
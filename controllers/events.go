@@ -0,0 +1,105 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+// repeatedEventInterval is how long an Event is suppressed after an identical Event for the same object
+const repeatedEventInterval = 5 * time.Minute
+
+type recordedEvent struct {
+	message string
+	time    time.Time
+}
+
+// eventRecorder emits Events, suppressing Events which are identical to one recently emitted for the same object,
+// so that a resource which fails the same way on every retry does not flood its namespace with Events
+type eventRecorder struct {
+	recorder record.EventRecorder
+	interval time.Duration
+
+	lock sync.Mutex
+	// recent is the last Event of each type and reason for each object
+	recent map[types.UID]map[string]recordedEvent
+}
+
+func newEventRecorder(recorder record.EventRecorder, interval time.Duration) *eventRecorder {
+	return &eventRecorder{recorder: recorder, interval: interval, recent: make(map[types.UID]map[string]recordedEvent)}
+}
+
+// Event emits an Event for an object, unless an identical one was emitted within the interval.
+// Messages must never contain the contents of Secrets or ConfigMaps
+func (e *eventRecorder) Event(obj client.Object, eventType, reason, message string) {
+	if e == nil || e.recorder == nil {
+		return
+	}
+	key := eventType + "/" + reason
+	now := time.Now()
+
+	e.lock.Lock()
+	recent, ok := e.recent[obj.GetUID()]
+	if !ok {
+		recent = make(map[string]recordedEvent)
+		e.recent[obj.GetUID()] = recent
+	}
+	last, ok := recent[key]
+	if ok && last.message == message && now.Sub(last.time) < e.interval {
+		e.lock.Unlock()
+		return
+	}
+	recent[key] = recordedEvent{message: message, time: now}
+	e.lock.Unlock()
+
+	e.recorder.Event(obj, eventType, reason, message)
+}
+
+func (e *eventRecorder) Eventf(obj client.Object, eventType, reason, format string, args ...interface{}) {
+	e.Event(obj, eventType, reason, fmt.Sprintf(format, args...))
+}
+
+// Warning emits a Warning Event for a failed reconcile, using the reason of the condition that failed
+func (e *eventRecorder) Warning(obj client.Object, err error) {
+	reason := secretsv1alpha1.ReasonFailed
+	var stageErr *stageError
+	if errors.As(err, &stageErr) {
+		reason = stageErr.Reason
+	}
+	e.Event(obj, corev1.EventTypeWarning, reason, redactedErrorMessage(err))
+}
+
+// Forget discards the recent Events of an object which no longer exists
+func (e *eventRecorder) Forget(obj client.Object) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	delete(e.recent, obj.GetUID())
+}
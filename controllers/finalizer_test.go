@@ -0,0 +1,131 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+// forbiddenSecretsClient forbids every access to Secrets, as happens when the ServiceAccount a Secret is released with,
+// or its RoleBindings, are deleted along with its namespace
+type forbiddenSecretsClient struct {
+	*indexedClient
+}
+
+func (c *forbiddenSecretsClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if _, ok := obj.(*corev1.Secret); ok {
+		return apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, key.Name, nil)
+	}
+	return c.indexedClient.Get(ctx, key, obj)
+}
+
+func TestFinalizeAbandonsForbiddenSecrets(t *testing.T) {
+	derivedSecret := &secretsv1alpha1.DerivedSecret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:  "app-ns",
+			Name:       "app",
+			Finalizers: []string{secretsv1alpha1.CleanupFinalizer},
+		},
+		Status: secretsv1alpha1.DerivedSecretStatus{
+			Inventory: []secretsv1alpha1.DerivedObjectReference{{Namespace: "app-ns", Name: "app"}},
+		},
+	}
+	c := &forbiddenSecretsClient{indexedClient: newIndexedClient(t, derivedSecret)}
+	r := &DerivedSecretReconciler{Client: c, Scheme: c.Scheme()}
+	r.instrument()
+
+	ctx := context.Background()
+	if err := r.Delete(ctx, derivedSecret); err != nil {
+		t.Fatal(err)
+	}
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "app-ns", Name: "app"}}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("Expected a Secret which cannot be released to be abandoned, got %s", err)
+	}
+	if err := r.Get(ctx, req.NamespacedName, derivedSecret); !apierrors.IsNotFound(err) {
+		t.Fatalf("Expected the finalizer to be removed so the DerivedSecret is deleted, got %v", err)
+	}
+}
+
+func TestDerivedConfigMapFinalizeAppliesDeletionPolicy(t *testing.T) {
+	for _, policy := range []secretsv1alpha1.DeletionPolicy{secretsv1alpha1.DeletionPolicyDelete, secretsv1alpha1.DeletionPolicyOrphan} {
+		t.Run(string(policy), func(t *testing.T) {
+			template := "bar"
+			derivedConfigMap := &secretsv1alpha1.DerivedConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "app-ns", Name: "app"},
+				Spec: secretsv1alpha1.DerivedConfigMapSpec{
+					DeletionPolicy: policy,
+					Data: map[string]secretsv1alpha1.StringTarget{
+						"foo": {TargetBase: secretsv1alpha1.TargetBase{Template: &template}},
+					},
+				},
+			}
+			c := newIndexedClient(t, derivedConfigMap)
+			r := &DerivedConfigMapReconciler{Client: c, Scheme: c.Scheme()}
+
+			ctx := context.Background()
+			req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "app-ns", Name: "app"}}
+			if _, err := r.Reconcile(ctx, req); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Get(ctx, req.NamespacedName, derivedConfigMap); err != nil {
+				t.Fatal(err)
+			}
+			if len(derivedConfigMap.Finalizers) != 1 || derivedConfigMap.Finalizers[0] != secretsv1alpha1.CleanupFinalizer {
+				t.Fatalf("Expected the cleanup finalizer to be added, got %v", derivedConfigMap.Finalizers)
+			}
+
+			if err := r.Delete(ctx, derivedConfigMap); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.Reconcile(ctx, req); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Get(ctx, req.NamespacedName, derivedConfigMap); !apierrors.IsNotFound(err) {
+				t.Fatalf("Expected the finalizer to be removed so the DerivedConfigMap is deleted, got %v", err)
+			}
+
+			configMap := corev1.ConfigMap{}
+			err := r.Get(ctx, client.ObjectKey{Namespace: "app-ns", Name: "app"}, &configMap)
+			switch policy {
+			case secretsv1alpha1.DeletionPolicyDelete:
+				if !apierrors.IsNotFound(err) {
+					t.Fatalf("Expected the ConfigMap to be deleted, got %v", err)
+				}
+			case secretsv1alpha1.DeletionPolicyOrphan:
+				if err != nil {
+					t.Fatalf("Expected the ConfigMap to be orphaned, got %s", err)
+				}
+				if len(configMap.OwnerReferences) != 0 || configMap.Labels[secretsv1alpha1.DerivedFromNameLabel] != "" {
+					t.Fatalf("Expected the orphaned ConfigMap to no longer refer to the DerivedConfigMap, got %+v", configMap.ObjectMeta)
+				}
+			}
+		})
+	}
+}
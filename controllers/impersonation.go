@@ -0,0 +1,191 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+var (
+	impersonationCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "secrets_operator_impersonation_client_cache_requests_total",
+			Help: "Number of requests for a client impersonating a ServiceAccount, by whether the client was already cached",
+		},
+		[]string{"result"},
+	)
+	impersonationCacheEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "secrets_operator_impersonation_client_cache_evictions_total",
+			Help: "Number of clients impersonating a ServiceAccount removed from the cache, by reason",
+		},
+		[]string{"reason"},
+	)
+	impersonationCacheSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "secrets_operator_impersonation_client_cache_size",
+			Help: "Number of clients impersonating a ServiceAccount currently cached",
+		},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(impersonationCacheRequests, impersonationCacheEvictions, impersonationCacheSize)
+}
+
+type impersonatingClientEntry struct {
+	key     types.NamespacedName
+	client  client.Client
+	created time.Time
+}
+
+// ImpersonatingClientCache is a bounded cache of clients which impersonate ServiceAccounts, keyed by namespace and ServiceAccount name.
+// The least recently used client is evicted when the cache is full, clients are rebuilt after a TTL,
+// and clients for a ServiceAccount are evicted when it is deleted.
+// The clients do not read from the manager's cache, as that would allow reading objects the ServiceAccount has no access to
+type ImpersonatingClientCache struct {
+	RestConfig *rest.Config
+	Scheme     *runtime.Scheme
+	Mapper     meta.RESTMapper
+	// MaxSize is the maximum number of clients to keep
+	MaxSize int
+	// TTL is how long to keep a client before building a new one
+	TTL time.Duration
+
+	lock    sync.Mutex
+	entries map[types.NamespacedName]*list.Element
+	lru     list.List
+	// now returns the current time. Defaults to time.Now
+	now func() time.Time
+}
+
+// NewImpersonatingClientCache creates a cache of impersonating clients for a manager
+func NewImpersonatingClientCache(mgr ctrl.Manager, maxSize int, ttl time.Duration) *ImpersonatingClientCache {
+	return &ImpersonatingClientCache{
+		RestConfig: mgr.GetConfig(),
+		Scheme:     mgr.GetScheme(),
+		Mapper:     mgr.GetRESTMapper(),
+		MaxSize:    maxSize,
+		TTL:        ttl,
+	}
+}
+
+// Get returns a client impersonating a ServiceAccount, building one if there is not already one cached
+func (c *ImpersonatingClientCache) Get(namespace, serviceAccountName string) (client.Client, error) {
+	key := types.NamespacedName{Namespace: namespace, Name: serviceAccountName}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[types.NamespacedName]*list.Element)
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*impersonatingClientEntry)
+		if c.TTL <= 0 || c.currentTime().Sub(entry.created) < c.TTL {
+			c.lru.MoveToFront(elem)
+			impersonationCacheRequests.WithLabelValues("hit").Inc()
+			return entry.client, nil
+		}
+		c.remove(elem, "expired")
+	}
+	impersonationCacheRequests.WithLabelValues("miss").Inc()
+
+	impConfig := rest.CopyConfig(c.RestConfig)
+	impConfig.Impersonate = rest.ImpersonationConfig{
+		UserName: fmt.Sprintf("system:serviceaccount:%s:%s", namespace, serviceAccountName),
+	}
+	impClient, err := client.New(impConfig, client.Options{Scheme: c.Scheme, Mapper: c.Mapper})
+	if err != nil {
+		return nil, err
+	}
+
+	c.entries[key] = c.lru.PushFront(&impersonatingClientEntry{key: key, client: impClient, created: c.currentTime()})
+	for c.MaxSize > 0 && c.lru.Len() > c.MaxSize {
+		c.remove(c.lru.Back(), "full")
+	}
+	impersonationCacheSize.Set(float64(c.lru.Len()))
+	return impClient, nil
+}
+
+func (c *ImpersonatingClientCache) currentTime() time.Time {
+	if c.now == nil {
+		return time.Now()
+	}
+	return c.now()
+}
+
+// Invalidate removes the client for a ServiceAccount, if one is cached, and stops reporting its impersonation failures
+func (c *ImpersonatingClientCache) Invalidate(namespace, serviceAccountName string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.entries[types.NamespacedName{Namespace: namespace, Name: serviceAccountName}]; ok {
+		c.remove(elem, "deleted")
+		impersonationCacheSize.Set(float64(c.lru.Len()))
+	}
+	forgetImpersonationFailures(namespace, serviceAccountName)
+}
+
+// remove evicts an entry. The lock must be held
+func (c *ImpersonatingClientCache) remove(elem *list.Element, reason string) {
+	entry := c.lru.Remove(elem).(*impersonatingClientEntry)
+	delete(c.entries, entry.key)
+	impersonationCacheEvictions.WithLabelValues(reason).Inc()
+}
+
+// Reconcile invalidates the client for a ServiceAccount when it is deleted
+func (c *ImpersonatingClientCache) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log.FromContext(ctx).Info("ServiceAccount deleted, invalidating impersonating client", "serviceAccount", req.NamespacedName)
+	c.Invalidate(req.Namespace, req.Name)
+	return ctrl.Result{}, nil
+}
+
+//+kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch
+
+// SetupWithManager watches for deleted ServiceAccounts. Only the metadata of ServiceAccounts is cached
+func (c *ImpersonatingClientCache) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("serviceaccount-impersonation").
+		For(&corev1.ServiceAccount{}, builder.OnlyMetadata, builder.WithPredicates(predicate.Funcs{
+			CreateFunc:  func(event.CreateEvent) bool { return false },
+			UpdateFunc:  func(event.UpdateEvent) bool { return false },
+			DeleteFunc:  func(event.DeleteEvent) bool { return true },
+			GenericFunc: func(event.GenericEvent) bool { return false },
+		})).
+		Complete(c)
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// fakeClock is a clock which only moves when advanced
+type fakeClock struct {
+	time time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.time
+}
+
+func newTestImpersonatingClientCache(t *testing.T, maxSize int, ttl time.Duration) (*ImpersonatingClientCache, *fakeClock) {
+	clock := &fakeClock{time: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	scheme := newIndexedClient(t).Scheme()
+	return &ImpersonatingClientCache{
+		// Building a client does not contact the API server when a mapper is provided
+		RestConfig: &rest.Config{Host: "https://127.0.0.1:6443"},
+		Scheme:     scheme,
+		Mapper:     meta.NewDefaultRESTMapper(nil),
+		MaxSize:    maxSize,
+		TTL:        ttl,
+		now:        clock.Now,
+	}, clock
+}
+
+func mustGet(t *testing.T, cache *ImpersonatingClientCache, namespace, serviceAccountName string) client.Client {
+	t.Helper()
+	c, err := cache.Get(namespace, serviceAccountName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestImpersonatingClientCacheHit(t *testing.T) {
+	cache, _ := newTestImpersonatingClientCache(t, 10, time.Minute)
+	first := mustGet(t, cache, "app-ns", "app")
+	if mustGet(t, cache, "app-ns", "app") != first {
+		t.Fatalf("Expected the cached client to be reused")
+	}
+	if mustGet(t, cache, "other-ns", "app") == first {
+		t.Fatalf("Expected a different client for a ServiceAccount in another namespace")
+	}
+}
+
+func TestImpersonatingClientCacheExpiry(t *testing.T) {
+	cache, clock := newTestImpersonatingClientCache(t, 10, time.Minute)
+	first := mustGet(t, cache, "app-ns", "app")
+
+	clock.time = clock.time.Add(time.Minute - time.Second)
+	if mustGet(t, cache, "app-ns", "app") != first {
+		t.Fatalf("Expected the client to be reused before its TTL")
+	}
+
+	clock.time = clock.time.Add(time.Second)
+	if mustGet(t, cache, "app-ns", "app") == first {
+		t.Fatalf("Expected the client to be rebuilt after its TTL")
+	}
+	if cache.lru.Len() != 1 {
+		t.Fatalf("Expected the expired client to be replaced, got %d clients", cache.lru.Len())
+	}
+}
+
+func TestImpersonatingClientCacheEviction(t *testing.T) {
+	cache, _ := newTestImpersonatingClientCache(t, 2, time.Minute)
+	first := mustGet(t, cache, "app-ns", "first")
+	second := mustGet(t, cache, "app-ns", "second")
+	// Using the first client makes the second the least recently used
+	mustGet(t, cache, "app-ns", "first")
+	mustGet(t, cache, "app-ns", "third")
+
+	if cache.lru.Len() != 2 {
+		t.Fatalf("Expected the cache to be limited to 2 clients, got %d", cache.lru.Len())
+	}
+	if mustGet(t, cache, "app-ns", "first") != first {
+		t.Fatalf("Expected the recently used client to be kept")
+	}
+	if mustGet(t, cache, "app-ns", "second") == second {
+		t.Fatalf("Expected the least recently used client to be evicted")
+	}
+}
+
+func TestImpersonatingClientCacheInvalidate(t *testing.T) {
+	cache, _ := newTestImpersonatingClientCache(t, 10, time.Minute)
+	first := mustGet(t, cache, "app-ns", "app")
+	other := mustGet(t, cache, "app-ns", "other")
+
+	// Deleting a ServiceAccount invalidates only its client
+	_, err := cache.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "app-ns", Name: "app"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mustGet(t, cache, "app-ns", "app") == first {
+		t.Fatalf("Expected the client of a deleted ServiceAccount to be rebuilt")
+	}
+	if mustGet(t, cache, "app-ns", "other") != other {
+		t.Fatalf("Expected the clients of other ServiceAccounts to be kept")
+	}
+}
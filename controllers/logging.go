@@ -0,0 +1,307 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/meta"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+	"github.com/meln5674/secrets-operator/model"
+)
+
+// NewRedactingLogger wraps a logger so that the contents of Secrets, ConfigMaps, and the resources derived from them
+// are never logged, no matter what is passed to it.
+// Objects and lists of objects are logged as their keys, maps as their keys, byte slices as their length,
+// other structs as their fields, and errors which may quote the contents of references as only the key which failed.
+// Values logged under, or stored in fields with, a sensitive name such as "data" or "value" are redacted whatever their type
+func NewRedactingLogger(logger logr.Logger) logr.Logger {
+	return logr.New(&redactingLogSink{sink: logger.GetSink()})
+}
+
+// redactingLogSink redacts the values and errors passed to another sink
+type redactingLogSink struct {
+	sink logr.LogSink
+}
+
+var (
+	_ = logr.LogSink(&redactingLogSink{})
+	_ = logr.CallDepthLogSink(&redactingLogSink{})
+)
+
+// Init accounts for the frame this sink adds between the logger and the underlying sink,
+// which was already initialized by its own logger
+func (s *redactingLogSink) Init(info logr.RuntimeInfo) {
+	if sink, ok := s.sink.(logr.CallDepthLogSink); ok {
+		s.sink = sink.WithCallDepth(1)
+	}
+}
+
+func (s *redactingLogSink) Enabled(level int) bool {
+	return s.sink.Enabled(level)
+}
+
+func (s *redactingLogSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	s.sink.Info(level, msg, redactKeysAndValues(keysAndValues)...)
+}
+
+func (s *redactingLogSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	if err != nil {
+		err = errors.New(redactedErrorMessage(err))
+	}
+	s.sink.Error(err, msg, redactKeysAndValues(keysAndValues)...)
+}
+
+func (s *redactingLogSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return &redactingLogSink{sink: s.sink.WithValues(redactKeysAndValues(keysAndValues)...)}
+}
+
+func (s *redactingLogSink) WithName(name string) logr.LogSink {
+	return &redactingLogSink{sink: s.sink.WithName(name)}
+}
+
+func (s *redactingLogSink) WithCallDepth(depth int) logr.LogSink {
+	if sink, ok := s.sink.(logr.CallDepthLogSink); ok {
+		return &redactingLogSink{sink: sink.WithCallDepth(depth)}
+	}
+	return s
+}
+
+// redactKeysAndValues redacts the values of a list of alternating keys and values
+func redactKeysAndValues(keysAndValues []interface{}) []interface{} {
+	redacted := make([]interface{}, len(keysAndValues))
+	for ix, value := range keysAndValues {
+		if ix%2 == 0 {
+			redacted[ix] = value
+			continue
+		}
+		if key, ok := keysAndValues[ix-1].(string); ok && isSensitiveName(key) {
+			redacted[ix] = redactSensitiveValue(value)
+			continue
+		}
+		redacted[ix] = redactValue(value)
+	}
+	return redacted
+}
+
+// sensitiveNames are the log keys and struct fields, compared case-insensitively, which hold the contents of
+// Secrets and ConfigMaps, literals, or rendered values
+var sensitiveNames = map[string]struct{}{
+	"data":       {},
+	"stringdata": {},
+	"binarydata": {},
+	"value":      {},
+	"values":     {},
+	"literal":    {},
+	"rendered":   {},
+	"output":     {},
+	"password":   {},
+	"token":      {},
+}
+
+func isSensitiveName(name string) bool {
+	_, ok := sensitiveNames[strings.ToLower(name)]
+	return ok
+}
+
+// redactSensitiveValue replaces a value with a sensitive name. Objects, maps, and errors are described as usual,
+// as their keys are never sensitive, but any other value is only described by its type or length
+func redactSensitiveValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, error, client.Object, client.ObjectList, []byte:
+		return redactValue(v)
+	case string:
+		return fmt.Sprintf("[%d bytes redacted]", len(v))
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Map:
+		return redactValue(value)
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil
+		}
+		return redactSensitiveValue(rv.Elem().Interface())
+	}
+	return fmt.Sprintf("[%T redacted]", value)
+}
+
+var objectType = reflect.TypeOf((*client.Object)(nil)).Elem()
+
+// redactValue replaces a value which may contain the contents of a Secret or ConfigMap with a description of it
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case error:
+		return redactedErrorMessage(v)
+	case client.ObjectList:
+		items, err := meta.ExtractList(v)
+		if err != nil {
+			return fmt.Sprintf("[%T redacted]", v)
+		}
+		keys := make([]string, 0, len(items))
+		for _, item := range items {
+			if obj, ok := item.(client.Object); ok {
+				keys = append(keys, objectKey(obj))
+			}
+		}
+		return keys
+	case client.Object:
+		return objectKey(v)
+	case []byte:
+		return fmt.Sprintf("[%d bytes redacted]", len(v))
+	case string, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return v
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Struct:
+		// Objects passed by value, such as the items of a list
+		if reflect.PtrTo(rv.Type()).Implements(objectType) {
+			ptr := reflect.New(rv.Type())
+			ptr.Elem().Set(rv)
+			return objectKey(ptr.Interface().(client.Object))
+		}
+		if mayHoldSensitive(rv.Type()) {
+			return redactStruct(rv)
+		}
+	case reflect.Slice, reflect.Array:
+		redacted := make([]interface{}, rv.Len())
+		for ix := range redacted {
+			redacted[ix] = redactValue(rv.Index(ix).Interface())
+		}
+		return redacted
+	case reflect.Map:
+		// Maps are the data of Secrets and ConfigMaps, and the references and outputs of templates, so only their keys are logged
+		keys := make([]string, 0, rv.Len())
+		for _, key := range rv.MapKeys() {
+			keys = append(keys, fmt.Sprint(key.Interface()))
+		}
+		sort.Strings(keys)
+		return keys
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil
+		}
+		return redactValue(rv.Elem().Interface())
+	}
+	return value
+}
+
+// redactStruct logs a struct as its exported fields, redacting each field as if it were logged under its name
+func redactStruct(rv reflect.Value) map[string]interface{} {
+	redacted := make(map[string]interface{}, rv.NumField())
+	for ix := 0; ix < rv.NumField(); ix++ {
+		field := rv.Type().Field(ix)
+		if field.PkgPath != "" {
+			continue
+		}
+		value := rv.Field(ix).Interface()
+		if isSensitiveName(field.Name) {
+			redacted[field.Name] = redactSensitiveValue(value)
+		} else {
+			redacted[field.Name] = redactValue(value)
+		}
+	}
+	return redacted
+}
+
+var sensitiveTypes sync.Map
+
+// mayHoldSensitive checks if a struct has any exported fields, at any depth, which redactValue would change,
+// so that structs such as types.NamespacedName and time.Time are logged as they are
+func mayHoldSensitive(t reflect.Type) bool {
+	if cached, ok := sensitiveTypes.Load(t); ok {
+		return cached.(bool)
+	}
+	// Recursive types are assumed not to hold anything sensitive through themselves while they are being checked
+	sensitiveTypes.Store(t, false)
+	sensitive := false
+	for ix := 0; ix < t.NumField() && !sensitive; ix++ {
+		field := t.Field(ix)
+		if field.PkgPath != "" {
+			continue
+		}
+		sensitive = isSensitiveName(field.Name) || typeMayHoldSensitive(field.Type)
+	}
+	sensitiveTypes.Store(t, sensitive)
+	return sensitive
+}
+
+func typeMayHoldSensitive(t reflect.Type) bool {
+	if t.Implements(objectType) || reflect.PtrTo(t).Implements(objectType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Map, reflect.Interface:
+		return true
+	case reflect.Slice, reflect.Array:
+		return t.Elem().Kind() == reflect.Uint8 || typeMayHoldSensitive(t.Elem())
+	case reflect.Ptr:
+		return typeMayHoldSensitive(t.Elem())
+	case reflect.Struct:
+		return mayHoldSensitive(t)
+	}
+	return false
+}
+
+// objectKey identifies an object in logs
+func objectKey(obj client.Object) string {
+	if obj.GetNamespace() == "" {
+		return obj.GetName()
+	}
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// redactedErrorMessage describes an error for logs, Events, spans, and statuses.
+// Errors from executing templates, or decoding their output, may quote the contents of references,
+// so only the key which failed is named for those
+func redactedErrorMessage(err error) string {
+	if aggregate, ok := err.(utilerrors.Aggregate); ok {
+		messages := make([]error, 0, len(aggregate.Errors()))
+		for _, err := range aggregate.Errors() {
+			messages = append(messages, errors.New(redactedErrorMessage(err)))
+		}
+		return utilerrors.NewAggregate(messages).Error()
+	}
+
+	var renderErr *model.RenderError
+	if !errors.As(err, &renderErr) {
+		return err.Error()
+	}
+	switch renderErr.Reason {
+	case secretsv1alpha1.ReasonTemplateFailed, secretsv1alpha1.ReasonInvalidTemplateOutput:
+		if renderErr.Key == "" {
+			return fmt.Sprintf("Failed to render (%s), the error is not shown as it may contain the contents of references", renderErr.Reason)
+		}
+		return fmt.Sprintf("Failed to render key %q (%s), the error is not shown as it may contain the contents of references", renderErr.Key, renderErr.Reason)
+	default:
+		return err.Error()
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+	"github.com/meln5674/secrets-operator/model"
+)
+
+// knownSecretValues are the contents of the references and literals used in these tests, which must never be logged
+var knownSecretValues = []string{"hunter2", "correct-horse-battery-staple", "c3VwZXItc2VjcmV0"}
+
+// newCapturingLogger returns a redacting logger which writes to a buffer
+func newCapturingLogger() (logr.Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	return NewRedactingLogger(zap.New(zap.WriteTo(buf), zap.UseDevMode(false))), buf
+}
+
+func expectRedacted(t *testing.T, output string) {
+	t.Helper()
+	for _, value := range knownSecretValues {
+		if strings.Contains(output, value) {
+			t.Fatalf("Log output contains secret value %q:\n%s", value, output)
+		}
+	}
+}
+
+func expectLogged(t *testing.T, output string, expected ...string) {
+	t.Helper()
+	for _, value := range expected {
+		if !strings.Contains(output, value) {
+			t.Fatalf("Expected log output to contain %q:\n%s", value, output)
+		}
+	}
+}
+
+func secretMaterialDerivedSecret() *secretsv1alpha1.DerivedSecret {
+	literal := "correct-horse-battery-staple"
+	return &secretsv1alpha1.DerivedSecret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app-ns", Name: "app"},
+		Spec: secretsv1alpha1.DerivedSecretSpec{
+			References: []secretsv1alpha1.SensitiveReference{secretRef("source", "")},
+			StringData: map[string]secretsv1alpha1.StringTarget{"literal": {Literal: &literal}},
+			Data:       map[string]secretsv1alpha1.BinaryTarget{"binary": {Literal: []byte("c3VwZXItc2VjcmV0")}},
+		},
+	}
+}
+
+func secretMaterialSecret() *corev1.Secret {
+	secret := secretIn("app-ns", "source")
+	secret.Data = map[string][]byte{"password": []byte("hunter2")}
+	secret.StringData = map[string]string{"passphrase": "correct-horse-battery-staple"}
+	return secret
+}
+
+func TestRedactingLoggerObjects(t *testing.T) {
+	logger, buf := newCapturingLogger()
+	derivedSecret := secretMaterialDerivedSecret()
+	list := &secretsv1alpha1.DerivedSecretList{Items: []secretsv1alpha1.DerivedSecret{*derivedSecret}}
+
+	logger.Info("Queuing referees", "referees", list.Items)
+	logger.Info("Listed", "list", list)
+	logger.Info("Got object", "derivedSecret", derivedSecret, "secret", secretMaterialSecret())
+	logger.Info("Got value", "derivedSecret", *derivedSecret)
+	logger.Info("Got data", "data", secretMaterialSecret().Data, "stringData", secretMaterialSecret().StringData, "bytes", []byte("hunter2"))
+	logger.WithValues("secret", secretMaterialSecret()).Info("With values")
+	logger.V(0).WithName("nested").Info("Got references", "references", map[string]corev1.Secret{"ref": *secretMaterialSecret()})
+
+	output := buf.String()
+	expectRedacted(t, output)
+	expectLogged(t, output, `"app-ns/app"`, `"app-ns/source"`, `"password"`, `"passphrase"`, "7 bytes redacted")
+}
+
+func TestRedactingLoggerSensitiveKeys(t *testing.T) {
+	logger, buf := newCapturingLogger()
+	secret := secretMaterialSecret()
+
+	logger.Info("Rendered", "rendered", "hunter2", "value", []string{"correct-horse-battery-staple"}, "Password", &secret.StringData)
+	logger.Info("Got literal", "literal", secretMaterialDerivedSecret().Spec.StringData["literal"].Literal)
+	logger.WithValues("data", string(secret.Data["password"])).Info("With values")
+	logger.Error(nil, "Failed", "output", struct{ Key string }{Key: "c3VwZXItc2VjcmV0"})
+
+	output := buf.String()
+	expectRedacted(t, output)
+	expectLogged(t, output, "7 bytes redacted", `"passphrase"`, "28 bytes redacted")
+}
+
+func TestRedactingLoggerStructs(t *testing.T) {
+	logger, buf := newCapturingLogger()
+	derivedSecret := secretMaterialDerivedSecret()
+	template := "{{ .References.ref.password }}"
+	derivedSecret.Spec.StringData["templated"] = secretsv1alpha1.StringTarget{TargetBase: secretsv1alpha1.TargetBase{Template: &template}}
+
+	logger.Info("Got spec", "spec", derivedSecret.Spec)
+	logger.Info("Got target", "target", derivedSecret.Spec.StringData["literal"])
+	logger.Info("Got binary target", "target", derivedSecret.Spec.Data["binary"])
+	logger.Info("Got reference", "reference", struct {
+		Name   string
+		Secret corev1.Secret
+	}{Name: "ref", Secret: *secretMaterialSecret()})
+	logger.Info("Got key", "key", types.NamespacedName{Namespace: "app-ns", Name: "unchanged"})
+
+	output := buf.String()
+	expectRedacted(t, output)
+	expectLogged(t, output, `"literal"`, `"templated"`, `"app-ns/source"`, `"name":"unchanged"`)
+}
+
+func TestRedactingLoggerRenderErrors(t *testing.T) {
+	sRefs := map[string]corev1.Secret{"ref": *secretMaterialSecret()}
+	failing := map[string]string{
+		"failed":              `{{ fail (.References.ref.password | b64bin | b64dec) }}`,
+		"invalid-yaml":        `{{ .References.ref.password | b64bin | b64dec }}: [`,
+		"spoofed-missing-key": `{{ fail (printf "map has no entry for key %q" (.References.ref.password | b64bin | b64dec)) }}`,
+	}
+	for key, template := range failing {
+		t.Run(key, func(t *testing.T) {
+			isMap := key == "invalid-yaml"
+			strict := key == "spoofed-missing-key"
+			derivedSecret := secretMaterialDerivedSecret()
+			derivedSecret.Spec.StringData = map[string]secretsv1alpha1.StringTarget{
+				key: {TargetBase: secretsv1alpha1.TargetBase{Template: &template, IsMap: &isMap, Strict: &strict}},
+			}
+			_, _, _, err := model.GenerateSecret(nil, sRefs, nil, derivedSecret)
+			if err == nil {
+				t.Fatal("Expected template to fail")
+			}
+			if key != "invalid-yaml" && !strings.Contains(err.Error(), "hunter2") {
+				t.Fatalf("Expected the unredacted error to quote the reference, got %s", err)
+			}
+			expectRedacted(t, redactedErrorMessage(err))
+
+			logger, buf := newCapturingLogger()
+			logger.Info("Reconcile failed", "error", renderError(err))
+			logger.Error(renderError(err), "Reconciler error")
+			logger.Error(err, "Reconciler error")
+
+			output := buf.String()
+			expectRedacted(t, output)
+			expectLogged(t, output, key)
+		})
+	}
+}
+
+func TestReconcileLogsRedacted(t *testing.T) {
+	r, _ := newTracedReconciler(t, `{{ fail (.References.ref.password | b64bin | b64dec) }}`)
+	logger, buf := newCapturingLogger()
+	ctx := log.IntoContext(context.Background(), logger)
+
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "app-ns", Name: "app"}}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	derivedSecret := secretsv1alpha1.DerivedSecret{}
+	if err := r.Get(ctx, req.NamespacedName, &derivedSecret); err != nil {
+		t.Fatal(err)
+	}
+	expectRedacted(t, derivedSecret.Status.Error)
+	for _, condition := range derivedSecret.Status.Conditions {
+		expectRedacted(t, condition.Message)
+	}
+	expectLogged(t, derivedSecret.Status.Error, `Failed to render key "password" (TemplateFailed)`)
+
+	output := buf.String()
+	expectRedacted(t, output)
+	expectLogged(t, output, "permanent error", `Failed to render key \"password\" (TemplateFailed)`)
+}
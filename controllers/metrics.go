@@ -0,0 +1,230 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+var (
+	derivedSecretReconciles = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "secrets_operator_derivedsecret_reconciles_total",
+			Help: "Number of DerivedSecret reconciles, by outcome and the reason for the outcome",
+		},
+		[]string{"result", "reason"},
+	)
+	derivedSecretRenderDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "secrets_operator_derivedsecret_render_duration_seconds",
+			Help:    "Time taken to render the Secret of a DerivedSecret from its references",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 12),
+		},
+		[]string{"namespace", "name"},
+	)
+	impersonationFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "secrets_operator_impersonation_failures_total",
+			Help: "Number of reconciles which failed because a ServiceAccount could not be impersonated, or was forbidden from an operation",
+		},
+		[]string{"namespace", "service_account"},
+	)
+
+	derivedSecretReferencesDesc = prometheus.NewDesc(
+		"secrets_operator_derivedsecret_references",
+		"Number of references of a DerivedSecret",
+		[]string{"namespace", "name"}, nil,
+	)
+	derivedSecretOutputKeysDesc = prometheus.NewDesc(
+		"secrets_operator_derivedsecret_output_keys",
+		"Number of keys in the Secret last rendered for a DerivedSecret",
+		[]string{"namespace", "name"}, nil,
+	)
+	derivedSecretSinceLastSyncDesc = prometheus.NewDesc(
+		"secrets_operator_derivedsecret_seconds_since_last_sync",
+		"Seconds since the Secret of a DerivedSecret was last successfully synced",
+		[]string{"namespace", "name"}, nil,
+	)
+	sourceSecretFanOutDesc = prometheus.NewDesc(
+		"secrets_operator_source_secret_derivedsecrets",
+		"Number of DerivedSecrets which reference a Secret",
+		[]string{"namespace", "name"}, nil,
+	)
+
+	derivedSecretMetrics = newDerivedSecretCollector()
+)
+
+func init() {
+	metrics.Registry.MustRegister(derivedSecretReconciles, derivedSecretRenderDuration, impersonationFailures, derivedSecretMetrics)
+}
+
+type derivedSecretState struct {
+	references int
+	outputKeys int
+	lastSync   time.Time
+	secretRefs []types.NamespacedName
+	// serviceAccountName is the ServiceAccount impersonation failures were last counted for
+	serviceAccountName string
+}
+
+// derivedSecretCollector reports the state of each DerivedSecret as of its last reconcile.
+// Staleness and fan-out are computed when scraped, so they stay accurate between reconciles
+type derivedSecretCollector struct {
+	lock   sync.Mutex
+	states map[types.NamespacedName]*derivedSecretState
+	now    func() time.Time
+}
+
+var (
+	_ = prometheus.Collector(&derivedSecretCollector{})
+)
+
+func newDerivedSecretCollector() *derivedSecretCollector {
+	return &derivedSecretCollector{states: make(map[types.NamespacedName]*derivedSecretState), now: time.Now}
+}
+
+func (c *derivedSecretCollector) state(key types.NamespacedName) *derivedSecretState {
+	state, ok := c.states[key]
+	if !ok {
+		state = &derivedSecretState{}
+		c.states[key] = state
+	}
+	return state
+}
+
+// ObserveSpec records the references of a DerivedSecret, and the time it was last synced
+func (c *derivedSecretCollector) ObserveSpec(src *secretsv1alpha1.DerivedSecret) {
+	secretRefs := make([]types.NamespacedName, 0, len(src.Spec.References))
+	for ix := range src.Spec.References {
+		ref := &src.Spec.References[ix]
+		if ref.SecretRef == nil {
+			continue
+		}
+		secretRefs = append(secretRefs, types.NamespacedName{Namespace: ref.NamespaceOrDefault(src.Namespace), Name: ref.SecretRef.Name})
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	state := c.state(types.NamespacedName{Namespace: src.Namespace, Name: src.Name})
+	state.references = len(src.Spec.References)
+	state.secretRefs = secretRefs
+	if state.serviceAccountName != src.Spec.ServiceAccountName {
+		previous := state.serviceAccountName
+		state.serviceAccountName = src.Spec.ServiceAccountName
+		c.releaseServiceAccount(src.Namespace, previous)
+	}
+	if src.Status.LastSync != nil {
+		state.lastSync = src.Status.LastSync.Time
+	}
+}
+
+// ObserveOutputKeys records the number of keys rendered for a DerivedSecret
+func (c *derivedSecretCollector) ObserveOutputKeys(src *secretsv1alpha1.DerivedSecret, keys int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.state(types.NamespacedName{Namespace: src.Namespace, Name: src.Name}).outputKeys = keys
+}
+
+// Forget stops reporting a DerivedSecret which no longer exists
+func (c *derivedSecretCollector) Forget(key types.NamespacedName) {
+	c.lock.Lock()
+	if state, ok := c.states[key]; ok {
+		delete(c.states, key)
+		c.releaseServiceAccount(key.Namespace, state.serviceAccountName)
+	}
+	c.lock.Unlock()
+	derivedSecretRenderDuration.DeleteLabelValues(key.Namespace, key.Name)
+}
+
+// releaseServiceAccount stops reporting impersonation failures for a ServiceAccount once no DerivedSecret uses it. The lock must be held
+func (c *derivedSecretCollector) releaseServiceAccount(namespace, serviceAccountName string) {
+	if serviceAccountName == "" {
+		return
+	}
+	for key, state := range c.states {
+		if key.Namespace == namespace && state.serviceAccountName == serviceAccountName {
+			return
+		}
+	}
+	forgetImpersonationFailures(namespace, serviceAccountName)
+}
+
+func (c *derivedSecretCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- derivedSecretReferencesDesc
+	ch <- derivedSecretOutputKeysDesc
+	ch <- derivedSecretSinceLastSyncDesc
+	ch <- sourceSecretFanOutDesc
+}
+
+func (c *derivedSecretCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	fanOut := make(map[types.NamespacedName]int)
+	for key, state := range c.states {
+		ch <- prometheus.MustNewConstMetric(derivedSecretReferencesDesc, prometheus.GaugeValue, float64(state.references), key.Namespace, key.Name)
+		ch <- prometheus.MustNewConstMetric(derivedSecretOutputKeysDesc, prometheus.GaugeValue, float64(state.outputKeys), key.Namespace, key.Name)
+		if !state.lastSync.IsZero() {
+			ch <- prometheus.MustNewConstMetric(derivedSecretSinceLastSyncDesc, prometheus.GaugeValue, now.Sub(state.lastSync).Seconds(), key.Namespace, key.Name)
+		}
+		// A DerivedSecret referencing the same Secret more than once only counts once
+		seen := make(map[types.NamespacedName]struct{}, len(state.secretRefs))
+		for _, ref := range state.secretRefs {
+			if _, ok := seen[ref]; ok {
+				continue
+			}
+			seen[ref] = struct{}{}
+			fanOut[ref]++
+		}
+	}
+	for ref, count := range fanOut {
+		ch <- prometheus.MustNewConstMetric(sourceSecretFanOutDesc, prometheus.GaugeValue, float64(count), ref.Namespace, ref.Name)
+	}
+}
+
+// forgetImpersonationFailures stops reporting impersonation failures for a ServiceAccount
+func forgetImpersonationFailures(namespace, serviceAccountName string) {
+	impersonationFailures.DeleteLabelValues(namespace, serviceAccountName)
+}
+
+// recordDerivedSecretReconcile counts the outcome of a reconcile of a DerivedSecret, given its final error
+func recordDerivedSecretReconcile(src *secretsv1alpha1.DerivedSecret, err error) {
+	derivedSecretMetrics.ObserveSpec(src)
+	if err == nil {
+		derivedSecretReconciles.WithLabelValues("success", secretsv1alpha1.ReasonSynced).Inc()
+		return
+	}
+	reason := secretsv1alpha1.ReasonFailed
+	var stageErr *stageError
+	if errors.As(err, &stageErr) {
+		reason = stageErr.Reason
+	}
+	derivedSecretReconciles.WithLabelValues("error", reason).Inc()
+	if reason == secretsv1alpha1.ReasonImpersonationFailed {
+		impersonationFailures.WithLabelValues(src.Namespace, src.Spec.ServiceAccountName).Inc()
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+func impersonatingDerivedSecret(name, serviceAccountName string) *secretsv1alpha1.DerivedSecret {
+	return &secretsv1alpha1.DerivedSecret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "metrics-ns", Name: name},
+		Spec:       secretsv1alpha1.DerivedSecretSpec{ServiceAccountName: serviceAccountName},
+	}
+}
+
+func TestForgetDropsImpersonationFailures(t *testing.T) {
+	collector := newDerivedSecretCollector()
+	first := impersonatingDerivedSecret("first", "shared-sa")
+	second := impersonatingDerivedSecret("second", "shared-sa")
+	for _, src := range []*secretsv1alpha1.DerivedSecret{first, second} {
+		collector.ObserveSpec(src)
+		impersonationFailures.WithLabelValues(src.Namespace, src.Spec.ServiceAccountName).Inc()
+	}
+	series := testutil.CollectAndCount(impersonationFailures)
+
+	collector.Forget(types.NamespacedName{Namespace: first.Namespace, Name: first.Name})
+	if testutil.CollectAndCount(impersonationFailures) != series {
+		t.Fatal("Expected failures to be kept while another DerivedSecret uses the ServiceAccount")
+	}
+	collector.Forget(types.NamespacedName{Namespace: second.Namespace, Name: second.Name})
+	if testutil.CollectAndCount(impersonationFailures) != series-1 {
+		t.Fatal("Expected failures to be dropped once no DerivedSecret uses the ServiceAccount")
+	}
+}
+
+func TestChangingServiceAccountDropsImpersonationFailures(t *testing.T) {
+	collector := newDerivedSecretCollector()
+	src := impersonatingDerivedSecret("changed", "old-sa")
+	collector.ObserveSpec(src)
+	impersonationFailures.WithLabelValues(src.Namespace, "old-sa").Inc()
+	series := testutil.CollectAndCount(impersonationFailures)
+
+	src.Spec.ServiceAccountName = "new-sa"
+	collector.ObserveSpec(src)
+	if testutil.CollectAndCount(impersonationFailures) != series-1 {
+		t.Fatal("Expected failures of the previous ServiceAccount to be dropped")
+	}
+}
+
+func TestInvalidateDropsImpersonationFailures(t *testing.T) {
+	cache, _ := newTestImpersonatingClientCache(t, 0, 0)
+	impersonationFailures.WithLabelValues("metrics-ns", "deleted-sa").Inc()
+	series := testutil.CollectAndCount(impersonationFailures)
+
+	cache.Invalidate("metrics-ns", "deleted-sa")
+	if testutil.CollectAndCount(impersonationFailures) != series-1 {
+		t.Fatal("Expected failures of a deleted ServiceAccount to be dropped")
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+// NamespaceScope restricts the namespaces the operator reconciles resources in, and writes derived objects to.
+// The zero value does not restrict anything
+type NamespaceScope struct {
+	// WatchNamespaces are the namespaces whose resources are reconciled, and whose Secrets and ConfigMaps are cached.
+	// If empty, all namespaces are watched
+	WatchNamespaces []string
+	// TargetNamespaces are the namespaces that derived objects may be written to, in addition to WatchNamespaces.
+	// If both are empty, derived objects may be written to any namespace
+	TargetNamespaces []string
+}
+
+// Restricted returns true if the operator does not watch every namespace
+func (s NamespaceScope) Restricted() bool {
+	return len(s.WatchNamespaces) != 0
+}
+
+// Watches returns true if resources in a namespace should be reconciled
+func (s NamespaceScope) Watches(namespace string) bool {
+	return !s.Restricted() || contains(s.WatchNamespaces, namespace)
+}
+
+// CanTarget returns true if derived objects may be written to a namespace
+func (s NamespaceScope) CanTarget(namespace string) bool {
+	if len(s.WatchNamespaces) == 0 && len(s.TargetNamespaces) == 0 {
+		return true
+	}
+	return contains(s.WatchNamespaces, namespace) || contains(s.TargetNamespaces, namespace)
+}
+
+// CacheNamespaces returns the namespaces to cache objects from, or nil to cache every namespace
+func (s NamespaceScope) CacheNamespaces() []string {
+	if !s.Restricted() {
+		return nil
+	}
+	namespaces := make([]string, 0, len(s.WatchNamespaces)+len(s.TargetNamespaces))
+	for _, namespace := range append(s.WatchNamespaces, s.TargetNamespaces...) {
+		if !contains(namespaces, namespace) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+// NewCache returns the function to build the manager's cache with, or nil for the default cluster-wide cache
+func (s NamespaceScope) NewCache() cache.NewCacheFunc {
+	namespaces := s.CacheNamespaces()
+	if namespaces == nil {
+		return nil
+	}
+	return cache.MultiNamespacedCacheBuilder(namespaces)
+}
+
+// Predicate filters out resources in namespaces which are not watched.
+// Target namespaces are cached so that changes to derived objects are noticed, but resources in them are not reconciled
+func (s NamespaceScope) Predicate() predicate.Predicate {
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return s.Watches(obj.GetNamespace())
+	})
+}
+
+// checkTarget returns an error for the TargetSynced condition if a resource in one namespace may not write derived objects to another.
+// Resources may always write to their own namespace
+func (s NamespaceScope) checkTarget(sourceNamespace, namespace string) error {
+	if namespace == sourceNamespace || s.CanTarget(namespace) {
+		return nil
+	}
+	return &stageError{
+		Condition: secretsv1alpha1.ConditionTargetSynced,
+		Reason:    secretsv1alpha1.ReasonNamespaceNotWatched,
+		Err:       fmt.Errorf("Namespace %s is not one of the operator's watched or target namespaces, so derived objects cannot be written to it", namespace),
+	}
+}
+
+// checkReferences returns an error for the ReferencesResolved condition if a resource in one namespace references objects in a namespace that is not watched.
+// Such references could be read, but changes to them would never be noticed
+func (s NamespaceScope) checkReferences(sourceNamespace string, references []secretsv1alpha1.SensitiveReference) error {
+	for ix := range references {
+		namespace := references[ix].NamespaceOrDefault(sourceNamespace)
+		if namespace == sourceNamespace || s.Watches(namespace) {
+			continue
+		}
+		return &stageError{
+			Condition: secretsv1alpha1.ConditionReferencesResolved,
+			Reason:    secretsv1alpha1.ReasonNamespaceNotWatched,
+			Err:       fmt.Errorf("Reference %s is in namespace %s, which is not one of the operator's watched namespaces, so changes to it would not be noticed", references[ix].Name, namespace),
+		}
+	}
+	return nil
+}
+
+func contains(items []string, item string) bool {
+	for _, candidate := range items {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
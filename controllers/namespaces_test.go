@@ -0,0 +1,144 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+func TestCheckReferences(t *testing.T) {
+	cases := []struct {
+		name       string
+		scope      NamespaceScope
+		references []secretsv1alpha1.SensitiveReference
+		allowed    bool
+	}{
+		{
+			name:       "every namespace is watched",
+			references: []secretsv1alpha1.SensitiveReference{secretRef("db", "shared")},
+			allowed:    true,
+		},
+		{
+			name:       "own namespace",
+			scope:      NamespaceScope{WatchNamespaces: []string{"app-ns"}},
+			references: []secretsv1alpha1.SensitiveReference{secretRef("db", ""), configMapRef("db", "app-ns")},
+			allowed:    true,
+		},
+		{
+			name:       "another watched namespace",
+			scope:      NamespaceScope{WatchNamespaces: []string{"app-ns", "shared"}},
+			references: []secretsv1alpha1.SensitiveReference{secretRef("db", "shared")},
+			allowed:    true,
+		},
+		{
+			name:       "unwatched namespace",
+			scope:      NamespaceScope{WatchNamespaces: []string{"app-ns"}},
+			references: []secretsv1alpha1.SensitiveReference{secretRef("db", "shared")},
+		},
+		{
+			name:       "target namespaces are not watched",
+			scope:      NamespaceScope{WatchNamespaces: []string{"app-ns"}, TargetNamespaces: []string{"shared"}},
+			references: []secretsv1alpha1.SensitiveReference{configMapRef("db", "shared")},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.scope.checkReferences("app-ns", tc.references)
+			if tc.allowed {
+				if err != nil {
+					t.Fatalf("Expected references to be allowed, got %s", err)
+				}
+				return
+			}
+			var stageErr *stageError
+			if !errors.As(err, &stageErr) || stageErr.Reason != secretsv1alpha1.ReasonNamespaceNotWatched || stageErr.Condition != secretsv1alpha1.ConditionReferencesResolved {
+				t.Fatalf("Expected a NamespaceNotWatched error for ReferencesResolved, got %v", err)
+			}
+		})
+	}
+}
+
+func TestClusterDerivedSecretSkipsUntargetedNamespaces(t *testing.T) {
+	template := "value"
+	clusterDerivedSecret := &secretsv1alpha1.ClusterDerivedSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "app"},
+		Spec: secretsv1alpha1.ClusterDerivedSecretSpec{
+			StringData: map[string]secretsv1alpha1.StringTarget{
+				"key": {TargetBase: secretsv1alpha1.TargetBase{Template: &template}},
+			},
+		},
+	}
+	c := &applyAsMergeClient{indexedClient: newIndexedClient(t,
+		clusterDerivedSecret,
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "app-ns"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other-ns"}},
+	)}
+	recorder := record.NewFakeRecorder(10)
+	r := &ClusterDerivedSecretReconciler{
+		Client:     c,
+		Scheme:     c.Scheme(),
+		Namespaces: NamespaceScope{TargetNamespaces: []string{"app-ns"}},
+		Recorder:   recorder,
+	}
+	r.events = newEventRecorder(r.Recorder, repeatedEventInterval)
+
+	ctx := context.Background()
+	if _, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{Name: "app"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "app-ns", Name: "app"}, &corev1.Secret{}); err != nil {
+		t.Fatalf("Expected a Secret in the target namespace: %s", err)
+	}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "other-ns", Name: "app"}, &corev1.Secret{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("Expected no Secret in the skipped namespace, got %v", err)
+	}
+
+	if err := c.Get(ctx, client.ObjectKey{Name: "app"}, clusterDerivedSecret); err != nil {
+		t.Fatal(err)
+	}
+	targets := clusterDerivedSecret.Status.Targets
+	if len(targets) != 2 || targets[0].Namespace != "app-ns" || targets[0].Error != "" || targets[1].Namespace != "other-ns" {
+		t.Fatalf("Expected both selected namespaces in status.targets, got %+v", targets)
+	}
+	if !strings.Contains(targets[1].Error, "other-ns is not one of the operator's watched or target namespaces") {
+		t.Fatalf("Expected the skipped namespace to explain why, got %q", targets[1].Error)
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, corev1.EventTypeWarning+" "+secretsv1alpha1.ReasonNamespaceNotWatched) || !strings.Contains(event, "other-ns") {
+			t.Fatalf("Expected a NamespaceNotWatched Warning naming the skipped namespace, got %q", event)
+		}
+	default:
+		t.Fatal("Expected a Warning Event for the skipped namespace")
+	}
+}
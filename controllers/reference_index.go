@@ -0,0 +1,119 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+const (
+	referencedSecretsKey    = ".metadata.references.secrets"
+	referencedConfigMapsKey = ".metadata.references.configMaps"
+
+	// anyNamespace is used in place of a namespace in reference index values for references which are resolved
+	// in every namespace a resource selects, instead of a single namespace
+	anyNamespace = "*"
+)
+
+// referenceIndexValue is the value used in the reference field indexes for a ConfigMap or Secret
+func referenceIndexValue(namespace, name string) string {
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
+
+// referenceKeyForKind returns the reference index key for a kind of referenced object
+func referenceKeyForKind(kind string) (string, bool) {
+	switch kind {
+	case "Secret":
+		return referencedSecretsKey, true
+	case "ConfigMap":
+		return referencedConfigMapsKey, true
+	default:
+		return "", false
+	}
+}
+
+// referencesFunc extracts the references of a resource, along with the namespace that references without a namespace are resolved in,
+// which is anyNamespace if they are resolved in more than one namespace
+type referencesFunc func(obj client.Object) (namespace string, references []secretsv1alpha1.SensitiveReference)
+
+// referenceIndexer produces an indexer of the namespace and name of each Secret or ConfigMap reference of a resource
+func referenceIndexer(kind string, referencesOf referencesFunc) client.IndexerFunc {
+	return func(rawObj client.Object) []string {
+		namespace, references := referencesOf(rawObj)
+		values := make([]string, 0, len(references))
+		for ix := range references {
+			ref := &references[ix]
+			switch {
+			case kind == "Secret" && ref.SecretRef != nil:
+				values = append(values, referenceIndexValue(ref.NamespaceOrDefault(namespace), ref.SecretRef.Name))
+			case kind == "ConfigMap" && ref.ConfigMapRef != nil:
+				values = append(values, referenceIndexValue(ref.NamespaceOrDefault(namespace), ref.ConfigMapRef.Name))
+			}
+		}
+		return values
+	}
+}
+
+// indexReferences registers the Secret and ConfigMap reference indexes for a kind of resource
+func indexReferences(ctx context.Context, indexer client.FieldIndexer, obj client.Object, referencesOf referencesFunc) error {
+	if err := indexer.IndexField(ctx, obj, referencedSecretsKey, referenceIndexer("Secret", referencesOf)); err != nil {
+		return err
+	}
+	return indexer.IndexField(ctx, obj, referencedConfigMapsKey, referenceIndexer("ConfigMap", referencesOf))
+}
+
+// listReferencing lists the resources which reference a Secret or ConfigMap through an index value
+func listReferencing(ctx context.Context, c client.Reader, list client.ObjectList, key, value string) ([]client.Object, error) {
+	err := c.List(ctx, list, client.MatchingFields(map[string]string{key: value}))
+	if err != nil {
+		return nil, err
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]client.Object, 0, len(items))
+	for _, item := range items {
+		obj, ok := item.(client.Object)
+		if !ok {
+			return nil, fmt.Errorf("Expected a client.Object, got %T", item)
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// requestsFor produces a reconcile request for each of a set of objects
+func requestsFor(objs []client.Object) []reconcile.Request {
+	requests := make([]reconcile.Request, 0, len(objs))
+	for _, obj := range objs {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Namespace: obj.GetNamespace(),
+			Name:      obj.GetName(),
+		}})
+	}
+	return requests
+}
@@ -0,0 +1,330 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+// indexedClient emulates the field indexes of the manager's cache on top of a fake client, which does not support them
+type indexedClient struct {
+	client.Client
+	indexes map[string]client.IndexerFunc
+}
+
+var _ = client.FieldIndexer(&indexedClient{})
+
+func (c *indexedClient) IndexField(ctx context.Context, obj client.Object, field string, extractValue client.IndexerFunc) error {
+	c.indexes[field] = extractValue
+	return nil
+}
+
+func (c *indexedClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	if listOpts.FieldSelector == nil {
+		return c.Client.List(ctx, list, opts...)
+	}
+
+	field, value := "", ""
+	for key, indexer := range c.indexes {
+		if v, ok := listOpts.FieldSelector.RequiresExactMatch(key); ok && indexer != nil {
+			field, value = key, v
+			break
+		}
+	}
+	if field == "" {
+		return fmt.Errorf("No index matches field selector %s", listOpts.FieldSelector)
+	}
+	listOpts.FieldSelector = nil
+	if err := c.Client.List(ctx, list, &listOpts); err != nil {
+		return err
+	}
+
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	matching := make([]runtime.Object, 0, len(items))
+	for _, item := range items {
+		for _, v := range c.indexes[field](item.(client.Object)) {
+			if v == value {
+				matching = append(matching, item)
+				break
+			}
+		}
+	}
+	return meta.SetList(list, matching)
+}
+
+func newIndexedClient(t *testing.T, objs ...client.Object) *indexedClient {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := secretsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := &indexedClient{
+		Client:  fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(),
+		indexes: make(map[string]client.IndexerFunc),
+	}
+	ctx := context.Background()
+	if err := indexReferences(ctx, c, &secretsv1alpha1.DerivedSecret{}, derivedSecretReferences); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func secretRef(name, namespace string) secretsv1alpha1.SensitiveReference {
+	return secretsv1alpha1.SensitiveReference{
+		Name: "ref",
+		SecretRef: &secretsv1alpha1.SecretReference{
+			SecretEnvSource: corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: name}},
+			Namespace:       namespace,
+		},
+	}
+}
+
+func configMapRef(name, namespace string) secretsv1alpha1.SensitiveReference {
+	return secretsv1alpha1.SensitiveReference{
+		Name: "ref",
+		ConfigMapRef: &secretsv1alpha1.ConfigMapReference{
+			ConfigMapEnvSource: corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: name}},
+			Namespace:          namespace,
+		},
+	}
+}
+
+func requestNames(requests []reconcile.Request) []string {
+	names := make([]string, 0, len(requests))
+	for _, request := range requests {
+		names = append(names, request.String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func expectRequests(t *testing.T, requests []reconcile.Request, expected ...string) {
+	t.Helper()
+	names := requestNames(requests)
+	sort.Strings(expected)
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		if len(names) > 10 {
+			t.Fatalf("Expected %d requests %v, got %d requests", len(expected), expected, len(names))
+		}
+		t.Fatalf("Expected requests %v, got %v", expected, names)
+	}
+}
+
+func secretIn(namespace, name string) *corev1.Secret {
+	return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+}
+
+const fanOutTenants = 500
+
+// multiTenantDerivedSecrets produces a DerivedSecret in each of many tenant namespaces which references a same-named Secret and ConfigMap
+// in its own namespace, plus one which references a shared Secret in another namespace
+func multiTenantDerivedSecrets() []client.Object {
+	objs := make([]client.Object, 0, 2*fanOutTenants)
+	for ix := 0; ix < fanOutTenants; ix++ {
+		namespace := fmt.Sprintf("tenant-%d", ix)
+		objs = append(objs,
+			&secretsv1alpha1.DerivedSecret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "app"},
+				Spec: secretsv1alpha1.DerivedSecretSpec{
+					References: []secretsv1alpha1.SensitiveReference{secretRef("db-creds", ""), configMapRef("db-config", "")},
+				},
+			},
+			&secretsv1alpha1.DerivedSecret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "shared"},
+				Spec: secretsv1alpha1.DerivedSecretSpec{
+					References: []secretsv1alpha1.SensitiveReference{secretRef("db-creds", "shared")},
+				},
+			},
+		)
+	}
+	return objs
+}
+
+func TestDerivedSecretSameNamespaceReferenceFanOut(t *testing.T) {
+	watcher := DerivedSecretWatcher{Reconciler: &DerivedSecretReconciler{Client: newIndexedClient(t, multiTenantDerivedSecrets()...)}}
+
+	requests, err := watcher.ReferencingDerivedSecrets("Secret", secretIn("tenant-42", "db-creds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRequests(t, requests, "tenant-42/app")
+
+	requests, err = watcher.ReferencingDerivedSecrets("ConfigMap", &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "tenant-7", Name: "db-config"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRequests(t, requests, "tenant-7/app")
+}
+
+func TestDerivedSecretReferenceKindsAreSeparate(t *testing.T) {
+	watcher := DerivedSecretWatcher{Reconciler: &DerivedSecretReconciler{Client: newIndexedClient(t, multiTenantDerivedSecrets()...)}}
+
+	// A ConfigMap with the same name as a referenced Secret is not a reference
+	requests, err := watcher.ReferencingDerivedSecrets("ConfigMap", &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "tenant-42", Name: "db-creds"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRequests(t, requests)
+}
+
+func TestDerivedSecretUnreferencedNamespace(t *testing.T) {
+	watcher := DerivedSecretWatcher{Reconciler: &DerivedSecretReconciler{Client: newIndexedClient(t, multiTenantDerivedSecrets()...)}}
+
+	requests, err := watcher.ReferencingDerivedSecrets("Secret", secretIn("not-a-tenant", "db-creds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRequests(t, requests)
+}
+
+func TestDerivedSecretCrossNamespaceReferenceFanOut(t *testing.T) {
+	watcher := DerivedSecretWatcher{Reconciler: &DerivedSecretReconciler{Client: newIndexedClient(t, multiTenantDerivedSecrets()...)}}
+
+	requests, err := watcher.ReferencingDerivedSecrets("Secret", secretIn("shared", "db-creds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]string, 0, fanOutTenants)
+	for ix := 0; ix < fanOutTenants; ix++ {
+		expected = append(expected, fmt.Sprintf("tenant-%d/shared", ix))
+	}
+	expectRequests(t, requests, expected...)
+}
+
+func TestDerivedConfigMapReferenceFanOut(t *testing.T) {
+	objs := make([]client.Object, 0, fanOutTenants)
+	for ix := 0; ix < fanOutTenants; ix++ {
+		objs = append(objs, &secretsv1alpha1.DerivedConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: fmt.Sprintf("tenant-%d", ix), Name: "app"},
+			Spec: secretsv1alpha1.DerivedConfigMapSpec{
+				References: []secretsv1alpha1.Reference{{
+					Name:         "ref",
+					ConfigMapRef: *configMapRef("db-config", "").ConfigMapRef,
+				}},
+			},
+		})
+	}
+	c := newIndexedClient(t, objs...)
+	if err := indexReferences(context.Background(), c, &secretsv1alpha1.DerivedConfigMap{}, derivedConfigMapReferences); err != nil {
+		t.Fatal(err)
+	}
+	watcher := DerivedConfigMapWatcher{Reconciler: &DerivedConfigMapReconciler{Client: c}}
+
+	requests, err := watcher.ReferencingDerivedConfigMaps("ConfigMap", &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "tenant-3", Name: "db-config"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRequests(t, requests, "tenant-3/app")
+}
+
+func TestClusterDerivedSecretReferenceFanOut(t *testing.T) {
+	objs := []client.Object{
+		&secretsv1alpha1.ClusterDerivedSecret{
+			ObjectMeta: metav1.ObjectMeta{Name: "per-tenant"},
+			Spec: secretsv1alpha1.ClusterDerivedSecretSpec{
+				NamespaceSelector: metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "true"}},
+				References:        []secretsv1alpha1.SensitiveReference{secretRef("db-creds", "")},
+			},
+		},
+		&secretsv1alpha1.ClusterDerivedSecret{
+			ObjectMeta: metav1.ObjectMeta{Name: "shared"},
+			Spec: secretsv1alpha1.ClusterDerivedSecretSpec{
+				NamespaceSelector:  metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "true"}},
+				ReferenceNamespace: "shared",
+				References:         []secretsv1alpha1.SensitiveReference{secretRef("db-creds", "")},
+			},
+		},
+		&secretsv1alpha1.ClusterDerivedSecret{
+			ObjectMeta: metav1.ObjectMeta{Name: "other-selector"},
+			Spec: secretsv1alpha1.ClusterDerivedSecretSpec{
+				NamespaceSelector: metav1.LabelSelector{MatchLabels: map[string]string{"team": "other"}},
+				References:        []secretsv1alpha1.SensitiveReference{secretRef("db-creds", "")},
+			},
+		},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shared"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "not-a-tenant"}},
+	}
+	for ix := 0; ix < fanOutTenants; ix++ {
+		objs = append(objs, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("tenant-%d", ix), Labels: map[string]string{"tenant": "true"}}})
+	}
+	c := newIndexedClient(t, objs...)
+	if err := indexReferences(context.Background(), c, &secretsv1alpha1.ClusterDerivedSecret{}, clusterDerivedSecretReferences); err != nil {
+		t.Fatal(err)
+	}
+	watcher := ClusterDerivedSecretWatcher{Reconciler: &ClusterDerivedSecretReconciler{Client: c}}
+
+	requests, err := watcher.ReferencingClusterDerivedSecrets("Secret", secretIn("tenant-42", "db-creds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRequests(t, requests, "/per-tenant")
+
+	requests, err = watcher.ReferencingClusterDerivedSecrets("Secret", secretIn("shared", "db-creds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRequests(t, requests, "/shared")
+
+	requests, err = watcher.ReferencingClusterDerivedSecrets("Secret", secretIn("not-a-tenant", "db-creds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRequests(t, requests)
+}
+
+func TestReferenceIndexerUsesReferenceNamespace(t *testing.T) {
+	derivedSecret := &secretsv1alpha1.DerivedSecret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "app"},
+		Spec: secretsv1alpha1.DerivedSecretSpec{
+			References: []secretsv1alpha1.SensitiveReference{
+				secretRef("local", ""),
+				secretRef("remote", "shared"),
+				configMapRef("config", ""),
+			},
+		},
+	}
+	values := referenceIndexer("Secret", derivedSecretReferences)(derivedSecret)
+	if fmt.Sprint(values) != fmt.Sprint([]string{"tenant/local", "shared/remote"}) {
+		t.Fatalf("Unexpected Secret index values %v", values)
+	}
+	values = referenceIndexer("ConfigMap", derivedSecretReferences)(derivedSecret)
+	if fmt.Sprint(values) != fmt.Sprint([]string{"tenant/config"}) {
+		t.Fatalf("Unexpected ConfigMap index values %v", values)
+	}
+}
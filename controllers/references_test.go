@@ -0,0 +1,122 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+// failingGetClient fails every Get with an error other than NotFound
+type failingGetClient struct {
+	*indexedClient
+}
+
+func (c *failingGetClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	return apierrors.NewInternalError(fmt.Errorf("etcd is unavailable"))
+}
+
+func optionalRef(ref secretsv1alpha1.SensitiveReference) secretsv1alpha1.SensitiveReference {
+	optional := true
+	if ref.SecretRef != nil {
+		ref.SecretRef.Optional = &optional
+	} else {
+		ref.ConfigMapRef.Optional = &optional
+	}
+	return ref
+}
+
+func TestOptionalReferenceMissing(t *testing.T) {
+	c := newIndexedClient(t)
+	for _, ref := range []secretsv1alpha1.SensitiveReference{optionalRef(secretRef("absent", "")), optionalRef(configMapRef("absent", ""))} {
+		cmRefs, sRefs, err := fetchReferences(context.Background(), c, nil, "app-ns", []secretsv1alpha1.SensitiveReference{ref})
+		if err != nil {
+			t.Fatalf("Expected a missing optional reference to be tolerated, got %s", err)
+		}
+		if len(cmRefs) != 0 || len(sRefs) != 0 {
+			t.Fatalf("Expected a missing optional reference to be left out, got %v %v", cmRefs, sRefs)
+		}
+	}
+}
+
+func TestRequiredReferenceMissing(t *testing.T) {
+	c := newIndexedClient(t)
+	_, _, err := fetchReferences(context.Background(), c, nil, "app-ns", []secretsv1alpha1.SensitiveReference{secretRef("absent", "")})
+	if !apierrors.IsNotFound(err) {
+		t.Fatalf("Expected a missing required reference to fail with NotFound, got %v", err)
+	}
+}
+
+func TestOptionalReferenceError(t *testing.T) {
+	c := &failingGetClient{indexedClient: newIndexedClient(t)}
+	_, _, err := fetchReferences(context.Background(), c, nil, "app-ns", []secretsv1alpha1.SensitiveReference{optionalRef(secretRef("absent", ""))})
+	if !apierrors.IsInternalError(err) {
+		t.Fatalf("Expected an error fetching an optional reference to fail the fetch, got %v", err)
+	}
+}
+
+func TestReconcileMissingOptionalReference(t *testing.T) {
+	ref := optionalRef(secretRef("absent", ""))
+	ref.Defaults = map[string]string{"password": "default-password"}
+	template := `{{ if .Missing.ref }}missing {{ end }}{{ .References.ref.password | utf8 }}`
+	derivedSecret := &secretsv1alpha1.DerivedSecret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app-ns", Name: "app"},
+		Spec: secretsv1alpha1.DerivedSecretSpec{
+			References: []secretsv1alpha1.SensitiveReference{ref},
+			StringData: map[string]secretsv1alpha1.StringTarget{
+				"password": {TargetBase: secretsv1alpha1.TargetBase{Template: &template}},
+			},
+		},
+	}
+	c := &applyAsMergeClient{indexedClient: newIndexedClient(t, derivedSecret)}
+	r := &DerivedSecretReconciler{Client: c, Scheme: c.Scheme()}
+	r.instrument()
+
+	ctx := context.Background()
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "app-ns", Name: "app"}}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Get(ctx, req.NamespacedName, derivedSecret); err != nil {
+		t.Fatal(err)
+	}
+	if derivedSecret.Status.Error != "" {
+		t.Fatalf("Expected the reconcile to succeed, got %s", derivedSecret.Status.Error)
+	}
+	if fmt.Sprint(derivedSecret.Status.MissingReferences) != "[ref]" {
+		t.Fatalf("Expected the missing reference to be reported in the status, got %v", derivedSecret.Status.MissingReferences)
+	}
+	secret := corev1.Secret{}
+	if err := r.Get(ctx, req.NamespacedName, &secret); err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["password"]) != "missing default-password" {
+		t.Fatalf("Expected the template to see the missing reference and its default, got %q", secret.Data["password"])
+	}
+}
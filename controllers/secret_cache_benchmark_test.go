@@ -0,0 +1,103 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+)
+
+const (
+	benchmarkSecrets      = 5000
+	benchmarkSecretKeys   = 4
+	benchmarkSecretValues = 1024
+)
+
+// newBenchmarkSecret returns a Secret resembling one in a large cluster, such as a ServiceAccount token or TLS certificate
+func newBenchmarkSecret(ix int) *corev1.Secret {
+	secret := &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       fmt.Sprintf("tenant-%d", ix%100),
+			Name:            fmt.Sprintf("secret-%d", ix),
+			UID:             "00000000-0000-0000-0000-000000000000",
+			ResourceVersion: fmt.Sprintf("%d", ix),
+			Labels:          map[string]string{"app": fmt.Sprintf("app-%d", ix)},
+			ManagedFields: []metav1.ManagedFieldsEntry{{
+				Manager:    "kubectl",
+				Operation:  metav1.ManagedFieldsOperationApply,
+				APIVersion: "v1",
+				FieldsType: "FieldsV1",
+				FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:data":{"f:key-0":{},"f:key-1":{},"f:key-2":{},"f:key-3":{}},"f:metadata":{"f:labels":{"f:app":{}}}}`)},
+			}},
+		},
+		Data: make(map[string][]byte, benchmarkSecretKeys),
+	}
+	for key := 0; key < benchmarkSecretKeys; key++ {
+		secret.Data[fmt.Sprintf("key-%d", key)] = []byte(strings.Repeat("x", benchmarkSecretValues))
+	}
+	return secret
+}
+
+// benchmarkStore fills an informer store with objects, and reports the heap retained by the store
+func benchmarkStore(b *testing.B, toCached func(*corev1.Secret) interface{}) {
+	b.ReportAllocs()
+	var retained uint64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		store := toolscache.NewStore(toolscache.MetaNamespaceKeyFunc)
+		for ix := 0; ix < benchmarkSecrets; ix++ {
+			if err := store.Add(toCached(newBenchmarkSecret(ix))); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(store)
+		if after.HeapAlloc > before.HeapAlloc {
+			retained += after.HeapAlloc - before.HeapAlloc
+		}
+	}
+	b.ReportMetric(float64(retained)/float64(b.N), "retained-B/op")
+}
+
+// BenchmarkSecretCache compares the memory held by an informer store of full Secrets,
+// as the operator cached before only their metadata was cached, to a store of only their metadata.
+// It only measures the stores, not the manager's cache, which needs an API server
+func BenchmarkSecretCache(b *testing.B) {
+	b.Run("Full", func(b *testing.B) {
+		benchmarkStore(b, func(secret *corev1.Secret) interface{} {
+			return secret
+		})
+	})
+	b.Run("MetadataOnly", func(b *testing.B) {
+		benchmarkStore(b, func(secret *corev1.Secret) interface{} {
+			return &metav1.PartialObjectMetadata{TypeMeta: secret.TypeMeta, ObjectMeta: secret.ObjectMeta}
+		})
+	})
+}
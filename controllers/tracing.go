@@ -0,0 +1,236 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+// tracerName is the instrumentation name of the spans of the operator
+const tracerName = "github.com/meln5674/secrets-operator/controllers"
+
+// maxPendingTraces is the most watch events whose traces are continued by a single reconcile.
+// Events beyond this are still reconciled, but their traces end at the watch
+const maxPendingTraces = 16
+
+var (
+	attrDerivedSecretNamespace = attribute.Key("secrets.derivedsecret.namespace")
+	attrDerivedSecretName      = attribute.Key("secrets.derivedsecret.name")
+	attrReferences             = attribute.Key("secrets.references")
+	attrReferees               = attribute.Key("secrets.referees")
+	attrTargetNamespace        = attribute.Key("secrets.target.namespace")
+	attrTargetName             = attribute.Key("secrets.target.name")
+	attrOutcome                = attribute.Key("secrets.outcome")
+	attrEvent                  = attribute.Key("k8s.event")
+	attrVerb                   = attribute.Key("k8s.verb")
+	attrKind                   = attribute.Key("k8s.kind")
+	attrNamespace              = attribute.Key("k8s.namespace")
+	attrName                   = attribute.Key("k8s.name")
+)
+
+// tracerFor returns the operator's tracer from a provider, or the global provider if nil
+func tracerFor(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// endSpan records the outcome of an operation on its span, and ends it.
+// Only the reason is recorded for errors which may quote the contents of references, see redactedErrorMessage
+func endSpan(span trace.Span, err error) {
+	if err == nil {
+		span.SetAttributes(attrOutcome.String(secretsv1alpha1.ReasonSynced))
+		span.SetStatus(codes.Ok, "")
+		span.End()
+		return
+	}
+	reason := secretsv1alpha1.ReasonFailed
+	var stageErr *stageError
+	if errors.As(err, &stageErr) {
+		reason = stageErr.Reason
+	}
+	span.SetAttributes(attrOutcome.String(reason))
+	span.SetStatus(codes.Error, redactedErrorMessage(err))
+	span.End()
+}
+
+// tracingClient creates a span for each API call made through a client, as a child of the span in the context of the call.
+// Calls made outside of a trace, such as the reads of the cache by watches, are not traced
+type tracingClient struct {
+	client.Client
+	tracer trace.Tracer
+}
+
+var (
+	_ = client.Client(&tracingClient{})
+)
+
+// newTracingClient wraps a client to trace its calls. A nil client is left as-is
+func newTracingClient(c client.Client, tracer trace.Tracer) client.Client {
+	if c == nil {
+		return nil
+	}
+	if _, ok := c.(*tracingClient); ok {
+		return c
+	}
+	return &tracingClient{Client: c, tracer: tracer}
+}
+
+// start starts the span of an API call, if the context has a span to be its parent
+func (c *tracingClient) start(ctx context.Context, verb string, obj runtime.Object, namespace, name string) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	attrs := []attribute.KeyValue{attrVerb.String(verb)}
+	if namespace != "" || name != "" {
+		attrs = append(attrs, attrNamespace.String(namespace), attrName.String(name))
+	}
+	if gvk, err := apiutil.GVKForObject(obj, c.Scheme()); err == nil {
+		attrs = append(attrs, attrKind.String(gvk.Kind))
+	}
+	return c.tracer.Start(ctx, verb, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func (c *tracingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) (err error) {
+	ctx, span := c.start(ctx, "get", obj, key.Namespace, key.Name)
+	defer func() { endSpan(span, err) }()
+	return c.Client.Get(ctx, key, obj)
+}
+
+func (c *tracingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) (err error) {
+	ctx, span := c.start(ctx, "list", list, "", "")
+	defer func() { endSpan(span, err) }()
+	return c.Client.List(ctx, list, opts...)
+}
+
+func (c *tracingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) (err error) {
+	ctx, span := c.start(ctx, "create", obj, obj.GetNamespace(), obj.GetName())
+	defer func() { endSpan(span, err) }()
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *tracingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) (err error) {
+	ctx, span := c.start(ctx, "delete", obj, obj.GetNamespace(), obj.GetName())
+	defer func() { endSpan(span, err) }()
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+func (c *tracingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) (err error) {
+	ctx, span := c.start(ctx, "update", obj, obj.GetNamespace(), obj.GetName())
+	defer func() { endSpan(span, err) }()
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c *tracingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) (err error) {
+	ctx, span := c.start(ctx, "patch", obj, obj.GetNamespace(), obj.GetName())
+	defer func() { endSpan(span, err) }()
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func (c *tracingClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) (err error) {
+	ctx, span := c.start(ctx, "deletecollection", obj, obj.GetNamespace(), obj.GetName())
+	defer func() { endSpan(span, err) }()
+	return c.Client.DeleteAllOf(ctx, obj, opts...)
+}
+
+func (c *tracingClient) Status() client.StatusWriter {
+	return &tracingStatusWriter{StatusWriter: c.Client.Status(), client: c}
+}
+
+type tracingStatusWriter struct {
+	client.StatusWriter
+	client *tracingClient
+}
+
+func (w *tracingStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) (err error) {
+	ctx, span := w.client.start(ctx, "update status", obj, obj.GetNamespace(), obj.GetName())
+	defer func() { endSpan(span, err) }()
+	return w.StatusWriter.Update(ctx, obj, opts...)
+}
+
+func (w *tracingStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) (err error) {
+	ctx, span := w.client.start(ctx, "patch status", obj, obj.GetNamespace(), obj.GetName())
+	defer func() { endSpan(span, err) }()
+	return w.StatusWriter.Patch(ctx, obj, patch, opts...)
+}
+
+// pendingTraces holds the span contexts of the watch events which queued each request.
+// A reconcile request only carries the name of the object, so this is how the trace of the event that caused a reconcile
+// is continued by the reconcile
+type pendingTraces struct {
+	lock  sync.Mutex
+	spans map[types.NamespacedName][]trace.SpanContext
+}
+
+func newPendingTraces() *pendingTraces {
+	return &pendingTraces{spans: make(map[types.NamespacedName][]trace.SpanContext)}
+}
+
+// Add records that an event in a trace queued a request
+func (p *pendingTraces) Add(key types.NamespacedName, spanContext trace.SpanContext) {
+	if p == nil || !spanContext.IsValid() {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	spans := p.spans[key]
+	if len(spans) >= maxPendingTraces {
+		spans = spans[1:]
+	}
+	p.spans[key] = append(spans, spanContext)
+}
+
+// Take returns the span contexts of the events which queued a request since it was last reconciled
+func (p *pendingTraces) Take(key types.NamespacedName) []trace.SpanContext {
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	spans := p.spans[key]
+	delete(p.spans, key)
+	return spans
+}
+
+// continueTraces returns a context whose span is the most recent of a set of events, and links to the other events.
+// Several events for the same object are coalesced into a single reconcile, which continues the trace of the latest,
+// and links the rest
+func continueTraces(ctx context.Context, spans []trace.SpanContext) (context.Context, []trace.SpanStartOption) {
+	if len(spans) == 0 {
+		return ctx, nil
+	}
+	links := make([]trace.Link, 0, len(spans)-1)
+	for _, spanContext := range spans[:len(spans)-1] {
+		links = append(links, trace.Link{SpanContext: spanContext})
+	}
+	return trace.ContextWithRemoteSpanContext(ctx, spans[len(spans)-1]), []trace.SpanStartOption{trace.WithLinks(links...)}
+}
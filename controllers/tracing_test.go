@@ -0,0 +1,221 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+// applyAsMergeClient emulates server-side apply, which the fake client does not support, with merge patches
+type applyAsMergeClient struct {
+	*indexedClient
+}
+
+func (c *applyAsMergeClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() != types.ApplyPatchType {
+		return c.indexedClient.Patch(ctx, obj, patch, opts...)
+	}
+	err := c.indexedClient.Patch(ctx, obj, client.Merge)
+	if apierrors.IsNotFound(err) {
+		return c.indexedClient.Create(ctx, obj)
+	}
+	return err
+}
+
+// newTracedReconciler creates a DerivedSecretReconciler whose spans are recorded by an in-memory exporter
+func newTracedReconciler(t *testing.T, template string) (*DerivedSecretReconciler, *tracetest.InMemoryExporter) {
+	source := secretIn("app-ns", "source")
+	source.Data = map[string][]byte{"password": []byte("hunter2")}
+	derivedSecret := &secretsv1alpha1.DerivedSecret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app-ns", Name: "app"},
+		Spec: secretsv1alpha1.DerivedSecretSpec{
+			References: []secretsv1alpha1.SensitiveReference{secretRef("source", "")},
+			StringData: map[string]secretsv1alpha1.StringTarget{
+				"password": {TargetBase: secretsv1alpha1.TargetBase{Template: &template}},
+			},
+		},
+	}
+	c := &applyAsMergeClient{indexedClient: newIndexedClient(t, source, derivedSecret)}
+
+	exporter := tracetest.NewInMemoryExporter()
+	r := &DerivedSecretReconciler{
+		Client:         c,
+		Scheme:         c.Scheme(),
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)),
+	}
+	r.instrument()
+	return r, exporter
+}
+
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string, attrs ...attribute.KeyValue) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range spans {
+		if span.Name == name && hasAttributes(span, attrs...) {
+			return span
+		}
+	}
+	names := make([]string, 0, len(spans))
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	t.Fatalf("No span %q with attributes %v, got %v", name, attrs, names)
+	return tracetest.SpanStub{}
+}
+
+func hasAttributes(span tracetest.SpanStub, attrs ...attribute.KeyValue) bool {
+	for _, expected := range attrs {
+		found := false
+		for _, attr := range span.Attributes {
+			if attr == expected {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func expectParent(t *testing.T, child, parent tracetest.SpanStub) {
+	t.Helper()
+	if child.Parent.SpanID() != parent.SpanContext.SpanID() || child.SpanContext.TraceID() != parent.SpanContext.TraceID() {
+		t.Fatalf("Expected span %q to be a child of %q", child.Name, parent.Name)
+	}
+}
+
+func TestReconcileSpans(t *testing.T) {
+	r, exporter := newTracedReconciler(t, "{{ .References.ref.password | b64bin | b64dec }}")
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "app-ns", Name: "app"}}
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	root := findSpan(t, spans, "Reconcile DerivedSecret",
+		attrDerivedSecretNamespace.String("app-ns"),
+		attrDerivedSecretName.String("app"),
+		attrReferences.Int(1),
+		attrOutcome.String(secretsv1alpha1.ReasonSynced),
+	)
+	if root.Parent.IsValid() {
+		t.Fatalf("Expected a reconcile without a watch event to start a new trace")
+	}
+
+	for _, stage := range []string{"GetClientForSecret", "GetClientForReferences", "FetchReferences", "CreateSecret", "CleanInventory"} {
+		expectParent(t, findSpan(t, spans, stage, attrOutcome.String(secretsv1alpha1.ReasonSynced)), root)
+	}
+	fetch := findSpan(t, spans, "FetchReferences", attrReferences.Int(1))
+	expectParent(t, findSpan(t, spans, "get", attrKind.String("Secret"), attrName.String("source")), fetch)
+
+	create := findSpan(t, spans, "CreateSecret", attrTargetNamespace.String("app-ns"), attrTargetName.String("app"))
+	expectParent(t, findSpan(t, spans, "patch", attrKind.String("Secret"), attrNamespace.String("app-ns"), attrName.String("app")), create)
+
+	expectParent(t, findSpan(t, spans, "update status", attrKind.String("DerivedSecret")), root)
+}
+
+func TestReconcileSpanFailure(t *testing.T) {
+	r, exporter := newTracedReconciler(t, "{{ .References.ref.password | b64bin | b64dec | fail }}")
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "app-ns", Name: "app"}}
+	// A permanent error is recorded in the status, and not returned
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	root := findSpan(t, spans, "Reconcile DerivedSecret", attrOutcome.String(secretsv1alpha1.ReasonTemplateFailed))
+	if root.Status.Code != codes.Error {
+		t.Fatalf("Expected the reconcile span to have an error status, got %v", root.Status)
+	}
+	if strings.Contains(root.Status.Description, "hunter2") {
+		t.Fatalf("Span status quotes the contents of a reference: %s", root.Status.Description)
+	}
+	render := findSpan(t, spans, "CreateSecret", attrOutcome.String(secretsv1alpha1.ReasonTemplateFailed))
+	expectParent(t, render, root)
+	for _, span := range spans {
+		if span.Name == "patch" {
+			t.Fatalf("Expected no Secret to be written after a failed render")
+		}
+	}
+}
+
+func TestWatchEventTraceContinuesToReconcile(t *testing.T) {
+	r, exporter := newTracedReconciler(t, "{{ .References.ref.password | b64bin | b64dec }}")
+	q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer q.ShutDown()
+
+	watcher := &DerivedSecretSecretWatcher{DerivedSecretWatcher: DerivedSecretWatcher{Reconciler: r}}
+	watcher.Update(event.UpdateEvent{ObjectOld: secretIn("app-ns", "source"), ObjectNew: secretIn("app-ns", "source")}, q)
+	watcher.Update(event.UpdateEvent{ObjectOld: secretIn("app-ns", "source"), ObjectNew: secretIn("app-ns", "source")}, q)
+
+	item, _ := q.Get()
+	req := item.(reconcile.Request)
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	var watches tracetest.SpanStubs
+	for _, span := range spans {
+		if span.Name == "Watch Secret" {
+			watches = append(watches, span)
+		}
+	}
+	if len(watches) != 2 {
+		t.Fatalf("Expected a span for each watch event, got %d", len(watches))
+	}
+	for _, watch := range watches {
+		if !hasAttributes(watch, attrEvent.String("update"), attrReferees.Int(1), attrName.String("source")) {
+			t.Fatalf("Watch span is missing attributes: %v", watch.Attributes)
+		}
+	}
+
+	// The reconcile continues the trace of the latest event, and links to the earlier one
+	root := findSpan(t, spans, "Reconcile DerivedSecret")
+	expectParent(t, root, watches[1])
+	if len(root.Links) != 1 || root.Links[0].SpanContext.SpanID() != watches[0].SpanContext.SpanID() {
+		t.Fatalf("Expected the reconcile span to link to the earlier watch event, got %v", root.Links)
+	}
+	write := findSpan(t, spans, "patch", attrKind.String("Secret"))
+	expectParent(t, write, findSpan(t, spans, "CreateSecret"))
+	if write.SpanContext.TraceID() != watches[1].SpanContext.TraceID() {
+		t.Fatalf("Expected the write of the Secret to be in the trace of the watch event")
+	}
+
+	// The pending traces are consumed by the reconcile
+	if pending := r.traces.Take(req.NamespacedName); len(pending) != 0 {
+		t.Fatalf("Expected no pending traces after reconciling, got %d", len(pending))
+	}
+}
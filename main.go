@@ -18,22 +18,36 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"golang.org/x/time/rate"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlcontroller "sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	configv1alpha1 "github.com/meln5674/secrets-operator/api/config/v1alpha1"
 	mydomainv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
 	"github.com/meln5674/secrets-operator/controllers"
+	"github.com/meln5674/secrets-operator/model"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -50,44 +64,119 @@ func init() {
 }
 
 func main() {
-	var metricsAddr string
-	var enableLeaderElection bool
-	var probeAddr string
-	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
-	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
-	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
-		"Enable leader election for controller manager. "+
-			"Enabling this will ensure there is only one active controller manager.")
+	flags := &operatorFlags{}
+	flags.bind(flag.CommandLine)
 	opts := zap.Options{
 		Development: true,
 	}
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
-	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	// Every log, including those of controller-runtime, is redacted, so that the contents of Secrets are never logged
+	ctrl.SetLogger(controllers.NewRedactingLogger(zap.New(zap.UseFlagOptions(&opts))))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "0c756fb7.secrets.meln5674.github.com",
+	config, err := flags.load(flag.CommandLine)
+	if err != nil {
+		setupLog.Error(err, "invalid configuration", "path", flags.configFile)
+		os.Exit(1)
+	}
+	if err := model.RestrictFuncs(config.Templates.AllowedFunctions, config.Templates.DeniedFunctions); err != nil {
+		setupLog.Error(err, "invalid configuration")
+		os.Exit(1)
+	}
+	model.SetLimits(model.Limits{
+		MaxOutputBytes: *config.Templates.MaxOutputBytes,
+		Timeout:        config.Templates.Timeout.Duration,
+		MaxIterations:  *config.Templates.MaxIterations,
 	})
+
+	tracerProvider, err := newTracerProvider(context.Background(), config.Tracing)
+	if err != nil {
+		setupLog.Error(err, "unable to set up tracing")
+		os.Exit(1)
+	}
+	if tracerProvider != nil {
+		setupLog.Info("Exporting traces", "endpoint", config.Tracing.OTLPEndpoint)
+		otel.SetTracerProvider(tracerProvider)
+	}
+
+	namespaces := controllers.NamespaceScope{
+		WatchNamespaces:  config.Namespaces.Watch,
+		TargetNamespaces: config.Namespaces.Target,
+	}
+	if namespaces.Restricted() {
+		setupLog.Info("Restricting to namespaces", "watchNamespaces", namespaces.WatchNamespaces, "targetNamespaces", namespaces.TargetNamespaces)
+	}
+
+	options, err := ctrl.Options{
+		Scheme:                scheme,
+		NewCache:              namespaces.NewCache(),
+		ClientDisableCacheFor: controllers.UncachedObjects(),
+	}.AndFrom(config)
+	if err != nil {
+		setupLog.Error(err, "unable to apply configuration")
+		os.Exit(1)
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	impersonatingClients := controllers.NewImpersonatingClientCache(mgr, *config.Impersonation.CacheSize, config.Impersonation.CacheTTL.Duration)
+	if err = impersonatingClients.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ServiceAccount")
+		os.Exit(1)
+	}
 	if err = (&controllers.DerivedSecretReconciler{
-		Client:     mgr.GetClient(),
-		Scheme:     mgr.GetScheme(),
-		RestConfig: mgr.GetConfig(),
-		Manager:    mgr,
+		Client:                          mgr.GetClient(),
+		Scheme:                          mgr.GetScheme(),
+		ImpersonatingClients:            impersonatingClients,
+		RequireServiceAccountReferences: config.Reconcile.RequireServiceAccountReferences,
+		Namespaces:                      namespaces,
+		DefaultResyncInterval:           config.Reconcile.DefaultResyncInterval,
+		ControllerOptions:               controllerOptions(config, "DerivedSecret"),
+		Recorder:                        mgr.GetEventRecorderFor("derivedsecret-controller"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "DerivedSecret")
 		os.Exit(1)
 	}
+	if err = (&controllers.DerivedConfigMapReconciler{
+		Client:                          mgr.GetClient(),
+		Scheme:                          mgr.GetScheme(),
+		ImpersonatingClients:            impersonatingClients,
+		RequireServiceAccountReferences: config.Reconcile.RequireServiceAccountReferences,
+		Namespaces:                      namespaces,
+		DefaultResyncInterval:           config.Reconcile.DefaultResyncInterval,
+		ControllerOptions:               controllerOptions(config, "DerivedConfigMap"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "DerivedConfigMap")
+		os.Exit(1)
+	}
+	if namespaces.Restricted() {
+		// ClusterDerivedSecrets and Namespaces are cluster-scoped, and cannot be watched with namespace-scoped permissions
+		setupLog.Info("Not reconciling ClusterDerivedSecrets, as --watch-namespaces is set")
+	} else if config.Reconcile.RequireServiceAccountReferences {
+		// ClusterDerivedSecrets have no ServiceAccount, so their references could only be read with the operator's own privileges
+		setupLog.Info("Not reconciling ClusterDerivedSecrets, as --require-service-account-references is set")
+	} else if err = (&controllers.ClusterDerivedSecretReconciler{
+		Client:                mgr.GetClient(),
+		Scheme:                mgr.GetScheme(),
+		Namespaces:            namespaces,
+		DefaultResyncInterval: config.Reconcile.DefaultResyncInterval,
+		ControllerOptions:     controllerOptions(config, "ClusterDerivedSecret"),
+		Recorder:              mgr.GetEventRecorderFor("clusterderivedsecret-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ClusterDerivedSecret")
+		os.Exit(1)
+	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&controllers.DerivedSecretValidator{RequireServiceAccountReferences: config.Reconcile.RequireServiceAccountReferences}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "DerivedSecret")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -100,8 +189,148 @@ func main() {
 	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	err = mgr.Start(ctrl.SetupSignalHandler())
+	if tracerProvider != nil {
+		if err := tracerProvider.Shutdown(context.Background()); err != nil {
+			setupLog.Error(err, "unable to flush traces")
+		}
+	}
+	if err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
 }
+
+// newTracerProvider returns a provider which exports traces to the OTLP endpoint of a config, or nil if it has none
+func newTracerProvider(ctx context.Context, config configv1alpha1.TracingConfig) (*sdktrace.TracerProvider, error) {
+	if config.OTLPEndpoint == "" {
+		return nil, nil
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.OTLPEndpoint)}
+	if config.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("secrets-operator"))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*config.SamplingRatio))),
+	), nil
+}
+
+// controllerOptions returns the concurrency and rate limiting of the controller for a kind.
+// controller.groupKindConcurrency takes precedence over reconcile.maxConcurrentReconciles
+func controllerOptions(config *configv1alpha1.OperatorConfig, kind string) ctrlcontroller.Options {
+	options := ctrlcontroller.Options{MaxConcurrentReconciles: config.Reconcile.MaxConcurrentReconciles}
+	if config.Controller != nil {
+		groupKind := mydomainv1alpha1.GroupVersion.WithKind(kind).GroupKind().String()
+		if concurrency, ok := config.Controller.GroupKindConcurrency[groupKind]; ok {
+			options.MaxConcurrentReconciles = concurrency
+		}
+	}
+	rateLimiter := config.Reconcile.RateLimiter
+	options.RateLimiter = workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(rateLimiter.BaseDelay.Duration, rateLimiter.MaxDelay.Duration),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(rateLimiter.QPS), rateLimiter.Burst)},
+	)
+	return options
+}
+
+// operatorFlags holds the command line flags, which override the corresponding fields of the configuration file when set
+type operatorFlags struct {
+	configFile                      string
+	metricsAddr                     string
+	enableLeaderElection            bool
+	probeAddr                       string
+	maxConcurrentReconciles         int
+	impersonationCacheSize          int
+	impersonationCacheTTL           time.Duration
+	requireServiceAccountReferences bool
+	watchNamespaces                 string
+	targetNamespaces                string
+	otlpEndpoint                    string
+}
+
+// bind registers the flags with a flag set
+func (o *operatorFlags) bind(flags *flag.FlagSet) {
+	flags.StringVar(&o.configFile, "config", "",
+		"The operator configuration file, an OperatorConfig. "+
+			"Flags which are set override the corresponding fields of the file.")
+	flags.StringVar(&o.metricsAddr, "metrics-bind-address", configv1alpha1.DefaultMetricsBindAddress, "The address the metric endpoint binds to.")
+	flags.StringVar(&o.probeAddr, "health-probe-bind-address", configv1alpha1.DefaultHealthProbeBindAddress, "The address the probe endpoint binds to.")
+	flags.BoolVar(&o.enableLeaderElection, "leader-elect", false,
+		"Enable leader election for controller manager. "+
+			"Enabling this will ensure there is only one active controller manager.")
+	flags.IntVar(&o.maxConcurrentReconciles, "max-concurrent-reconciles", configv1alpha1.DefaultMaxConcurrentReconciles,
+		"How many resources of each kind may be reconciled at once.")
+	flags.IntVar(&o.impersonationCacheSize, "impersonation-cache-size", configv1alpha1.DefaultImpersonationCacheSize,
+		"The maximum number of clients impersonating ServiceAccounts to keep. 0 disables the limit.")
+	flags.DurationVar(&o.impersonationCacheTTL, "impersonation-cache-ttl", configv1alpha1.DefaultImpersonationCacheTTL,
+		"How long to keep a client impersonating a ServiceAccount before building a new one. 0 keeps clients until evicted.")
+	flags.BoolVar(&o.requireServiceAccountReferences, "require-service-account-references", false,
+		"Read the references of every DerivedSecret and DerivedConfigMap by impersonating its ServiceAccount, regardless of spec.referenceAccess. "+
+			"DerivedSecrets without a ServiceAccount are rejected, and ClusterDerivedSecrets, which have none, are not reconciled.")
+	flags.StringVar(&o.watchNamespaces, "watch-namespaces", "",
+		"Comma-separated namespaces to reconcile resources in and cache Secrets and ConfigMaps from. "+
+			"If set, only namespace-scoped permissions are needed, and ClusterDerivedSecrets are not reconciled. Defaults to all namespaces.")
+	flags.StringVar(&o.targetNamespaces, "target-namespaces", "",
+		"Comma-separated namespaces, in addition to the watched namespaces, that derived objects may be written to. "+
+			"If neither this nor --watch-namespaces is set, derived objects may be written to any namespace.")
+	flags.StringVar(&o.otlpEndpoint, "otlp-endpoint", "",
+		"The host and port of an OTLP/HTTP collector to export traces of reconciles to. Traces are not exported if not set.")
+}
+
+// load reads the configuration file, if any, overrides it with the flags which were set on the parsed flag set, and validates the result
+func (o *operatorFlags) load(flags *flag.FlagSet) (*configv1alpha1.OperatorConfig, error) {
+	config := configv1alpha1.NewOperatorConfig()
+	if o.configFile != "" {
+		var err error
+		config, err = configv1alpha1.LoadOperatorConfig(o.configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "metrics-bind-address":
+			config.Metrics.BindAddress = o.metricsAddr
+		case "health-probe-bind-address":
+			config.Health.HealthProbeBindAddress = o.probeAddr
+		case "leader-elect":
+			config.LeaderElection.LeaderElect = &o.enableLeaderElection
+		case "max-concurrent-reconciles":
+			config.Reconcile.MaxConcurrentReconciles = o.maxConcurrentReconciles
+		case "impersonation-cache-size":
+			config.Impersonation.CacheSize = &o.impersonationCacheSize
+		case "impersonation-cache-ttl":
+			config.Impersonation.CacheTTL = &metav1.Duration{Duration: o.impersonationCacheTTL}
+		case "require-service-account-references":
+			config.Reconcile.RequireServiceAccountReferences = o.requireServiceAccountReferences
+		case "watch-namespaces":
+			config.Namespaces.Watch = splitNamespaces(o.watchNamespaces)
+		case "target-namespaces":
+			config.Namespaces.Target = splitNamespaces(o.targetNamespaces)
+		case "otlp-endpoint":
+			config.Tracing.OTLPEndpoint = o.otlpEndpoint
+		}
+	})
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// splitNamespaces parses a comma-separated list of namespaces, ignoring empty entries
+func splitNamespaces(list string) []string {
+	namespaces := []string{}
+	for _, namespace := range strings.Split(list, ",") {
+		namespace = strings.TrimSpace(namespace)
+		if namespace != "" {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2022 Andrew Melnick.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	configv1alpha1 "github.com/meln5674/secrets-operator/api/config/v1alpha1"
+)
+
+const testConfigFile = `apiVersion: config.secrets.meln5674.github.com/v1alpha1
+kind: OperatorConfig
+metrics:
+  bindAddress: ":9090"
+reconcile:
+  maxConcurrentReconciles: 4
+impersonation:
+  cacheTTL: 1m
+namespaces:
+  watch:
+  - app-ns
+`
+
+func loadFlags(t *testing.T, args ...string) (*configv1alpha1.OperatorConfig, error) {
+	flags := &operatorFlags{}
+	flagSet := flag.NewFlagSet("secrets-operator", flag.ContinueOnError)
+	flags.bind(flagSet)
+	if err := flagSet.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return flags.load(flagSet)
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadWithoutFile(t *testing.T) {
+	config, err := loadFlags(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Metrics.BindAddress != configv1alpha1.DefaultMetricsBindAddress || config.Reconcile.MaxConcurrentReconciles != configv1alpha1.DefaultMaxConcurrentReconciles {
+		t.Fatalf("Expected defaults, got metrics bind address %q and %d concurrent reconciles", config.Metrics.BindAddress, config.Reconcile.MaxConcurrentReconciles)
+	}
+	if len(config.Namespaces.Watch) != 0 {
+		t.Fatalf("Expected every namespace to be watched, got %v", config.Namespaces.Watch)
+	}
+}
+
+func TestLoadUnsetFlagsKeepFile(t *testing.T) {
+	config, err := loadFlags(t, "--config", writeConfigFile(t, testConfigFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Metrics.BindAddress != ":9090" || config.Reconcile.MaxConcurrentReconciles != 4 || config.Impersonation.CacheTTL.Duration != time.Minute {
+		t.Fatalf("Expected the file's values, got metrics bind address %q, %d concurrent reconciles, and cache TTL %s", config.Metrics.BindAddress, config.Reconcile.MaxConcurrentReconciles, config.Impersonation.CacheTTL.Duration)
+	}
+	if config.Health.HealthProbeBindAddress != configv1alpha1.DefaultHealthProbeBindAddress {
+		t.Fatalf("Expected the default for fields missing from the file, got %q", config.Health.HealthProbeBindAddress)
+	}
+}
+
+func TestLoadSetFlagsOverrideFile(t *testing.T) {
+	config, err := loadFlags(t,
+		"--config", writeConfigFile(t, testConfigFile),
+		"--metrics-bind-address", ":7070",
+		"--max-concurrent-reconciles", "1",
+		"--impersonation-cache-ttl", "0s",
+		"--watch-namespaces", "other-ns, shared",
+		"--leader-elect",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Metrics.BindAddress != ":7070" {
+		t.Errorf("Expected metrics bind address from the flag, got %q", config.Metrics.BindAddress)
+	}
+	// Flags set to their defaults must still win over the file
+	if config.Reconcile.MaxConcurrentReconciles != 1 || config.Impersonation.CacheTTL.Duration != 0 {
+		t.Errorf("Expected concurrent reconciles and cache TTL from the flags, got %d and %s", config.Reconcile.MaxConcurrentReconciles, config.Impersonation.CacheTTL.Duration)
+	}
+	if len(config.Namespaces.Watch) != 2 || config.Namespaces.Watch[0] != "other-ns" || config.Namespaces.Watch[1] != "shared" {
+		t.Errorf("Expected watch namespaces from the flag, got %v", config.Namespaces.Watch)
+	}
+	if !*config.LeaderElection.LeaderElect {
+		t.Errorf("Expected leader election to be enabled by the flag")
+	}
+}
+
+func TestLoadRejectsInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		args func(t *testing.T) []string
+	}{
+		{
+			name: "invalid flag",
+			args: func(t *testing.T) []string { return []string{"--max-concurrent-reconciles", "0"} },
+		},
+		{
+			name: "invalid flag overriding a valid file",
+			args: func(t *testing.T) []string {
+				return []string{"--config", writeConfigFile(t, testConfigFile), "--watch-namespaces", "Not_A_Namespace"}
+			},
+		},
+		{
+			name: "invalid file",
+			args: func(t *testing.T) []string {
+				return []string{"--config", writeConfigFile(t, testConfigFile+"tracing:\n  samplingRatio: 2\n")}
+			},
+		},
+		{
+			name: "unknown field",
+			args: func(t *testing.T) []string {
+				return []string{"--config", writeConfigFile(t, testConfigFile+"unknown: true\n")}
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := loadFlags(t, tc.args(t)...); err == nil {
+				t.Fatal("Expected the configuration to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package model
+
+import (
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func GenerateConfigMap(cmRefs map[string]corev1.ConfigMap, src *secretsv1alpha1.DerivedConfigMap) (configMap corev1.ConfigMap, noOverwrite map[string]struct{}, accessed []secretsv1alpha1.ReferenceSubset, err error) {
+	blank := corev1.ConfigMap{}
+	target := corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      strOrDefault(src.Spec.TargetName, src.Name),
+			Namespace: strOrDefault(src.Spec.TargetNamespace, src.Namespace),
+			Labels:    secretsv1alpha1.DerivedFromLabelValues(src),
+		},
+		Data:       make(map[string]string),
+		BinaryData: make(map[string][]byte),
+	}
+
+	noOverwrite, accessed, err = renderTargets(configMapReferences(src.Spec.References), cmRefs, nil, nil, src.Spec.Prefab, src.Spec.Strict, src.Spec.BinaryData, src.Spec.Data, configMapFields, target.Data, target.BinaryData)
+	if err != nil {
+		return blank, nil, nil, err
+	}
+	return target, noOverwrite, accessed, nil
+}
+
+// configMapReferences converts the references of a DerivedConfigMap to SensitiveReferences
+func configMapReferences(references []secretsv1alpha1.Reference) []secretsv1alpha1.SensitiveReference {
+	sensitive := make([]secretsv1alpha1.SensitiveReference, 0, len(references))
+	for ix := range references {
+		sensitive = append(sensitive, references[ix].AsSensitiveReference())
+	}
+	return sensitive
+}
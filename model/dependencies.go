@@ -0,0 +1,196 @@
+package model
+
+import (
+	"sort"
+	templates "text/template"
+	"text/template/parse"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+// referenceKey is a key of a reference which a template uses.
+// If Key is empty, the template uses the whole reference, and if Reference is also empty, it uses every reference
+type referenceKey struct {
+	Reference string
+	Key       string
+}
+
+// referenceKeys returns the references and keys which a template uses, in the order they appear.
+// Keys are found from .References.<reference>.<key>, $.References.<reference>.<key>, and index with constant keys.
+// Anything which uses a reference in a way that cannot be followed, such as passing it to a function, uses the whole reference
+func referenceKeys(tpl *templates.Template) []referenceKey {
+	w := referenceKeyWalker{}
+	for _, t := range tpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		// Associated templates are called with a pipeline, whose references are found where they are called
+		w.walk(t.Tree.Root, t.Name() != tpl.Name())
+	}
+	return w.keys
+}
+
+// referenceKeyWalker walks the parse tree of a template, collecting the references and keys it uses
+type referenceKeyWalker struct {
+	keys []referenceKey
+}
+
+// walk collects the references and keys used by a node.
+// If rebound is true, dot is not the template context, such as within a range or with,
+// so fields of dot are ignored, as its value was collected where it was bound
+func (w *referenceKeyWalker) walk(node parse.Node, rebound bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			w.walk(child, rebound)
+		}
+	case *parse.ActionNode:
+		w.walk(n.Pipe, rebound)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			w.walk(cmd, rebound)
+		}
+	case *parse.CommandNode:
+		w.walkCommand(n, rebound)
+	case *parse.IfNode:
+		w.walk(n.Pipe, rebound)
+		w.walk(n.List, rebound)
+		w.walk(n.ElseList, rebound)
+	case *parse.RangeNode:
+		w.walk(n.Pipe, rebound)
+		w.walk(n.List, true)
+		w.walk(n.ElseList, rebound)
+	case *parse.WithNode:
+		w.walk(n.Pipe, rebound)
+		w.walk(n.List, true)
+		w.walk(n.ElseList, rebound)
+	case *parse.TemplateNode:
+		w.walk(n.Pipe, rebound)
+	case *parse.ChainNode:
+		w.walk(n.Node, rebound)
+	case *parse.FieldNode, *parse.VariableNode, *parse.DotNode:
+		if ident, ok := contextIdent(n, rebound); ok {
+			w.add(ident)
+		}
+	}
+}
+
+// walkCommand collects the references and keys used by a command, following index with constant keys
+func (w *referenceKeyWalker) walkCommand(n *parse.CommandNode, rebound bool) {
+	args := n.Args
+	if len(args) >= 2 {
+		if fn, ok := args[0].(*parse.IdentifierNode); ok && fn.Ident == "index" {
+			if ident, ok := contextIdent(args[1], rebound); ok {
+				ident = append([]string{}, ident...)
+				args = args[2:]
+				for len(args) != 0 {
+					str, ok := args[0].(*parse.StringNode)
+					if !ok {
+						break
+					}
+					ident = append(ident, str.Text)
+					args = args[1:]
+				}
+				w.add(ident)
+			}
+		}
+	}
+	for _, arg := range args {
+		w.walk(arg, rebound)
+	}
+}
+
+// contextIdent returns the path of fields within the template context that a node refers to, if any
+func contextIdent(node parse.Node, rebound bool) ([]string, bool) {
+	switch n := node.(type) {
+	case *parse.FieldNode:
+		return n.Ident, !rebound
+	case *parse.DotNode:
+		return nil, !rebound
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" {
+			return n.Ident[1:], true
+		}
+	}
+	return nil, false
+}
+
+// add records the use of a path of fields within the template context
+func (w *referenceKeyWalker) add(ident []string) {
+	switch {
+	case len(ident) == 0:
+		w.keys = append(w.keys, referenceKey{})
+	case ident[0] != "References":
+		return
+	case len(ident) == 1:
+		w.keys = append(w.keys, referenceKey{})
+	case len(ident) == 2:
+		w.keys = append(w.keys, referenceKey{Reference: ident[1]})
+	default:
+		w.keys = append(w.keys, referenceKey{Reference: ident[1], Key: ident[2]})
+	}
+}
+
+// accessedKeys collects the keys of each reference which are used to render a derived object
+type accessedKeys struct {
+	every bool
+	whole map[string]struct{}
+	keys  map[string]map[string]struct{}
+}
+
+func newAccessedKeys() *accessedKeys {
+	return &accessedKeys{
+		whole: make(map[string]struct{}),
+		keys:  make(map[string]map[string]struct{}),
+	}
+}
+
+func (a *accessedKeys) add(used referenceKey) {
+	switch {
+	case used.Reference == "":
+		a.every = true
+	case used.Key == "":
+		a.whole[used.Reference] = struct{}{}
+	default:
+		if _, ok := a.keys[used.Reference]; !ok {
+			a.keys[used.Reference] = make(map[string]struct{})
+		}
+		a.keys[used.Reference][used.Key] = struct{}{}
+	}
+}
+
+func (a *accessedKeys) addTemplate(tpl *templates.Template) {
+	for _, used := range referenceKeys(tpl) {
+		a.add(used)
+	}
+}
+
+// subsets returns the keys used of each reference, in the order of the references, leaving out references which were not used
+func (a *accessedKeys) subsets(refSpecs []secretsv1alpha1.SensitiveReference) []secretsv1alpha1.ReferenceSubset {
+	subsets := []secretsv1alpha1.ReferenceSubset{}
+	for _, refSpec := range refSpecs {
+		_, whole := a.whole[refSpec.Name]
+		if a.every || whole {
+			allKeys := true
+			subsets = append(subsets, secretsv1alpha1.ReferenceSubset{Name: refSpec.Name, AllKeys: &allKeys})
+			continue
+		}
+		keys, ok := a.keys[refSpec.Name]
+		if !ok {
+			continue
+		}
+		subset := secretsv1alpha1.ReferenceSubset{Name: refSpec.Name, Keys: make([]string, 0, len(keys))}
+		for key := range keys {
+			subset.Keys = append(subset.Keys, key)
+		}
+		sort.Strings(subset.Keys)
+		subsets = append(subsets, subset)
+	}
+	return subsets
+}
@@ -0,0 +1,30 @@
+package model
+
+import (
+	"fmt"
+)
+
+// RenderError is an error produced while rendering a derived object, along with a machine-readable reason
+// from the v1alpha1 Reason constants
+type RenderError struct {
+	Reason string
+	// Key is the key of the derived object which failed to render, if the error is specific to one key
+	Key string
+	Err error
+}
+
+func (e *RenderError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+func renderErrorf(reason string, format string, args ...interface{}) error {
+	return &RenderError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+func keyRenderErrorf(key string, reason string, format string, args ...interface{}) error {
+	return &RenderError{Reason: reason, Key: key, Err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,538 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	templates "text/template"
+	"text/template/parse"
+	"time"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+var (
+	// UnsafeFuncs are functions which are never available to templates, as they would let anyone who can create a resource
+	// read the environment of the operator, such as cloud credentials, or probe the network from its pod
+	UnsafeFuncs = []string{"env", "expandenv", "getHostByName"}
+)
+
+// Limits bound the resources that a single execution of a template may use
+type Limits struct {
+	// MaxOutputBytes is the most output a template may produce, and the longest string any function may return. 0 disables the limit
+	MaxOutputBytes int
+	// Timeout is how long a template may execute. 0 disables the limit
+	Timeout time.Duration
+	// MaxIterations is the most steps a single execution may take. Every function call, every call of another template,
+	// every element ranged over, and every element produced by functions such as until and seq is a step.
+	// It is also the most elements a slice or map returned by a function may have. 0 disables the limit
+	MaxIterations int
+}
+
+var (
+	// DefaultLimits are the limits of templates unless SetLimits is called. A Secret cannot be larger than 1MiB
+	DefaultLimits = Limits{
+		MaxOutputBytes: 1024 * 1024,
+		Timeout:        time.Second,
+		MaxIterations:  10000,
+	}
+
+	limits = DefaultLimits
+)
+
+// SetLimits sets the limits of every template execution. It must be called before any templates are executed
+func SetLimits(l Limits) {
+	limits = l
+}
+
+// limitError is returned when a template exceeds one of its limits
+type limitError struct {
+	msg string
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+func limitErrorf(format string, args ...interface{}) error {
+	return &limitError{msg: fmt.Sprintf(format, args...)}
+}
+
+// execution tracks the resources used by a single execution of a template
+type execution struct {
+	limits     Limits
+	ctx        context.Context
+	iterations int
+	out        strings.Builder
+}
+
+func newExecution(ctx context.Context, l Limits) *execution {
+	return &execution{limits: l, ctx: ctx}
+}
+
+// checkCancelled fails once the execution has run for longer than its timeout, or has been abandoned.
+// It is checked on every write, function call, call of another template, and range, so that an abandoned execution stops soon after
+func (e *execution) checkCancelled() error {
+	select {
+	case <-e.ctx.Done():
+		return limitErrorf("did not finish within %s", e.limits.Timeout)
+	default:
+		return nil
+	}
+}
+
+// iterate charges steps against the iteration limit
+func (e *execution) iterate(count int) error {
+	if err := e.checkCancelled(); err != nil {
+		return err
+	}
+	e.iterations += count
+	if e.limits.MaxIterations > 0 && e.iterations > e.limits.MaxIterations {
+		return limitErrorf("took more than %d steps (function calls, template calls, range iterations, and sequence elements)", e.limits.MaxIterations)
+	}
+	return nil
+}
+
+// checkSize fails if a value would be larger than the output limit
+func (e *execution) checkSize(size int) error {
+	if err := e.checkCancelled(); err != nil {
+		return err
+	}
+	if e.limits.MaxOutputBytes > 0 && size > e.limits.MaxOutputBytes {
+		return limitErrorf("produced more than %d bytes", e.limits.MaxOutputBytes)
+	}
+	return nil
+}
+
+// checkRepeated fails if count copies of a value of some size, plus some extra bytes, would be larger than the output limit.
+// This is checked before the value is built, without overflowing
+func (e *execution) checkRepeated(count, size, extra int) error {
+	if count <= 0 || size <= 0 || e.limits.MaxOutputBytes <= 0 {
+		return e.checkSize(extra)
+	}
+	if count > e.limits.MaxOutputBytes/size {
+		return limitErrorf("produced more than %d bytes", e.limits.MaxOutputBytes)
+	}
+	return e.checkSize(count*size + extra)
+}
+
+// Write implements io.Writer for the output of the template, enforcing the output limit
+func (e *execution) Write(p []byte) (int, error) {
+	if err := e.checkSize(e.out.Len() + len(p)); err != nil {
+		return 0, err
+	}
+	return e.out.Write(p)
+}
+
+// stepCount is the number of elements in [start, stop) by step, as produced by until and untilStep
+func stepCount(start, stop, step int) int {
+	switch {
+	case stop > start && step > 0:
+		return (stop - start + step - 1) / step
+	case stop < start && step < 0:
+		return (start - stop - step - 1) / -step
+	default:
+		return 0
+	}
+}
+
+// seqCount is the number of elements produced by seq for its parameters
+func seqCount(params ...int) int {
+	switch len(params) {
+	case 1:
+		if params[0] < 1 {
+			return stepCount(1, params[0]-1, -1)
+		}
+		return stepCount(1, params[0]+1, 1)
+	case 2:
+		if params[1] < params[0] {
+			return stepCount(params[0], params[1]-1, -1)
+		}
+		return stepCount(params[0], params[1]+1, 1)
+	case 3:
+		if params[2] < params[0] {
+			return stepCount(params[0], params[2]-1, params[1])
+		}
+		return stepCount(params[0], params[2]+1, params[1])
+	default:
+		return 0
+	}
+}
+
+// boundedFuncs replaces the functions which can produce arbitrarily large sequences or strings
+// with versions that are charged against the limits of an execution.
+// Only functions which are available to templates are replaced
+func (e *execution) boundedFuncs(available templates.FuncMap) templates.FuncMap {
+	bounded := templates.FuncMap{
+		"until": func(count int) ([]int, error) {
+			if count < 0 {
+				return e.untilStep(available["until"], stepCount(0, count, -1), count)
+			}
+			return e.untilStep(available["until"], stepCount(0, count, 1), count)
+		},
+		"untilStep": func(start, stop, step int) ([]int, error) {
+			return e.untilStep(available["untilStep"], stepCount(start, stop, step), start, stop, step)
+		},
+		"seq": func(params ...int) (string, error) {
+			if err := e.iterate(seqCount(params...)); err != nil {
+				return "", err
+			}
+			return callString(available["seq"], params...), nil
+		},
+		"repeat": func(count int, str string) (string, error) {
+			if err := e.checkRepeated(count, len(str), 0); err != nil {
+				return "", err
+			}
+			return strings.Repeat(str, count), nil
+		},
+		"indent": func(spaces int, v string) (string, error) {
+			if err := e.checkIndent(spaces, v); err != nil {
+				return "", err
+			}
+			return available["indent"].(func(int, string) string)(spaces, v), nil
+		},
+		"nindent": func(spaces int, v string) (string, error) {
+			if err := e.checkIndent(spaces, v); err != nil {
+				return "", err
+			}
+			return available["nindent"].(func(int, string) string)(spaces, v), nil
+		},
+	}
+	for _, name := range []string{"randAlphaNum", "randAlpha", "randAscii", "randNumeric"} {
+		fn, ok := available[name].(func(int) string)
+		if !ok {
+			continue
+		}
+		bounded[name] = func(count int) (string, error) {
+			if err := e.checkSize(count); err != nil {
+				return "", err
+			}
+			return fn(count), nil
+		}
+	}
+	if fn, ok := available["randBytes"].(func(int) (string, error)); ok {
+		bounded["randBytes"] = func(count int) (string, error) {
+			if err := e.checkSize(count); err != nil {
+				return "", err
+			}
+			return fn(count)
+		}
+	}
+	for name := range bounded {
+		if _, ok := available[name]; !ok {
+			delete(bounded, name)
+		}
+	}
+	return bounded
+}
+
+func (e *execution) untilStep(fn interface{}, count int, args ...int) ([]int, error) {
+	if err := e.iterate(count); err != nil {
+		return nil, err
+	}
+	result := reflect.ValueOf(fn).Call(intValues(args))
+	return result[0].Interface().([]int), nil
+}
+
+// checkIndent fails if indenting each line of a value would make it larger than the output limit
+func (e *execution) checkIndent(spaces int, v string) error {
+	return e.checkRepeated(strings.Count(v, "\n")+2, spaces, len(v))
+}
+
+func callString(fn interface{}, args ...int) string {
+	return reflect.ValueOf(fn).Call(intValues(args))[0].String()
+}
+
+func intValues(args []int) []reflect.Value {
+	values := make([]reflect.Value, len(args))
+	for ix, arg := range args {
+		values[ix] = reflect.ValueOf(arg)
+	}
+	return values
+}
+
+// stepFunc and rangeFunc are added to the pipelines of templates by sandboxTemplate to charge steps which no function call does.
+// They are only defined once a template is executed, so templates which call them directly fail to parse
+const (
+	stepFunc  = "sandboxStep"
+	rangeFunc = "sandboxRange"
+)
+
+var (
+	// stringBuiltins are the builtin functions of text/template which build strings, so that they can be replaced with counted versions
+	stringBuiltins = templates.FuncMap{
+		"print":    fmt.Sprint,
+		"printf":   fmt.Sprintf,
+		"println":  fmt.Sprintln,
+		"html":     templates.HTMLEscaper,
+		"js":       templates.JSEscaper,
+		"urlquery": templates.URLQueryEscaper,
+	}
+	// otherBuiltins are the remaining builtin functions of text/template. They cannot be replaced without changing their behavior,
+	// so each call is charged by the stepFunc at the end of its pipeline instead
+	otherBuiltins = map[string]struct{}{
+		"and": {}, "or": {}, "not": {}, "call": {}, "index": {}, "slice": {}, "len": {},
+		"eq": {}, "ne": {}, "lt": {}, "le": {}, "gt": {}, "ge": {},
+	}
+
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// countedFuncs returns the functions used by a template, each of which is charged as a step, and has its result checked against the limits.
+// Functions which can produce arbitrarily large values are also checked before they are called
+func (e *execution) countedFuncs(available templates.FuncMap, used map[string]struct{}) templates.FuncMap {
+	bounded := e.boundedFuncs(available)
+	counted := templates.FuncMap{
+		stepFunc:  e.step,
+		rangeFunc: e.rangeStep,
+	}
+	for name := range used {
+		fn, ok := bounded[name]
+		if !ok {
+			fn, ok = available[name]
+		}
+		if !ok {
+			fn, ok = stringBuiltins[name]
+		}
+		if ok {
+			counted[name] = e.counted(fn)
+		}
+	}
+	return counted
+}
+
+// counted wraps a function so that each call is charged as a step, and its result is checked against the limits.
+// Functions which do not already return an error are given one
+func (e *execution) counted(fn interface{}) interface{} {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	returnsError := ft.NumOut() == 2 && ft.Out(1) == errorType
+	if ft.NumOut() != 1 && !returnsError {
+		return fn
+	}
+	wrappedType := ft
+	if !returnsError {
+		in := make([]reflect.Type, ft.NumIn())
+		for ix := range in {
+			in[ix] = ft.In(ix)
+		}
+		wrappedType = reflect.FuncOf(in, []reflect.Type{ft.Out(0), errorType}, ft.IsVariadic())
+	}
+	fail := func(err error) []reflect.Value {
+		return []reflect.Value{reflect.Zero(ft.Out(0)), reflect.ValueOf(&err).Elem()}
+	}
+	return reflect.MakeFunc(wrappedType, func(args []reflect.Value) []reflect.Value {
+		if err := e.iterate(1); err != nil {
+			return fail(err)
+		}
+		var results []reflect.Value
+		if ft.IsVariadic() {
+			results = fv.CallSlice(args)
+		} else {
+			results = fv.Call(args)
+		}
+		if returnsError && !results[1].IsNil() {
+			return results
+		}
+		if err := e.checkResult(results[0]); err != nil {
+			return fail(err)
+		}
+		if returnsError {
+			return results
+		}
+		return append(results, reflect.Zero(errorType))
+	}).Interface()
+}
+
+// checkResult fails if a function returned a string larger than the output limit, or a slice or map with more elements than the iteration limit
+func (e *execution) checkResult(v reflect.Value) error {
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	switch {
+	case v.Kind() == reflect.String, v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		return e.checkSize(v.Len())
+	case v.Kind() == reflect.Slice, v.Kind() == reflect.Array, v.Kind() == reflect.Map:
+		if e.limits.MaxIterations > 0 && v.Len() > e.limits.MaxIterations {
+			return limitErrorf("produced a value with more than %d elements", e.limits.MaxIterations)
+		}
+	}
+	return nil
+}
+
+// step charges the calls of builtin functions in a pipeline, and for a template action, the call of the template itself,
+// then passes on the value of the pipeline, if any
+func (e *execution) step(count int, value ...interface{}) (interface{}, error) {
+	if err := e.iterate(count); err != nil {
+		return nil, err
+	}
+	if len(value) == 0 {
+		return nil, nil
+	}
+	return value[0], nil
+}
+
+// rangeStep is step for the pipeline of a range action, which also charges every element that will be ranged over
+func (e *execution) rangeStep(count int, value interface{}) (interface{}, error) {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			break
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.String:
+		count += v.Len()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Int() > 0 {
+			count += int(v.Int())
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		count += int(v.Uint())
+	}
+	return e.step(count, value)
+}
+
+// sandboxTemplate charges the steps of a template, and of every template it defines, which are not function calls,
+// by adding a stepFunc or rangeFunc to the end of the pipelines of its actions. It returns the names of the functions the templates use.
+// Templates which have already been sandboxed are left as they are
+func sandboxTemplate(tpl *templates.Template) map[string]struct{} {
+	used := make(map[string]struct{})
+	for _, t := range tpl.Templates() {
+		if t.Tree != nil {
+			sandboxNode(t.Tree, t.Tree.Root, used)
+		}
+	}
+	return used
+}
+
+func sandboxNode(tree *parse.Tree, node parse.Node, used map[string]struct{}) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			sandboxNode(tree, child, used)
+		}
+	case *parse.ActionNode:
+		n.Pipe = sandboxPipe(tree, n.Pipe, stepFunc, 0, used)
+	case *parse.IfNode:
+		sandboxBranch(tree, &n.BranchNode, stepFunc, used)
+	case *parse.WithNode:
+		sandboxBranch(tree, &n.BranchNode, stepFunc, used)
+	case *parse.RangeNode:
+		sandboxBranch(tree, &n.BranchNode, rangeFunc, used)
+	case *parse.TemplateNode:
+		n.Pipe = sandboxPipe(tree, n.Pipe, stepFunc, 1, used)
+	}
+}
+
+func sandboxBranch(tree *parse.Tree, n *parse.BranchNode, fn string, used map[string]struct{}) {
+	n.Pipe = sandboxPipe(tree, n.Pipe, fn, 0, used)
+	sandboxNode(tree, n.List, used)
+	sandboxNode(tree, n.ElseList, used)
+}
+
+// sandboxPipe adds a call of fn to the end of a pipeline, which charges the builtin functions it calls, plus some extra steps.
+// Pipelines of other actions which call no builtin functions are left as they are
+func sandboxPipe(tree *parse.Tree, pipe *parse.PipeNode, fn string, extra int, used map[string]struct{}) *parse.PipeNode {
+	count := extra
+	if pipe != nil {
+		count += pipeFuncs(pipe, used)
+		if last := pipe.Cmds[len(pipe.Cmds)-1]; len(last.Args) != 0 {
+			if ident, ok := last.Args[0].(*parse.IdentifierNode); ok && (ident.Ident == stepFunc || ident.Ident == rangeFunc) {
+				return pipe
+			}
+		}
+	}
+	if count == 0 && fn == stepFunc {
+		return pipe
+	}
+	pos := parse.Pos(0)
+	if pipe == nil {
+		pipe = &parse.PipeNode{NodeType: parse.NodePipe}
+	} else {
+		pos = pipe.Position()
+	}
+	pipe.Cmds = append(pipe.Cmds, &parse.CommandNode{
+		NodeType: parse.NodeCommand,
+		Pos:      pos,
+		Args: []parse.Node{
+			parse.NewIdentifier(fn).SetTree(tree).SetPos(pos),
+			&parse.NumberNode{NodeType: parse.NodeNumber, Pos: pos, IsInt: true, Int64: int64(count), Text: strconv.Itoa(count)},
+		},
+	})
+	return pipe
+}
+
+// pipeFuncs records the functions a pipeline, including any nested pipelines, calls, and counts the calls of builtin functions
+func pipeFuncs(pipe *parse.PipeNode, used map[string]struct{}) int {
+	builtins := 0
+	for _, cmd := range pipe.Cmds {
+		for _, arg := range cmd.Args {
+			builtins += argFuncs(arg, used)
+		}
+	}
+	return builtins
+}
+
+func argFuncs(arg parse.Node, used map[string]struct{}) int {
+	switch n := arg.(type) {
+	case *parse.IdentifierNode:
+		used[n.Ident] = struct{}{}
+		if _, ok := otherBuiltins[n.Ident]; ok {
+			return 1
+		}
+	case *parse.PipeNode:
+		return pipeFuncs(n, used)
+	case *parse.ChainNode:
+		return argFuncs(n.Node, used)
+	}
+	return 0
+}
+
+// executeTemplate executes a template within the limits, returning its output.
+// If the template does not finish within the timeout, it is abandoned, and fails on its next step or write
+func executeTemplate(tpl *templates.Template, data interface{}) (string, error) {
+	ctx := context.Background()
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+	e := newExecution(ctx, limits)
+	tpl = tpl.Funcs(e.countedFuncs(funcs, sandboxTemplate(tpl)))
+
+	if e.limits.Timeout <= 0 {
+		err := tpl.Execute(e, data)
+		return e.out.String(), err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tpl.Execute(e, data)
+	}()
+	select {
+	case err := <-done:
+		return e.out.String(), err
+	case <-ctx.Done():
+		return "", limitErrorf("did not finish within %s", e.limits.Timeout)
+	}
+}
+
+// executeError converts an error executing a template for a key into a RenderError
+func executeError(key string, err error) error {
+	var limitErr *limitError
+	if errors.As(err, &limitErr) {
+		return keyRenderErrorf(key, secretsv1alpha1.ReasonTemplateLimitExceeded, "Template for key %s exceeded its limits: it %s", key, limitErr.msg)
+	}
+	return &RenderError{Reason: secretsv1alpha1.ReasonTemplateFailed, Key: key, Err: err}
+}
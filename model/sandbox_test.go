@@ -0,0 +1,174 @@
+package model
+
+import (
+	"errors"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withLimits sets the limits of templates for the rest of a test
+func withLimits(t *testing.T, l Limits) {
+	previous := limits
+	SetLimits(l)
+	t.Cleanup(func() { SetLimits(previous) })
+}
+
+func execute(t *testing.T, template string, data interface{}) (string, error) {
+	t.Helper()
+	tpl, err := parseTemplate("test", template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return executeTemplate(tpl, data)
+}
+
+func expectLimitExceeded(t *testing.T, err error, msg string) {
+	t.Helper()
+	var limitErr *limitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("Expected a limit to be exceeded, got %v", err)
+	}
+	if !strings.Contains(limitErr.msg, msg) {
+		t.Fatalf("Expected the limit error to contain %q, got %q", msg, limitErr.msg)
+	}
+}
+
+func TestSandboxAllowsTemplatesWithinLimits(t *testing.T) {
+	withLimits(t, DefaultLimits)
+	cases := []struct {
+		name     string
+		template string
+		data     interface{}
+		expected string
+	}{
+		{
+			name:     "range over map",
+			template: `{{ range $k, $v := . }}{{ $k }}={{ $v | upper }};{{ end }}`,
+			data:     map[string]string{"a": "x", "b": "y"},
+			expected: "a=X;b=Y;",
+		},
+		{
+			name:     "range over sequence",
+			template: `{{ range $i := until 3 }}{{ print $i }}{{ end }}`,
+			expected: "012",
+		},
+		{
+			name:     "short circuit",
+			template: `{{ if and . (index . 0) }}non-empty{{ else }}empty{{ end }}`,
+			data:     []string{},
+			expected: "empty",
+		},
+		{
+			name:     "defined templates",
+			template: `{{ define "greet" }}hello {{ . }}{{ end }}{{ template "greet" "world" }}{{ with $x := "!" }}{{ $x }}{{ end }}`,
+			expected: "hello world!",
+		},
+		{
+			name:     "missing value",
+			template: `{{ .missing }}`,
+			data:     map[string]interface{}{},
+			expected: "<no value>",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := execute(t, tc.template, tc.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != tc.expected {
+				t.Fatalf("Expected %q, got %q", tc.expected, out)
+			}
+		})
+	}
+}
+
+func TestSandboxRejectsTemplatesOverLimits(t *testing.T) {
+	withLimits(t, DefaultLimits)
+	manyKeys := make(map[string]string, DefaultLimits.MaxIterations+1)
+	for ix := 0; ix <= DefaultLimits.MaxIterations; ix++ {
+		manyKeys[strconv.Itoa(ix)] = "v"
+	}
+	cases := []struct {
+		name     string
+		template string
+		data     interface{}
+		msg      string
+	}{
+		{
+			name:     "string doubling",
+			template: `{{ $s := "x" }}{{ range until 64 }}{{ $s = print $s $s }}{{ end }}{{ len $s }}`,
+			msg:      "bytes",
+		},
+		{
+			name:     "string doubling with a sprig function",
+			template: `{{ $s := "x" }}{{ range until 64 }}{{ $s = cat $s $s }}{{ end }}{{ len $s }}`,
+			msg:      "bytes",
+		},
+		{
+			name:     "splitting a large string",
+			template: `{{ range splitList "" (repeat 1000000 "x") }}{{ end }}`,
+			msg:      "value with more than",
+		},
+		{
+			name:     "range over map",
+			template: `{{ range . }}{{ end }}`,
+			data:     manyKeys,
+			msg:      "steps",
+		},
+		{
+			name:     "range over reference bytes",
+			template: `{{ range .ref.password }}{{ end }}`,
+			data:     map[string]map[string][]byte{"ref": {"password": make([]byte, DefaultLimits.MaxIterations+1)}},
+			msg:      "steps",
+		},
+		{
+			name:     "function calls in range",
+			template: `{{ range until 5000 }}{{ upper "a" }}{{ end }}`,
+			msg:      "steps",
+		},
+		{
+			name:     "builtin calls in range",
+			template: `{{ range until 5000 }}{{ if eq 1 1 }}{{ end }}{{ end }}`,
+			msg:      "steps",
+		},
+		{
+			name:     "recursive templates",
+			template: `{{ define "a" }}{{ if lt (len .) 40 }}{{ template "a" (append . 1) }}{{ template "a" (append . 1) }}{{ end }}{{ end }}{{ template "a" list }}`,
+			msg:      "steps",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := execute(t, tc.template, tc.data)
+			expectLimitExceeded(t, err, tc.msg)
+		})
+	}
+}
+
+func TestSandboxStopsAbandonedExecutions(t *testing.T) {
+	withLimits(t, Limits{Timeout: 50 * time.Millisecond})
+	before := runtime.NumGoroutine()
+
+	_, err := execute(t, `{{ define "a" }}{{ if lt (len .) 60 }}{{ template "a" (append . 1) }}{{ template "a" (append . 1) }}{{ end }}{{ end }}{{ template "a" list }}`, nil)
+	expectLimitExceeded(t, err, "did not finish")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the abandoned execution to stop, %d goroutines are still running, %d were before", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSandboxFunctionsCannotBeCalledDirectly(t *testing.T) {
+	for _, name := range []string{stepFunc, rangeFunc} {
+		if _, err := parseTemplate("test", "{{ "+name+" 0 }}"); err == nil {
+			t.Fatalf("Expected a template calling %s to fail to parse", name)
+		}
+	}
+}
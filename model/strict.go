@@ -0,0 +1,77 @@
+package model
+
+import (
+	"strconv"
+	"strings"
+	templates "text/template"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+)
+
+// missingKeyMessage is how text/template reports a missing map key when executed with missingkey=error
+const missingKeyMessage = "map has no entry for key "
+
+// isStrict determines if a target is strict, given the strict field of the target, and of its resource
+func isStrict(resourceStrict, targetStrict *bool) bool {
+	if targetStrict != nil {
+		return *targetStrict
+	}
+	if resourceStrict != nil {
+		return *resourceStrict
+	}
+	return secretsv1alpha1.DefaultStrict
+}
+
+// executeTarget executes the template of a target, returning its output.
+// Strict templates fail if they use a reference or key which does not exist, or if they produce empty output
+func executeTarget(key string, tpl *templates.Template, context *TemplateContext, strict bool) (string, error) {
+	if strict {
+		tpl = tpl.Option("missingkey=error")
+	}
+	out, err := executeTemplate(tpl, context)
+	if err != nil && strict {
+		if keyErr := missingKeyError(key, tpl, context, err); keyErr != nil {
+			return "", keyErr
+		}
+	}
+	if err != nil {
+		return "", executeError(key, err)
+	}
+	if strict && out == "" {
+		return "", keyRenderErrorf(key, secretsv1alpha1.ReasonEmptyTemplateOutput, "Template for key %s produced empty output", key)
+	}
+	return out, nil
+}
+
+// missingKeyError explains the failure of a strict template to find a map key by naming the reference and key which do not exist.
+// It returns nil if the error was for any other reason, or if it names no reference or key the template uses, as the message may
+// then have been produced by the template itself, e.g. by fail, and is left to executeError
+func missingKeyError(key string, tpl *templates.Template, context *TemplateContext, err error) error {
+	msg := err.Error()
+	ix := strings.LastIndex(msg, missingKeyMessage)
+	if ix == -1 {
+		return nil
+	}
+	name, unquoteErr := strconv.Unquote(msg[ix+len(missingKeyMessage):])
+	if unquoteErr != nil {
+		name = ""
+	}
+
+	for _, used := range referenceKeys(tpl) {
+		ref, found := context.References[used.Reference]
+		switch {
+		case !found && used.Reference == name:
+			return keyRenderErrorf(key, secretsv1alpha1.ReasonMissingKey, "Template for key %s uses reference %s, which does not exist", key, used.Reference)
+		case !found || used.Key == "" || used.Key != name:
+			continue
+		}
+		if _, found := ref[used.Key]; found {
+			continue
+		}
+		if context.Missing[used.Reference] {
+			return keyRenderErrorf(key, secretsv1alpha1.ReasonMissingKey, "Template for key %s uses key %s of reference %s, which is optional and does not exist, and has no default for that key", key, used.Key, used.Reference)
+		}
+		return keyRenderErrorf(key, secretsv1alpha1.ReasonMissingKey, "Template for key %s uses key %s of reference %s, which does not exist", key, used.Key, used.Reference)
+	}
+	return nil
+}
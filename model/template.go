@@ -0,0 +1,469 @@
+package model
+
+import (
+	"encoding/base64"
+	"fmt"
+	sprig "github.com/Masterminds/sprig/v3"
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	templates "text/template"
+)
+
+var (
+	CustomFuncs = map[string]interface{}{
+		"b64bin": base64.StdEncoding.EncodeToString,
+		"utf8":   func(x []byte) string { return string(x) },
+	}
+)
+
+// funcs are the functions available to templates
+var funcs = allFuncs()
+
+// allFuncs returns every function that templates may be allowed to use
+func allFuncs() templates.FuncMap {
+	all := sprig.TxtFuncMap()
+	for _, name := range UnsafeFuncs {
+		delete(all, name)
+	}
+	for name, fn := range CustomFuncs {
+		all[name] = fn
+	}
+	return all
+}
+
+// FuncNames returns the names of every function that templates may be allowed to use
+func FuncNames() []string {
+	all := allFuncs()
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RestrictFuncs limits templates to the allowed functions, or every function if none are allowed, except for the denied functions.
+// Templates which use any other function fail to parse. It must be called before any templates are parsed
+func RestrictFuncs(allowed, denied []string) error {
+	all := allFuncs()
+	unknown := []string{}
+	unsafe := []string{}
+	checkKnown := func(name string) bool {
+		if _, ok := all[name]; ok {
+			return true
+		}
+		for _, unsafeName := range UnsafeFuncs {
+			if name == unsafeName {
+				unsafe = append(unsafe, name)
+				return false
+			}
+		}
+		unknown = append(unknown, name)
+		return false
+	}
+
+	restricted := all
+	if len(allowed) != 0 {
+		restricted = make(templates.FuncMap, len(allowed))
+		for _, name := range allowed {
+			if checkKnown(name) {
+				restricted[name] = all[name]
+			}
+		}
+	}
+	for _, name := range denied {
+		if checkKnown(name) {
+			delete(restricted, name)
+		}
+	}
+	if len(unsafe) != 0 {
+		return fmt.Errorf("Template functions are never available, as they expose the environment of the operator: %s", strings.Join(unsafe, ", "))
+	}
+	if len(unknown) != 0 {
+		return fmt.Errorf("Unknown template functions: %s", strings.Join(unknown, ", "))
+	}
+	funcs = restricted
+	return nil
+}
+
+type TemplateContext struct {
+	// References are the keys of each reference, including defaults for keys which are not present
+	References map[string]map[string]interface{}
+	// Missing is true for each optional reference which does not exist, and false for every other reference
+	Missing map[string]bool
+	// Current is the contents of the target Secret as it was before rendering, or empty if it does not exist
+	Current map[string][]byte
+}
+
+// MissingReferences returns the names of the references which were not fetched, because they are optional and do not exist
+func MissingReferences(refSpecs []secretsv1alpha1.SensitiveReference, cmRefs map[string]corev1.ConfigMap, sRefs map[string]corev1.Secret) []string {
+	var missing []string
+	for _, refSpec := range refSpecs {
+		_, isConfigMap := cmRefs[refSpec.Name]
+		_, isSecret := sRefs[refSpec.Name]
+		if !isConfigMap && !isSecret {
+			missing = append(missing, refSpec.Name)
+		}
+	}
+	return missing
+}
+
+// referenceContext builds the References and Missing of the template context from the fetched references,
+// filling in the defaults of each reference for keys which are not present
+func referenceContext(refSpecs []secretsv1alpha1.SensitiveReference, cmRefs map[string]corev1.ConfigMap, sRefs map[string]corev1.Secret) (references map[string]map[string]interface{}, missing map[string]bool) {
+	references = make(map[string]map[string]interface{})
+	for ref, cm := range cmRefs {
+		references[ref] = make(map[string]interface{})
+		for key, value := range cm.Data {
+			references[ref][key] = value
+		}
+		for key, value := range cm.BinaryData {
+			references[ref][key] = value
+		}
+	}
+	for ref, s := range sRefs {
+		references[ref] = make(map[string]interface{})
+		for key, value := range s.Data {
+			references[ref][key] = value
+		}
+		for key, value := range s.StringData {
+			references[ref][key] = value
+		}
+	}
+
+	missing = make(map[string]bool, len(refSpecs))
+	for _, refSpec := range refSpecs {
+		_, found := references[refSpec.Name]
+		missing[refSpec.Name] = !found
+		if !found {
+			references[refSpec.Name] = make(map[string]interface{}, len(refSpec.Defaults))
+		}
+		for key, value := range refSpec.Defaults {
+			if _, ok := references[refSpec.Name][key]; ok {
+				continue
+			}
+			if refSpec.SecretRef != nil {
+				references[refSpec.Name][key] = []byte(value)
+			} else {
+				references[refSpec.Name][key] = value
+			}
+		}
+	}
+	return references, missing
+}
+
+// referencesWithDefaults returns copies of the fetched references with the defaults of each reference filled in for keys which are not present,
+// so that prefabs copy the same keys templates see. Optional references which do not exist hold only their defaults
+func referencesWithDefaults(refSpecs []secretsv1alpha1.SensitiveReference, cmRefs map[string]corev1.ConfigMap, sRefs map[string]corev1.Secret) (map[string]corev1.ConfigMap, map[string]corev1.Secret) {
+	cmOut := make(map[string]corev1.ConfigMap, len(cmRefs))
+	for ref, cm := range cmRefs {
+		cmOut[ref] = cm
+	}
+	sOut := make(map[string]corev1.Secret, len(sRefs))
+	for ref, s := range sRefs {
+		sOut[ref] = s
+	}
+
+	for _, refSpec := range refSpecs {
+		if len(refSpec.Defaults) == 0 {
+			continue
+		}
+		if refSpec.SecretRef != nil {
+			s := sOut[refSpec.Name]
+			data := make(map[string][]byte, len(s.Data)+len(refSpec.Defaults))
+			for key, value := range s.Data {
+				data[key] = value
+			}
+			for key, value := range refSpec.Defaults {
+				if _, ok := data[key]; ok {
+					continue
+				}
+				if _, ok := s.StringData[key]; ok {
+					continue
+				}
+				data[key] = []byte(value)
+			}
+			s.Data = data
+			sOut[refSpec.Name] = s
+		} else {
+			cm := cmOut[refSpec.Name]
+			data := make(map[string]string, len(cm.Data)+len(refSpec.Defaults))
+			for key, value := range cm.Data {
+				data[key] = value
+			}
+			for key, value := range refSpec.Defaults {
+				if _, ok := data[key]; ok {
+					continue
+				}
+				if _, ok := cm.BinaryData[key]; ok {
+					continue
+				}
+				data[key] = value
+			}
+			cm.Data = data
+			cmOut[refSpec.Name] = cm
+		}
+	}
+	return cmOut, sOut
+}
+
+// targetFields are the names of the spec fields that hold string and binary targets, used when reporting errors
+type targetFields struct {
+	String string
+	Binary string
+}
+
+var (
+	secretFields    = targetFields{String: "stringData", Binary: "data"}
+	configMapFields = targetFields{String: "data", Binary: "binaryData"}
+)
+
+// parseTemplate parses a template with the same functions available to every template
+func parseTemplate(key, template string) (*templates.Template, error) {
+	return templates.New(key).Funcs(funcs).Parse(template)
+}
+
+// renderTargets evaluates either a prefab or a set of string and binary targets against a set of references,
+// storing the results in strOut and binOut, and returns the set of keys which should not be overwritten,
+// and the keys of each reference which the prefab or templates use.
+// current is the existing contents of the target, if any
+func renderTargets(refSpecs []secretsv1alpha1.SensitiveReference, cmRefs map[string]corev1.ConfigMap, sRefs map[string]corev1.Secret, current map[string][]byte, prefab *secretsv1alpha1.Prefabs, strict *bool, binTargets map[string]secretsv1alpha1.BinaryTarget, strTargets map[string]secretsv1alpha1.StringTarget, fields targetFields, strOut map[string]string, binOut map[string][]byte) (noOverwrite map[string]struct{}, accessed []secretsv1alpha1.ReferenceSubset, err error) {
+	if errs := validateTargets(field.NewPath("spec"), nil, prefab, binTargets, strTargets, fields); len(errs) != 0 {
+		return nil, nil, &RenderError{Reason: secretsv1alpha1.ReasonInvalidSpec, Err: errs.ToAggregate()}
+	}
+
+	noOverwrite = make(map[string]struct{})
+	used := newAccessedKeys()
+
+	for key, tgt := range binTargets {
+		overwrite := secretsv1alpha1.DefaultTargetOverwrite
+		if tgt.Overwrite != nil {
+			overwrite = *tgt.Overwrite
+		}
+		if !overwrite {
+			noOverwrite[key] = struct{}{}
+		}
+	}
+	for key, tgt := range strTargets {
+		overwrite := secretsv1alpha1.DefaultTargetOverwrite
+		if tgt.Overwrite != nil {
+			overwrite = *tgt.Overwrite
+		}
+		if !overwrite {
+			noOverwrite[key] = struct{}{}
+		}
+	}
+
+	references, missing := referenceContext(refSpecs, cmRefs, sRefs)
+	if prefab != nil {
+		cmRefs, sRefs = referencesWithDefaults(refSpecs, cmRefs, sRefs)
+	}
+	if prefab != nil && prefab.CopyAll != nil && *prefab.CopyAll {
+		used.add(referenceKey{})
+		knownKeys := make(map[string]string)
+		for ref, cm := range cmRefs {
+			collision, collidingKey, collided := copyMapPair(ref, knownKeys, strOut, cm.Data, binOut, cm.BinaryData)
+			if collided {
+				return nil, nil, renderErrorf(secretsv1alpha1.ReasonKeyCollision, "Key %s in reference %s was also present in reference %s when doing a prefab.copyAll", collidingKey, ref, collision)
+			}
+		}
+		for ref, s := range sRefs {
+			collision, collidingKey, collided := copyMapPair(ref, knownKeys, strOut, s.StringData, binOut, s.Data)
+			if collided {
+				return nil, nil, renderErrorf(secretsv1alpha1.ReasonKeyCollision, "Key %s in reference %s was also present in reference %s when doing a prefab.copyAll", collidingKey, ref, collision)
+			}
+		}
+		return noOverwrite, used.subsets(refSpecs), nil
+	}
+	if prefab != nil && len(prefab.CopyIncluding) != 0 {
+		included := make(map[string]map[string]struct{})
+		for _, include := range prefab.CopyIncluding {
+			included[include.Name] = make(map[string]struct{})
+			ref, ok := references[include.Name]
+			if !ok {
+				return nil, nil, renderErrorf(secretsv1alpha1.ReasonInvalidSpec, "prefab.copyInclude reference %s does not exist", include.Name)
+			}
+			if include.AllKeys != nil && *include.AllKeys {
+				used.add(referenceKey{Reference: include.Name})
+				for key, _ := range ref {
+					included[include.Name][key] = struct{}{}
+				}
+			} else {
+				for _, key := range include.Keys {
+					used.add(referenceKey{Reference: include.Name, Key: key})
+					included[include.Name][key] = struct{}{}
+				}
+			}
+		}
+
+		// References which are not listed are not copied at all, rather than copied as a whole
+		knownKeys := make(map[string]string)
+		for ref, cm := range cmRefs {
+			if _, ok := included[ref]; !ok {
+				continue
+			}
+			collision, collidingKey, collided := copyMapPairInclude(ref, knownKeys, included[ref], strOut, cm.Data, binOut, cm.BinaryData)
+			if collided {
+				return nil, nil, renderErrorf(secretsv1alpha1.ReasonKeyCollision, "Key %s in reference %s was also present in reference %s when doing a prefab.copyIncluding", collidingKey, ref, collision)
+			}
+		}
+		for ref, s := range sRefs {
+			if _, ok := included[ref]; !ok {
+				continue
+			}
+			collision, collidingKey, collided := copyMapPairInclude(ref, knownKeys, included[ref], strOut, s.StringData, binOut, s.Data)
+			if collided {
+				return nil, nil, renderErrorf(secretsv1alpha1.ReasonKeyCollision, "Key %s in reference %s was also present in reference %s when doing a prefab.copyIncluding", collidingKey, ref, collision)
+			}
+		}
+		return noOverwrite, used.subsets(refSpecs), nil
+
+	}
+	if prefab != nil && len(prefab.CopyExcluding) != 0 {
+		// Every key of every reference is copied, other than the excluded keys
+		used.add(referenceKey{})
+		excluded := make(map[string]map[string]struct{})
+		for _, exclude := range prefab.CopyExcluding {
+			excluded[exclude.Name] = make(map[string]struct{})
+			ref, ok := references[exclude.Name]
+			if !ok {
+				return nil, nil, renderErrorf(secretsv1alpha1.ReasonInvalidSpec, "prefab.copyExclude reference %s does not exist", exclude.Name)
+			}
+			if exclude.AllKeys != nil && *exclude.AllKeys {
+				for key, _ := range ref {
+					excluded[exclude.Name][key] = struct{}{}
+				}
+			} else {
+				for _, key := range exclude.Keys {
+					excluded[exclude.Name][key] = struct{}{}
+				}
+			}
+		}
+
+		knownKeys := make(map[string]string)
+		for ref, cm := range cmRefs {
+			collision, collidingKey, collided := copyMapPairExclude(ref, knownKeys, excluded[ref], strOut, cm.Data, binOut, cm.BinaryData)
+			if collided {
+				return nil, nil, renderErrorf(secretsv1alpha1.ReasonKeyCollision, "Key %s in reference %s was also present in reference %s when doing a prefab.copyExcluding", collidingKey, ref, collision)
+			}
+		}
+		for ref, s := range sRefs {
+			collision, collidingKey, collided := copyMapPairExclude(ref, knownKeys, excluded[ref], strOut, s.StringData, binOut, s.Data)
+			if collided {
+				return nil, nil, renderErrorf(secretsv1alpha1.ReasonKeyCollision, "Key %s in reference %s was also present in reference %s when doing a prefab.copyExcluding", collidingKey, ref, collision)
+			}
+		}
+		return noOverwrite, used.subsets(refSpecs), nil
+
+	}
+
+	knownKeys := make(map[string]struct{})
+	if current == nil {
+		current = make(map[string][]byte)
+	}
+	context := TemplateContext{References: references, Missing: missing, Current: current}
+	for key, tgt := range binTargets {
+		if _, collided := knownKeys[key]; collided {
+			return nil, nil, renderErrorf(secretsv1alpha1.ReasonKeyCollision, "Key %s appeared in multiple locations between %s, %s, and the output of map templates", key, fields.Binary, fields.String)
+		}
+		knownKeys[key] = struct{}{}
+
+		if tgt.Literal != nil {
+			binOut[key] = tgt.Literal
+			continue
+		}
+		var template string
+		if tgt.Template != nil {
+			template = *tgt.Template
+		}
+
+		tpl, err := parseTemplate(key, template)
+		if err != nil {
+			return nil, nil, keyRenderErrorf(key, secretsv1alpha1.ReasonInvalidTemplate, `Failed to parse spec.%s["%s"] as a template: %s`, fields.Binary, key, err)
+		}
+		used.addTemplate(tpl)
+
+		out, err := executeTarget(key, tpl, &context, isStrict(strict, tgt.Strict))
+		if err != nil {
+			return nil, nil, err
+		}
+		isMap := secretsv1alpha1.DefaultIsMap
+		if tgt.IsMap != nil {
+			isMap = *tgt.IsMap
+		}
+		if isMap {
+			delete(knownKeys, key)
+			mapData := make(map[string][]byte)
+			err := yaml.Unmarshal([]byte(out), &mapData)
+			if err != nil {
+				return nil, nil, keyRenderErrorf(key, secretsv1alpha1.ReasonInvalidTemplateOutput, `Failed to parse output of spec.%s["%s"] as yaml map of string to base64: %s`, fields.Binary, key, err)
+			}
+			for key, value := range mapData {
+				if _, collided := knownKeys[key]; collided {
+					return nil, nil, renderErrorf(secretsv1alpha1.ReasonKeyCollision, "Key %s appeared in multiple locations between %s, %s, and the output of map templates", key, fields.Binary, fields.String)
+				}
+				knownKeys[key] = struct{}{}
+				binOut[key] = value
+			}
+		} else {
+			binOut[key], err = base64.StdEncoding.DecodeString(out)
+			if err != nil {
+				return nil, nil, keyRenderErrorf(key, secretsv1alpha1.ReasonInvalidTemplateOutput, `Failed to decode spec.%s["%s"] output as base64: %s`, fields.Binary, key, err)
+			}
+		}
+
+	}
+	for key, tgt := range strTargets {
+		if _, collided := knownKeys[key]; collided {
+			return nil, nil, renderErrorf(secretsv1alpha1.ReasonKeyCollision, "Key %s appeared in multiple locations between %s, %s, and the output of map templates", key, fields.Binary, fields.String)
+		}
+		knownKeys[key] = struct{}{}
+
+		if tgt.Literal != nil {
+			strOut[key] = *tgt.Literal
+			continue
+		}
+		var template string
+		if tgt.Template != nil {
+			template = *tgt.Template
+		}
+
+		knownKeys[key] = struct{}{}
+		tpl, err := parseTemplate(key, template)
+		if err != nil {
+			return nil, nil, keyRenderErrorf(key, secretsv1alpha1.ReasonInvalidTemplate, `Failed to parse spec.%s["%s"] as a template: %s`, fields.String, key, err)
+		}
+		used.addTemplate(tpl)
+
+		out, err := executeTarget(key, tpl, &context, isStrict(strict, tgt.Strict))
+		if err != nil {
+			return nil, nil, err
+		}
+		isMap := secretsv1alpha1.DefaultIsMap
+		if tgt.IsMap != nil {
+			isMap = *tgt.IsMap
+		}
+		if isMap {
+			delete(knownKeys, key)
+			mapData := make(map[string]string)
+			err := yaml.Unmarshal([]byte(out), &mapData)
+			if err != nil {
+				return nil, nil, keyRenderErrorf(key, secretsv1alpha1.ReasonInvalidTemplateOutput, `Failed to parse output of spec.%s["%s"] as yaml map of string to string: %s`, fields.String, key, err)
+			}
+			for key, value := range mapData {
+				if _, collided := knownKeys[key]; collided {
+					return nil, nil, renderErrorf(secretsv1alpha1.ReasonKeyCollision, "Key %s appeared in multiple locations between %s, %s, and the output of map templates", key, fields.Binary, fields.String)
+				}
+				knownKeys[key] = struct{}{}
+				strOut[key] = value
+			}
+		} else {
+			strOut[key] = out
+		}
+	}
+	return noOverwrite, used.subsets(refSpecs), nil
+}
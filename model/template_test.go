@@ -0,0 +1,75 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPrefabsCopyDefaults(t *testing.T) {
+	optional := true
+	references := []secretsv1alpha1.SensitiveReference{
+		{
+			Name:      "db",
+			SecretRef: &secretsv1alpha1.SecretReference{SecretEnvSource: corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "db"}}},
+			Defaults:  map[string]string{"host": "ignored", "port": "5432"},
+		},
+		{
+			Name:         "extra",
+			ConfigMapRef: &secretsv1alpha1.ConfigMapReference{ConfigMapEnvSource: corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "extra"}, Optional: &optional}},
+			Defaults:     map[string]string{"region": "eu"},
+		},
+	}
+	sRefs := map[string]corev1.Secret{"db": {Data: map[string][]byte{"host": []byte("db.example")}}}
+
+	allKeys := true
+	cases := []struct {
+		name       string
+		prefab     secretsv1alpha1.Prefabs
+		data       map[string][]byte
+		stringData map[string]string
+	}{
+		{
+			name:       "copyAll",
+			prefab:     secretsv1alpha1.Prefabs{CopyAll: &allKeys},
+			data:       map[string][]byte{"host": []byte("db.example"), "port": []byte("5432")},
+			stringData: map[string]string{"region": "eu"},
+		},
+		{
+			name:   "copyIncluding",
+			prefab: secretsv1alpha1.Prefabs{CopyIncluding: []secretsv1alpha1.ReferenceSubset{{Name: "db", Keys: []string{"port"}}}},
+			data:   map[string][]byte{"port": []byte("5432")},
+		},
+		{
+			name:       "copyExcluding",
+			prefab:     secretsv1alpha1.Prefabs{CopyExcluding: []secretsv1alpha1.ReferenceSubset{{Name: "db", Keys: []string{"host"}}}},
+			data:       map[string][]byte{"port": []byte("5432")},
+			stringData: map[string]string{"region": "eu"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			prefab := tc.prefab
+			src := &secretsv1alpha1.DerivedSecret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "app-ns", Name: "app"},
+				Spec:       secretsv1alpha1.DerivedSecretSpec{References: references, Prefab: &prefab},
+			}
+			secret, _, _, err := GenerateSecret(nil, sRefs, nil, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.stringData == nil {
+				tc.stringData = map[string]string{}
+			}
+			if !reflect.DeepEqual(secret.Data, tc.data) || !reflect.DeepEqual(secret.StringData, tc.stringData) {
+				t.Fatalf("Expected data %v and stringData %v, got %v and %v", tc.data, tc.stringData, secret.Data, secret.StringData)
+			}
+		})
+	}
+	if _, ok := sRefs["db"].Data["port"]; ok {
+		t.Fatal("Expected the fetched reference to be left as is")
+	}
+}
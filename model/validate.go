@@ -0,0 +1,134 @@
+package model
+
+import (
+	secretsv1alpha1 "github.com/meln5674/secrets-operator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ValidateReferences checks that a set of references have unique names, and each specify exactly one source
+func ValidateReferences(path *field.Path, references []secretsv1alpha1.SensitiveReference) field.ErrorList {
+	errs := field.ErrorList{}
+	refKeys := make(map[string]struct{})
+	for ix, refInfo := range references {
+		refPath := path.Index(ix)
+		if _, collided := refKeys[refInfo.Name]; collided {
+			errs = append(errs, field.Duplicate(refPath.Child("name"), refInfo.Name))
+		}
+		refKeys[refInfo.Name] = struct{}{}
+		if refInfo.ConfigMapRef == nil && refInfo.SecretRef == nil {
+			errs = append(errs, field.Required(refPath, "one of configMapRef or secretRef must be set"))
+		}
+		if refInfo.ConfigMapRef != nil && refInfo.SecretRef != nil {
+			errs = append(errs, field.Forbidden(refPath, "only one of configMapRef or secretRef may be set"))
+		}
+	}
+	return errs
+}
+
+// validatePrefab checks that at most one prefab is used, that it is not used alongside templates,
+// and that it only uses references which exist
+func validatePrefab(path *field.Path, prefab *secretsv1alpha1.Prefabs, references map[string]struct{}, hasTargets bool, fields targetFields) field.ErrorList {
+	errs := field.ErrorList{}
+	if prefab == nil {
+		return errs
+	}
+	modes := 0
+	if prefab.CopyAll != nil && *prefab.CopyAll {
+		modes++
+	}
+	if len(prefab.CopyIncluding) != 0 {
+		modes++
+	}
+	if len(prefab.CopyExcluding) != 0 {
+		modes++
+	}
+	if modes > 1 {
+		errs = append(errs, field.Forbidden(path, "only one of copyAll, copyIncluding, or copyExcluding may be set"))
+	}
+	if modes != 0 && hasTargets {
+		errs = append(errs, field.Forbidden(path, "a prefab cannot be used alongside templates or literals in "+fields.Binary+" or "+fields.String))
+	}
+	if references == nil {
+		return errs
+	}
+	for ix, include := range prefab.CopyIncluding {
+		if _, ok := references[include.Name]; !ok {
+			errs = append(errs, field.NotFound(path.Child("copyIncluding").Index(ix).Child("name"), include.Name))
+		}
+	}
+	for ix, exclude := range prefab.CopyExcluding {
+		if _, ok := references[exclude.Name]; !ok {
+			errs = append(errs, field.NotFound(path.Child("copyExcluding").Index(ix).Child("name"), exclude.Name))
+		}
+	}
+	return errs
+}
+
+// validateTemplates checks that every template in a set of targets can be parsed
+func validateTemplates(specPath *field.Path, binTargets map[string]secretsv1alpha1.BinaryTarget, strTargets map[string]secretsv1alpha1.StringTarget, fields targetFields) field.ErrorList {
+	errs := field.ErrorList{}
+	for key, tgt := range binTargets {
+		if tgt.Template == nil {
+			continue
+		}
+		if _, err := parseTemplate(key, *tgt.Template); err != nil {
+			errs = append(errs, field.Invalid(specPath.Child(fields.Binary).Key(key).Child("template"), *tgt.Template, err.Error()))
+		}
+	}
+	for key, tgt := range strTargets {
+		if tgt.Template == nil {
+			continue
+		}
+		if _, err := parseTemplate(key, *tgt.Template); err != nil {
+			errs = append(errs, field.Invalid(specPath.Child(fields.String).Key(key).Child("template"), *tgt.Template, err.Error()))
+		}
+	}
+	return errs
+}
+
+// validateTargets checks a prefab and set of targets before they are rendered.
+// If references is nil, references used by the prefab are not checked
+func validateTargets(specPath *field.Path, references map[string]struct{}, prefab *secretsv1alpha1.Prefabs, binTargets map[string]secretsv1alpha1.BinaryTarget, strTargets map[string]secretsv1alpha1.StringTarget, fields targetFields) field.ErrorList {
+	// Targets with neither a template nor a literal only mark a key as not to be overwritten, which is allowed alongside a prefab
+	hasTargets := false
+	for _, tgt := range binTargets {
+		hasTargets = hasTargets || tgt.Template != nil || tgt.Literal != nil
+	}
+	for _, tgt := range strTargets {
+		hasTargets = hasTargets || tgt.Template != nil || tgt.Literal != nil
+	}
+	errs := validatePrefab(specPath.Child("prefab"), prefab, references, hasTargets, fields)
+	errs = append(errs, validateTemplates(specPath, binTargets, strTargets, fields)...)
+	return errs
+}
+
+// ValidateDerivedSecret performs every check on a DerivedSecret that can be done without fetching its references
+func ValidateDerivedSecret(src *secretsv1alpha1.DerivedSecret) field.ErrorList {
+	specPath := field.NewPath("spec")
+	errs := ValidateReferences(specPath.Child("references"), src.Spec.References)
+
+	references := make(map[string]struct{}, len(src.Spec.References))
+	crossNamespace := false
+	for ix := range src.Spec.References {
+		references[src.Spec.References[ix].Name] = struct{}{}
+		if src.Spec.References[ix].NamespaceOrDefault(src.Namespace) != src.Namespace {
+			crossNamespace = true
+		}
+	}
+	if src.Spec.ServiceAccountName == "" {
+		if src.Spec.TargetNamespace != "" && src.Spec.TargetNamespace != src.Namespace {
+			errs = append(errs, field.Required(specPath.Child("serviceAccountName"), "required when targetNamespace is a different namespace"))
+		} else if crossNamespace {
+			errs = append(errs, field.Required(specPath.Child("serviceAccountName"), "required when referencing a secret or configmap in another namespace"))
+		} else if src.Spec.ReferenceAccess == secretsv1alpha1.ReferenceAccessServiceAccount {
+			errs = append(errs, field.Required(specPath.Child("serviceAccountName"), "required when referenceAccess is "+string(secretsv1alpha1.ReferenceAccessServiceAccount)))
+		}
+	}
+
+	if src.Spec.ResyncInterval != nil && src.Spec.ResyncInterval.Duration <= 0 {
+		errs = append(errs, field.Invalid(specPath.Child("resyncInterval"), src.Spec.ResyncInterval.Duration.String(), "must be positive"))
+	}
+
+	errs = append(errs, validateTargets(specPath, references, src.Spec.Prefab, src.Spec.Data, src.Spec.StringData, secretFields)...)
+	return errs
+}